@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AuditEntry records one state-changing action. Before and After hold the
+// JSON form of the entity around the change and are null for creations and
+// deletions respectively.
+type AuditEntry struct {
+	ID         int             `json:"id"`
+	ActorID    int             `json:"actorID"`
+	ActorEmail string          `json:"actorEmail"`
+	Action     string          `json:"action"`
+	Entity     string          `json:"entity"`
+	EntityID   string          `json:"entityID"`
+	Before     json.RawMessage `json:"before"`
+	After      json.RawMessage `json:"after"`
+	CreatedAt  time.Time       `json:"createdAt"`
+}
+
+// AuditFilter narrows audit queries. Zero values mean "no restriction".
+type AuditFilter struct {
+	ActorID  int
+	Action   string
+	Entity   string
+	EntityID string
+	Since    time.Time
+	Until    time.Time
+	Limit    int
+}
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// createAuditTable creates the append-only audit_log table. The triggers
+// reject any attempt to rewrite or remove history.
+func createAuditTable() error {
+	createAuditTableSQL := []string{
+		`CREATE TABLE IF NOT EXISTS audit_log (
+        "ID" INTEGER PRIMARY KEY AUTOINCREMENT,
+        "ActorID" INTEGER NOT NULL DEFAULT 0,
+        "ActorEmail" TEXT NOT NULL DEFAULT '',
+        "Action" TEXT NOT NULL,
+        "Entity" TEXT NOT NULL,
+        "EntityID" TEXT NOT NULL DEFAULT '',
+        "Before" TEXT,
+        "After" TEXT,
+        "CreatedAt" TIMESTAMP NOT NULL
+    );`,
+		`CREATE INDEX IF NOT EXISTS audit_log_entity ON audit_log ("Entity", "EntityID");`,
+		`CREATE INDEX IF NOT EXISTS audit_log_created ON audit_log ("CreatedAt");`,
+		`CREATE TRIGGER IF NOT EXISTS audit_log_no_update BEFORE UPDATE ON audit_log
+    BEGIN SELECT RAISE(ABORT, 'audit_log is append-only'); END;`,
+		`CREATE TRIGGER IF NOT EXISTS audit_log_no_delete BEFORE DELETE ON audit_log
+    BEGIN SELECT RAISE(ABORT, 'audit_log is append-only'); END;`,
+	}
+
+	for _, stmt := range createAuditTableSQL {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// auditTx records a change made by the authenticated user of c through tx, the
+// Store of the transaction making the change, so that the change and its
+// audit row are committed together or not at all. before and after are
+// marshalled to JSON; pass nil where there is no state.
+func auditTx(c *gin.Context, tx *Store, action, entity, entityID string, before, after interface{}) error {
+	return tx.Audit.Record(auditEntry(c, action, entity, entityID, before, after))
+}
+
+// audit records a change that is not stored in the database, such as a cover
+// image or a backup file. The change has already been made, so failing to
+// write the audit row is logged but does not fail the request.
+func (s *Server) audit(c *gin.Context, action, entity, entityID string, before, after interface{}) {
+	if err := s.store.Audit.Record(auditEntry(c, action, entity, entityID, before, after)); err != nil {
+		requestLog(c).Error("writing audit log", "err", err)
+	}
+}
+
+func auditEntry(c *gin.Context, action, entity, entityID string, before, after interface{}) *AuditEntry {
+	entry := &AuditEntry{
+		Action:    action,
+		Entity:    entity,
+		EntityID:  entityID,
+		Before:    auditJSON(before),
+		After:     auditJSON(after),
+		CreatedAt: time.Now().UTC(),
+	}
+	if value, ok := c.Get("user"); ok {
+		actor := value.(User)
+		entry.ActorID = actor.ID
+		entry.ActorEmail = actor.Email
+	}
+	return entry
+}
+
+func auditJSON(value interface{}) json.RawMessage {
+	if value == nil {
+		return nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil || string(data) == "null" {
+		return nil
+	}
+	return data
+}
+
+// listAudit serves GET /owner/audit?actor=&action=&entity=&entityID=&since=&until=&limit=
+// with since and until in RFC 3339. Newest entries come first.
+func (s *Server) listAudit(c *gin.Context) {
+	filter := AuditFilter{
+		Action:   c.Query("action"),
+		Entity:   c.Query("entity"),
+		EntityID: c.Query("entityID"),
+		Limit:    defaultAuditLimit,
+	}
+
+	var err error
+	if actor := c.Query("actor"); actor != "" {
+		if filter.ActorID, err = strconv.Atoi(actor); err != nil {
+			respondError(c, badRequest("Invalid actor"))
+			return
+		}
+	}
+	if limit := c.Query("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil || filter.Limit <= 0 {
+			respondError(c, badRequest("Invalid limit"))
+			return
+		}
+		if filter.Limit > maxAuditLimit {
+			filter.Limit = maxAuditLimit
+		}
+	}
+	for name, dst := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := c.Query(name); value != "" {
+			if *dst, err = time.Parse(time.RFC3339, value); err != nil {
+				respondError(c, badRequest("Invalid "+name+", expected RFC 3339"))
+				return
+			}
+		}
+	}
+
+	entries, err := s.store.Audit.List(filter)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, entries)
+}
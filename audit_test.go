@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestAuditBookUpdate(t *testing.T) {
+	store, conn := newTestStore(t)
+	library, admin, book := seedLibrary(t, store, 1)
+	owner := &User{Name: "Owner", Email: "owner@example.org", Role: defaultOwnerRole, LibID: library.ID}
+	if err := store.Users.Create(owner); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{store: store}
+
+	w := serveAs(admin, "/books/:isbn", s.updateBook, http.MethodPut, "/books/"+book.ISBN, `{"title": "Renamed", "totalCopies": 1}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("update: %d %s", w.Code, w.Body.String())
+	}
+	w = serveAs(admin, "/books/:isbn", s.updateBook, http.MethodPut, "/books/"+book.ISBN, `{"title": ""}`)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("invalid update: %d %s", w.Code, w.Body.String())
+	}
+
+	w = serveAs(owner, "/owner/audit", s.listAudit, http.MethodGet, "/owner/audit?entity=book&actor="+strconv.Itoa(admin.ID), "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("list: %d %s", w.Code, w.Body.String())
+	}
+	var entries []AuditEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("got %d audit entries, want only the successful update", len(entries))
+	}
+	entry := entries[0]
+	if entry.Action != "update" || entry.EntityID != book.ISBN || entry.ActorEmail != admin.Email {
+		t.Errorf("entry = %+v", entry)
+	}
+	var before, after BookInventory
+	if err := json.Unmarshal(entry.Before, &before); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(entry.After, &after); err != nil {
+		t.Fatal(err)
+	}
+	if before.Title != "Title" || after.Title != "Renamed" {
+		t.Errorf("before %q, after %q; want Title and Renamed", before.Title, after.Title)
+	}
+
+	for _, query := range []string{"?actor=me", "?limit=0", "?since=yesterday"} {
+		if w := serveAs(owner, "/owner/audit", s.listAudit, http.MethodGet, "/owner/audit"+query, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", query, w.Code)
+		}
+	}
+
+	// History cannot be rewritten, even with direct database access
+	if _, err := conn.Exec("UPDATE audit_log SET Action = 'create'"); err == nil {
+		t.Error("audit_log row was updated")
+	}
+	if _, err := conn.Exec("DELETE FROM audit_log"); err == nil {
+		t.Error("audit_log row was deleted")
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const minPasswordLength = 12
+
+// knownDefaultPasswords are refused as new passwords. Passwords are checked
+// against them when they are set or, for rows still holding a plain password,
+// when the server starts and when the password is hashed at login.
+var knownDefaultPasswords = []string{"password", "admin", "owner", "root", "changeme", "123456", "12345678", "library"}
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+func isPasswordHash(stored string) bool {
+	return strings.HasPrefix(stored, "$2")
+}
+
+// checkPassword compares a login attempt with the stored value. Rows created
+// before hashing was introduced still hold the plain password; AuthMiddleware
+// rehashes those after a successful login.
+func checkPassword(stored, password string) bool {
+	if stored == "" {
+		return false
+	}
+	if isPasswordHash(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+}
+
+func generatePassword() (string, error) {
+	buf := make([]byte, 18)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func validateNewPassword(password, email string) error {
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+	if isKnownDefaultPassword(password) {
+		return errors.New("password is a well-known default")
+	}
+	if strings.EqualFold(password, email) {
+		return errors.New("password must not match the email address")
+	}
+	return nil
+}
+
+func isKnownDefaultPassword(password string) bool {
+	for _, known := range knownDefaultPasswords {
+		if strings.EqualFold(password, known) {
+			return true
+		}
+	}
+	return false
+}
+
+// createOwner adds an owner account for the given library, creating the
+// library when it does not exist yet. An empty password is replaced by a
+// generated one, which is returned so it can be shown to the operator once.
+// The owner must choose a new password at first login either way.
+func createOwner(store *Store, owner OwnerConfig) (string, error) {
+	if owner.Email == "" {
+		return "", errors.New("owner email is required")
+	}
+
+	password := owner.Password
+	if password == "" {
+		generated, err := generatePassword()
+		if err != nil {
+			return "", err
+		}
+		password = generated
+	} else if err := validateNewPassword(password, owner.Email); err != nil {
+		return "", fmt.Errorf("refusing owner password: %w", err)
+	}
+
+	exists, err := store.Libraries.Exists(owner.LibID)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		library := Library{Name: "Main Library"}
+		if err := store.Libraries.Create(&library); err != nil {
+			return "", err
+		}
+		owner.LibID = library.ID
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return "", err
+	}
+
+	user := User{
+		Name:               owner.Name,
+		Email:              owner.Email,
+		Contact:            owner.Contact,
+		Role:               defaultOwnerRole,
+		LibID:              owner.LibID,
+		Password:           hash,
+		MustChangePassword: true,
+	}
+	if err := store.Users.Create(&user); err != nil {
+		return "", err
+	}
+	return password, nil
+}
+
+// bootstrapOwner creates the initial owner from the configuration when the
+// database has none.
+func bootstrapOwner(store *Store, owner OwnerConfig) error {
+	owners, err := store.Users.ListByRole(defaultOwnerRole)
+	if err != nil {
+		return err
+	}
+	if len(owners) > 0 {
+		return nil
+	}
+
+	password, err := createOwner(store, owner)
+	if err != nil {
+		return err
+	}
+	if owner.Password == "" {
+		fmt.Printf("Created owner %s with one-time password %s\n", owner.Email, password)
+	} else {
+		fmt.Printf("Created owner %s with the configured password\n", owner.Email)
+	}
+	fmt.Println("The password must be changed at first login via POST /account/password")
+	return nil
+}
+
+// checkDefaultCredentials refuses to run while a privileged account can be
+// logged into with a well-known password. Only plain passwords are compared:
+// hashed ones were checked when they were set, and comparing hashes would
+// cost a bcrypt run per account and default on every start.
+func checkDefaultCredentials(store *Store) error {
+	for _, role := range []string{defaultOwnerRole, "admin"} {
+		users, err := store.Users.ListByRole(role)
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			if !isPasswordHash(user.Password) && isKnownDefaultPassword(user.Password) {
+				return fmt.Errorf("%s %s uses a well-known default password; reset it with create-owner -reset before starting the server", role, user.Email)
+			}
+		}
+	}
+	return nil
+}
+
+// runCreateOwnerCommand implements `create-owner -email ADDR [-name N]
+// [-password P] [-lib ID] [-reset]`. With -reset an existing account instead
+// gets a new password that must be changed at next login.
+func runCreateOwnerCommand(store *Store, defaults OwnerConfig, args []string) error {
+	owner := defaults
+	flags := flag.NewFlagSet("create-owner", flag.ExitOnError)
+	flags.StringVar(&owner.Email, "email", defaults.Email, "owner email address")
+	flags.StringVar(&owner.Name, "name", defaults.Name, "owner display name")
+	flags.StringVar(&owner.Password, "password", "", "initial password (generated when empty)")
+	flags.IntVar(&owner.LibID, "lib", defaults.LibID, "library the owner belongs to")
+	reset := flags.Bool("reset", false, "reset the password of an existing account")
+	flags.Parse(args)
+
+	existing, err := store.Users.GetByEmail(owner.Email)
+	if err != nil && !errors.Is(err, errNotFound) {
+		return err
+	}
+	if existing != nil && !*reset {
+		return fmt.Errorf("a user with email %s already exists; use -reset to replace its password", owner.Email)
+	}
+	if existing != nil {
+		password := owner.Password
+		if password == "" {
+			if password, err = generatePassword(); err != nil {
+				return err
+			}
+		} else if err := validateNewPassword(password, owner.Email); err != nil {
+			return err
+		}
+
+		hash, err := hashPassword(password)
+		if err != nil {
+			return err
+		}
+		if err := store.Users.SetPassword(existing.ID, hash, true); err != nil {
+			return err
+		}
+		if owner.Password == "" {
+			fmt.Printf("Reset password of %s to %s\n", owner.Email, password)
+		} else {
+			fmt.Printf("Reset password of %s to the given password\n", owner.Email)
+		}
+		return nil
+	}
+
+	password, err := createOwner(store, owner)
+	if err != nil {
+		return err
+	}
+	if owner.Password == "" {
+		fmt.Printf("Created owner %s with initial password %s\n", owner.Email, password)
+	} else {
+		fmt.Printf("Created owner %s with the given password\n", owner.Email)
+	}
+	return nil
+}
+
+type passwordChange struct {
+	NewPassword string `json:"newPassword"`
+}
+
+// changePassword lets any authenticated user replace their password. It is the
+// only route open to users whose password must be changed.
+func (s *Server) changePassword(c *gin.Context) {
+	user := c.MustGet("user").(User)
+	var change passwordChange
+
+	if err := c.ShouldBindJSON(&change); err != nil {
+		respondError(c, badRequest(err.Error()))
+		return
+	}
+
+	if err := validateNewPassword(change.NewPassword, user.Email); err != nil {
+		respondError(c, fieldError("newPassword", err.Error()))
+		return
+	}
+	if checkPassword(user.Password, change.NewPassword) {
+		respondError(c, fieldError("newPassword", "must differ from the current one"))
+		return
+	}
+
+	hash, err := hashPassword(change.NewPassword)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if err := s.store.Atomic(func(tx *Store) error {
+		if err := tx.Users.SetPassword(user.ID, hash, false); err != nil {
+			return err
+		}
+		return auditTx(c, tx, "change_password", "user", strconv.Itoa(user.ID), nil, nil)
+	}); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password changed"})
+}
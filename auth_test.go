@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCheckDefaultCredentials(t *testing.T) {
+	store, _ := newTestStore(t)
+	library, admin, _ := seedLibrary(t, store, 1)
+
+	if err := checkDefaultCredentials(store); err != nil {
+		t.Errorf("admin without a password: %v", err)
+	}
+	if err := store.Users.SetPassword(admin.ID, "ChangeMe", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkDefaultCredentials(store); err == nil {
+		t.Error("plain default password was not refused")
+	}
+	if err := store.Users.SetPassword(admin.ID, "a-long-legacy-password", false); err != nil {
+		t.Fatal(err)
+	}
+	reader := &User{Name: "Reader", Email: "reader@example.org", Role: "reader", LibID: library.ID, Password: "password"}
+	if err := store.Users.Create(reader); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkDefaultCredentials(store); err != nil {
+		t.Errorf("strong admin password and a reader with a default: %v", err)
+	}
+}
+
+func TestLoginWithLegacyDefaultPassword(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store, _ := newTestStore(t)
+	_, admin, _ := seedLibrary(t, store, 1)
+	if err := store.Users.SetPassword(admin.ID, "admin", false); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{config: defaultConfig(), store: store}
+	router := gin.New()
+	router.GET("/admin/stats", s.AuthMiddleware("admin"), func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/admin/stats", nil)
+	req.SetBasicAuth(admin.Email, "admin")
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), codePasswordChangeRequired) {
+		t.Errorf("login with a legacy default password: %d %s", w.Code, w.Body)
+	}
+
+	after, err := store.Users.Get(admin.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isPasswordHash(after.Password) || !after.MustChangePassword {
+		t.Errorf("password hashed %v, must change %v; want both", isPasswordHash(after.Password), after.MustChangePassword)
+	}
+}
+
+func TestCreateOwnerPrintsOnlyGeneratedPasswords(t *testing.T) {
+	store, _ := newTestStore(t)
+	output := func(args ...string) string {
+		t.Helper()
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stdout := os.Stdout
+		os.Stdout = w
+		err = runCreateOwnerCommand(store, OwnerConfig{Name: "Owner"}, args)
+		os.Stdout = stdout
+		w.Close()
+		printed, _ := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(printed)
+	}
+
+	const given = "a-given-owner-password"
+	if printed := output("-email", "owner@example.org", "-password", given); strings.Contains(printed, given) {
+		t.Errorf("given password printed: %q", printed)
+	}
+	if printed := output("-email", "owner@example.org", "-password", given+"-2", "-reset"); strings.Contains(printed, given) {
+		t.Errorf("given password printed on reset: %q", printed)
+	}
+	printed := output("-email", "owner@example.org", "-reset")
+	owner, err := store.Users.GetByEmail("owner@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := strings.Fields(printed)
+	if len(fields) == 0 || !checkPassword(owner.Password, fields[len(fields)-1]) {
+		t.Errorf("generated password not printed: %q", printed)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mattn/go-sqlite3"
+)
+
+var errBackupUnsupported = errors.New("backups are only supported for SQLite; use pg_dump for PostgreSQL")
+
+// backupTables must all be present in a snapshot before it is accepted.
+var backupTables = []string{"library", "users", "book_inventory", "RequestEvents", "IssueRegistery"}
+
+// Snapshot names carry nanoseconds so two backups taken in the same second
+// do not collide. backupParseFormat also reads names written before that,
+// since time.Parse accepts a fraction after the seconds.
+const (
+	backupTimeFormat  = "20060102-150405.000000000"
+	backupParseFormat = "20060102-150405"
+)
+
+type BackupInfo struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// BackupManager takes snapshots of the live SQLite database into Dir and
+// keeps the newest Retain of them.
+type BackupManager struct {
+	conn   *dbConn
+	Dir    string
+	Retain int
+}
+
+func NewBackupManager(conn *dbConn, cfg BackupConfig) *BackupManager {
+	return &BackupManager{conn: conn, Dir: cfg.Dir, Retain: cfg.Retain}
+}
+
+// Create writes a new snapshot to the backup directory and prunes old ones.
+func (m *BackupManager) Create() (BackupInfo, error) {
+	info, err := m.Snapshot()
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	return info, m.Prune()
+}
+
+// Snapshot writes a new verified snapshot to the backup directory without
+// applying the retention limit.
+func (m *BackupManager) Snapshot() (BackupInfo, error) {
+	if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+		return BackupInfo{}, err
+	}
+
+	now := time.Now().UTC()
+	name := "library-" + now.Format(backupTimeFormat) + ".db"
+	path := filepath.Join(m.Dir, name)
+	if err := backupDatabase(m.conn, path); err != nil {
+		return BackupInfo{}, err
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	return BackupInfo{Name: name, Size: stat.Size(), CreatedAt: now}, nil
+}
+
+// List returns the snapshots in the backup directory, newest first.
+func (m *BackupManager) List() ([]BackupInfo, error) {
+	entries, err := os.ReadDir(m.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []BackupInfo
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, "library-") || !strings.HasSuffix(name, ".db") {
+			continue
+		}
+		createdAt, err := time.Parse(backupParseFormat, strings.TrimSuffix(strings.TrimPrefix(name, "library-"), ".db"))
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		backups = append(backups, BackupInfo{Name: name, Size: info.Size(), CreatedAt: createdAt})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].CreatedAt.After(backups[j].CreatedAt) })
+	return backups, nil
+}
+
+// Prune deletes all but the newest Retain snapshots. A Retain of zero keeps
+// everything.
+func (m *BackupManager) Prune() error {
+	if m.Retain <= 0 {
+		return nil
+	}
+	backups, err := m.List()
+	if err != nil {
+		return err
+	}
+	for i := m.Retain; i < len(backups); i++ {
+		if err := os.Remove(filepath.Join(m.Dir, backups[i].Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Schedule takes a snapshot every interval until ctx is cancelled.
+func (m *BackupManager) Schedule(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := m.Create(); err != nil {
+				slog.Error("scheduled backup failed", "err", err)
+			}
+		}
+	}
+}
+
+// backupDatabase writes a consistent copy of the live database to path.
+// SQLite's VACUUM INTO reads inside a single transaction, so the server can
+// keep running while the snapshot is taken. The copy is written under a
+// temporary name and only renamed into place once it passes verifyBackup.
+func backupDatabase(conn *dbConn, path string) error {
+	if conn.dialect != dialectSQLite {
+		return errBackupUnsupported
+	}
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	}
+
+	tmp := path + ".partial"
+	os.Remove(tmp)
+	if _, err := conn.Exec("VACUUM INTO ?", tmp); err != nil {
+		return err
+	}
+	if err := verifyBackup(tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// verifyBackup opens a snapshot read-only and checks that it is an intact
+// library database.
+func verifyBackup(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	snapshot, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer snapshot.Close()
+
+	var result string
+	if err := snapshot.QueryRow("PRAGMA integrity_check").Scan(&result); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("%s failed the integrity check: %s", path, result)
+	}
+
+	for _, table := range backupTables {
+		var n int
+		if err := snapshot.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&n); err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("%s is not a library database: table %s is missing", path, table)
+		}
+	}
+	return nil
+}
+
+// restoreDatabase verifies the snapshot at path and copies it over the live
+// database with SQLite's online backup API, which replaces the content in a
+// single step. The server should be stopped while restoring.
+func restoreDatabase(conn *dbConn, path string) error {
+	if conn.dialect != dialectSQLite {
+		return errBackupUnsupported
+	}
+	if err := verifyBackup(path); err != nil {
+		return err
+	}
+
+	snapshot, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer snapshot.Close()
+
+	ctx := context.Background()
+	src, err := snapshot.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := conn.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	return dst.Raw(func(dstDriver interface{}) error {
+		return src.Raw(func(srcDriver interface{}) error {
+			backup, err := dstDriver.(*sqlite3.SQLiteConn).Backup("main", srcDriver.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			if _, err := backup.Step(-1); err != nil {
+				backup.Finish()
+				return err
+			}
+			return backup.Finish()
+		})
+	})
+}
+
+func (s *Server) listBackups(c *gin.Context) {
+	backups, err := s.backups.List()
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, backups)
+}
+
+func (s *Server) createBackup(c *gin.Context) {
+	info, err := s.backups.Create()
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	s.audit(c, "create", "backup", info.Name, nil, info)
+
+	c.JSON(http.StatusCreated, info)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackupRestoreRoundTrip(t *testing.T) {
+	store, conn := newTestStore(t)
+	_, _, book := seedLibrary(t, store, 2)
+	backups := NewBackupManager(conn, BackupConfig{Dir: t.TempDir()})
+
+	info, err := backups.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	book.Title = "Changed"
+	if err := store.Books.Update(book); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Libraries.Create(&Library{Name: "Branch"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restoreDatabase(conn, filepath.Join(backups.Dir, info.Name)); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := store.Books.Get(book.ISBN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Title != "Title" || restored.AvailableCopies != 2 {
+		t.Errorf("restored book = %q with %d copies, want the snapshot's %q with 2", restored.Title, restored.AvailableCopies, "Title")
+	}
+	libraries, err := store.Libraries.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(libraries) != 1 {
+		t.Errorf("restored %d libraries, want 1", len(libraries))
+	}
+}
+
+func TestBackupsInTheSameSecond(t *testing.T) {
+	_, conn := newTestStore(t)
+	backups := NewBackupManager(conn, BackupConfig{Dir: t.TempDir(), Retain: 2})
+
+	// A snapshot named before sub-second precision was added is still listed
+	old := filepath.Join(backups.Dir, "library-20240101-120000.db")
+	if err := os.WriteFile(old, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	infos, err := backups.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || !infos[0].CreatedAt.Equal(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Fatalf("List() = %+v, want the old snapshot from 2024-01-01 12:00", infos)
+	}
+
+	var names []string
+	for i := 0; i < 3; i++ {
+		info, err := backups.Snapshot()
+		if err != nil {
+			t.Fatalf("snapshot %d: %v", i, err)
+		}
+		names = append(names, info.Name)
+	}
+
+	infos, err = backups.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 4 {
+		t.Fatalf("listed %d snapshots, want 4", len(infos))
+	}
+	for i, name := range []string{names[2], names[1], names[0], filepath.Base(old)} {
+		if infos[i].Name != name {
+			t.Errorf("snapshot %d = %s, want %s", i, infos[i].Name, name)
+		}
+	}
+
+	if err := backups.Prune(); err != nil {
+		t.Fatal(err)
+	}
+	infos, err = backups.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 || infos[0].Name != names[2] || infos[1].Name != names[1] {
+		t.Errorf("after pruning = %+v, want the two newest snapshots", infos)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type Author struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type Subject struct {
+	ID      int    `json:"id"`
+	Heading string `json:"heading"`
+}
+
+// Links disappear with the book, author or subject they connect.
+const bookAuthorsSchema = `(
+        "ISBN" TEXT NOT NULL,
+        "AuthorID" INTEGER NOT NULL,
+        "Position" INTEGER NOT NULL DEFAULT 0,
+        PRIMARY KEY ("ISBN", "AuthorID"),
+        FOREIGN KEY ("ISBN") REFERENCES book_inventory("ISBN") ON DELETE CASCADE,
+        FOREIGN KEY ("AuthorID") REFERENCES authors("ID") ON DELETE CASCADE
+    );`
+
+const bookSubjectsSchema = `(
+        "ISBN" TEXT NOT NULL,
+        "SubjectID" INTEGER NOT NULL,
+        PRIMARY KEY ("ISBN", "SubjectID"),
+        FOREIGN KEY ("ISBN") REFERENCES book_inventory("ISBN") ON DELETE CASCADE,
+        FOREIGN KEY ("SubjectID") REFERENCES subjects("ID") ON DELETE CASCADE
+    );`
+
+func createCatalogTables() error {
+	createCatalogTablesSQL := []string{
+		`CREATE TABLE IF NOT EXISTS authors (
+        "ID" INTEGER PRIMARY KEY AUTOINCREMENT,
+        "Name" TEXT NOT NULL UNIQUE COLLATE NOCASE
+    );`,
+		`CREATE TABLE IF NOT EXISTS book_authors ` + bookAuthorsSchema,
+		`CREATE TABLE IF NOT EXISTS subjects (
+        "ID" INTEGER PRIMARY KEY AUTOINCREMENT,
+        "Heading" TEXT NOT NULL UNIQUE COLLATE NOCASE
+    );`,
+		`CREATE TABLE IF NOT EXISTS book_subjects ` + bookSubjectsSchema,
+	}
+
+	for _, stmt := range createCatalogTablesSQL {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	if err := rebuildTableIfOutdated("book_authors", bookAuthorsSchema, "ON DELETE"); err != nil {
+		return err
+	}
+	return rebuildTableIfOutdated("book_subjects", bookSubjectsSchema, "ON DELETE")
+}
+
+// addColumnIfMissing adds a column to an existing table. CREATE TABLE IF NOT EXISTS
+// leaves tables from older releases untouched, so new columns are added here.
+func addColumnIfMissing(table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("adding %s.%s: %w", table, column, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			return fmt.Errorf("adding %s.%s: %w", table, column, err)
+		}
+		if strings.EqualFold(name, column) {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("adding %s.%s: %w", table, column, err)
+	}
+	rows.Close()
+
+	_, err = db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN "%s" %s`, table, column, definition))
+	if err != nil {
+		return fmt.Errorf("adding %s.%s: %w", table, column, err)
+	}
+	return nil
+}
+
+// splitAuthors turns the legacy free-text Authors field into individual names.
+func splitAuthors(authors string) []Author {
+	var list []Author
+	for _, name := range strings.FieldsFunc(authors, func(r rune) bool { return r == ',' || r == ';' }) {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			list = append(list, Author{Name: name})
+		}
+	}
+	return list
+}
+
+// bookFilterFromQuery reads catalog filters from the query string: author,
+// subject, series, language, year, yearFrom and yearTo.
+func bookFilterFromQuery(c *gin.Context) BookFilter {
+	filter := BookFilter{
+		Author:   c.Query("author"),
+		Subject:  c.Query("subject"),
+		Series:   c.Query("series"),
+		Language: c.Query("language"),
+	}
+	filter.Year, _ = strconv.Atoi(c.Query("year"))
+	filter.YearFrom, _ = strconv.Atoi(c.Query("yearFrom"))
+	filter.YearTo, _ = strconv.Atoi(c.Query("yearTo"))
+	return filter
+}
+
+func (s *Server) listAuthors(c *gin.Context) {
+	authors, err := s.store.Books.ListAuthors()
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, authors)
+}
+
+func (s *Server) listSubjects(c *gin.Context) {
+	subjects, err := s.store.Books.ListSubjects()
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, subjects)
+}
+
+// listAvailableBooks serves GET /reader/books: the books of the reader's
+// library that have a copy on the shelf. It takes the same filters as
+// GET /books.
+func (s *Server) listAvailableBooks(c *gin.Context) {
+	reader := c.MustGet("user").(User)
+	filter := bookFilterFromQuery(c)
+	filter.LibID = reader.LibID
+
+	books, err := s.store.Books.List(filter)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	available := make([]BookInventory, 0, len(books))
+	for _, book := range books {
+		if book.AvailableCopies > 0 {
+			available = append(available, book)
+		}
+	}
+	c.JSON(http.StatusOK, available)
+}
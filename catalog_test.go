@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestBookMetadataSyncedWithRow(t *testing.T) {
+	store, conn := newTestStore(t)
+	library, _, book := seedLibrary(t, store, 1)
+
+	dune := &BookInventory{ISBN: "9780441172719", LibID: library.ID, Title: "Dune", Authors: "Frank Herbert; Brian Herbert", Subjects: []string{"Science fiction", " "}, TotalCopies: 1, AvailableCopies: 1}
+	if err := store.Books.Create(dune); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Books.Get(dune.ISBN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.AuthorList) != 2 || got.AuthorList[0].Name != "Frank Herbert" || len(got.Subjects) != 1 {
+		t.Errorf("stored metadata: authors %+v, subjects %q", got.AuthorList, got.Subjects)
+	}
+
+	// Without the link table the metadata cannot be written, and neither
+	// may the book row be
+	if _, err := conn.Exec("DROP TABLE book_subjects"); err != nil {
+		t.Fatal(err)
+	}
+	broken := &BookInventory{ISBN: "9780306406164", LibID: library.ID, Title: "Broken", Subjects: []string{"Lost"}, TotalCopies: 1, AvailableCopies: 1}
+	if err := store.Books.Create(broken); err == nil {
+		t.Fatal("Create succeeded without the subject links")
+	}
+	var rows int
+	if err := conn.QueryRow("SELECT COUNT(*) FROM book_inventory WHERE ISBN =?", broken.ISBN).Scan(&rows); err != nil || rows != 0 {
+		t.Errorf("book row kept after its metadata failed: %d rows, %v", rows, err)
+	}
+
+	book.Title = "Renamed"
+	book.Subjects = []string{"Lost"}
+	if err := store.Books.Update(book); err == nil {
+		t.Fatal("Update succeeded without the subject links")
+	}
+	var title string
+	if err := conn.QueryRow("SELECT Title FROM book_inventory WHERE ISBN =?", book.ISBN).Scan(&title); err != nil || title != "Title" {
+		t.Errorf("book row changed after its metadata failed: title %q, %v", title, err)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	requestTypeIssue  = "issue"
+	requestTypeReturn = "return"
+)
+
+const (
+	requestDecisionApproved = "approved"
+	requestDecisionRejected = "rejected"
+)
+
+var (
+	errAlreadyDecided     = errors.New("request has already been decided")
+	errNoCopiesAvailable  = errors.New("no copies available")
+	errLoanLimitReached   = errors.New("reader has reached the loan limit")
+	errNoOpenLoan         = errors.New("reader has no open loan of this book")
+	errUnknownRequestType = errors.New("request_type must be issue or return")
+	errCopiesOnLoan       = errors.New("totalCopies cannot be lower than the copies on loan")
+)
+
+// approveIssueRequest serves POST /admin/requests/:reqID. It lends or takes
+// back a copy on behalf of the signed-in admin, who may only decide requests
+// for books of their own library, and answers with the request and the loan
+// it opened or closed.
+func (s *Server) approveIssueRequest(c *gin.Context) {
+	id, ok := paramID(c, "reqID")
+	if !ok {
+		return
+	}
+	approver := c.MustGet("user").(User)
+
+	before, err := s.libraryRequest(id, approver.LibID)
+	if err != nil {
+		respondRequestError(c, err)
+		return
+	}
+	var loan *IssueRegistery
+	var request *RequestEvent
+	err = s.store.Atomic(func(tx *Store) error {
+		var err error
+		if loan, err = tx.Circulation.Approve(id, approver.ID, time.Now().UTC(), s.config.Circulation); err != nil {
+			return err
+		}
+		if request, err = tx.RequestEvents.Get(id); err != nil {
+			return err
+		}
+		if err := auditTx(c, tx, "approve", "request_event", strconv.Itoa(id), before, request); err != nil {
+			return err
+		}
+		if loan.IssueStatus == issueStatusReturned {
+			return auditTx(c, tx, "return", "issue", strconv.Itoa(loan.IssueID), nil, loan)
+		}
+		return auditTx(c, tx, "issue", "issue", strconv.Itoa(loan.IssueID), nil, loan)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, errNotFound):
+			respondError(c, notFoundError("RequestEvent not found"))
+		case errors.Is(err, errInvalidReference):
+			respondError(c, invalidReference("book_id or reader_id does not name an existing book or user"))
+		default:
+			respondError(c, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"request": request, "issue": loan})
+}
+
+// rejectIssueRequest serves POST /admin/requests/:reqID/reject. The optional
+// JSON body {"reason": "..."} is passed on to the reader.
+func (s *Server) rejectIssueRequest(c *gin.Context) {
+	id, ok := paramID(c, "reqID")
+	if !ok {
+		return
+	}
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&body); err != nil {
+			respondError(c, badRequest(err.Error()))
+			return
+		}
+	}
+	approver := c.MustGet("user").(User)
+
+	before, err := s.libraryRequest(id, approver.LibID)
+	if err != nil {
+		respondRequestError(c, err)
+		return
+	}
+	var request *RequestEvent
+	err = s.store.Atomic(func(tx *Store) error {
+		var err error
+		if request, err = tx.Circulation.Reject(id, approver.ID, body.Reason, time.Now().UTC()); err != nil {
+			return err
+		}
+		return auditTx(c, tx, "reject", "request_event", strconv.Itoa(id), before, request)
+	})
+	if err != nil {
+		respondRequestError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, request)
+}
+
+// libraryRequest returns request id if its book belongs to library libID.
+// Requests of other libraries are reported as errNotFound, so admins cannot
+// tell them from requests that do not exist.
+func (s *Server) libraryRequest(id, libID int) (*RequestEvent, error) {
+	request, err := s.store.RequestEvents.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.libraryBook(request.BookID, libID); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+func respondRequestError(c *gin.Context, err error) {
+	if errors.Is(err, errNotFound) {
+		respondError(c, notFoundError("RequestEvent not found"))
+		return
+	}
+	respondError(c, err)
+}
+
+// getReaderInfo serves GET /admin/readers/:readerID with a reader of the
+// admin's library and the reader's loans.
+func (s *Server) getReaderInfo(c *gin.Context) {
+	admin := c.MustGet("user").(User)
+	id, ok := paramID(c, "readerID")
+	if !ok {
+		return
+	}
+
+	reader, err := s.store.Users.Get(id)
+	if err != nil && !errors.Is(err, errNotFound) {
+		respondError(c, err)
+		return
+	}
+	if err != nil || !strings.EqualFold(reader.Role, "reader") || reader.LibID != admin.LibID {
+		respondError(c, notFoundError("Reader not found"))
+		return
+	}
+
+	issues, err := s.store.Issues.List()
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	loans := []IssueRegistery{}
+	for _, issue := range issues {
+		if issue.ReaderID == reader.ID {
+			loans = append(loans, issue)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"reader": reader, "loans": loans})
+}
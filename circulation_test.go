@@ -0,0 +1,293 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newTestStore opens a migrated SQLite database in a temporary directory with
+// the same connection options the server uses.
+func newTestStore(t *testing.T) (*Store, *dbConn) {
+	t.Helper()
+	conn, err := openDatabase(DatabaseConfig{
+		Driver:        string(dialectSQLite),
+		DSN:           filepath.Join(t.TempDir(), "library.db"),
+		BusyTimeoutMS: 5000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	// The migrations use the package level handle
+	db = conn.DB
+	if err := migrate(conn); err != nil {
+		t.Fatal(err)
+	}
+	return NewSQLStore(conn), conn
+}
+
+// seedLibrary adds a library with an admin and a book with copies copies.
+func seedLibrary(t *testing.T, store *Store, copies int) (*Library, *User, *BookInventory) {
+	t.Helper()
+	library := &Library{Name: "Central"}
+	if err := store.Libraries.Create(library); err != nil {
+		t.Fatal(err)
+	}
+	admin := &User{Name: "Admin", Email: "admin@example.org", Role: "admin", LibID: library.ID}
+	if err := store.Users.Create(admin); err != nil {
+		t.Fatal(err)
+	}
+	book := &BookInventory{ISBN: "9780306406157", LibID: library.ID, Title: "Title", TotalCopies: copies, AvailableCopies: copies}
+	if err := store.Books.Create(book); err != nil {
+		t.Fatal(err)
+	}
+	return library, admin, book
+}
+
+func TestApproveLastCopyConcurrently(t *testing.T) {
+	const readers = 20
+	store, _ := newTestStore(t)
+	library, admin, book := seedLibrary(t, store, 1)
+
+	requests := make([]int, readers)
+	for i := range requests {
+		reader := &User{Name: "Reader", Email: fmt.Sprintf("reader%d@example.org", i), Role: "reader", LibID: library.ID}
+		if err := store.Users.Create(reader); err != nil {
+			t.Fatal(err)
+		}
+		request := &RequestEvent{BookID: book.ISBN, ReaderID: reader.ID, RequestType: requestTypeIssue, RequestDate: time.Now().UTC()}
+		if err := store.RequestEvents.Create(request); err != nil {
+			t.Fatal(err)
+		}
+		requests[i] = request.ReqID
+	}
+
+	policy := CirculationConfig{LoanDays: 14, MaxLoansPerReader: 5}
+	errs := make([]error, readers)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i, reqID := range requests {
+		wg.Add(1)
+		go func(i, reqID int) {
+			defer wg.Done()
+			<-start
+			_, errs[i] = store.Circulation.Approve(reqID, admin.ID, time.Now().UTC(), policy)
+		}(i, reqID)
+	}
+	close(start)
+	wg.Wait()
+
+	approved := 0
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			approved++
+		case errors.Is(err, errNoCopiesAvailable):
+			if status := classifyError(err).Status; status != http.StatusConflict {
+				t.Errorf("errNoCopiesAvailable answered %d, want %d", status, http.StatusConflict)
+			}
+		default:
+			t.Errorf("Approve: %v", err)
+		}
+	}
+	if approved != 1 {
+		t.Errorf("%d approvals succeeded, want 1", approved)
+	}
+
+	after, err := store.Books.Get(book.ISBN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.AvailableCopies != 0 {
+		t.Errorf("AvailableCopies = %d, want 0", after.AvailableCopies)
+	}
+	open, err := store.Issues.CountOpen(LoanFilter{ISBN: book.ISBN})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if open != 1 {
+		t.Errorf("%d open loans, want 1", open)
+	}
+}
+
+func TestCreateRequestIgnoresDecision(t *testing.T) {
+	store, _ := newTestStore(t)
+	library, admin, book := seedLibrary(t, store, 1)
+	reader := &User{Name: "Reader", Email: "reader@example.org", Role: "reader", LibID: library.ID}
+	if err := store.Users.Create(reader); err != nil {
+		t.Fatal(err)
+	}
+
+	request := &RequestEvent{
+		BookID:      book.ISBN,
+		ReaderID:    reader.ID,
+		RequestType: requestTypeIssue,
+		ApproverID:  admin.ID,
+		Decision:    requestDecisionRejected,
+	}
+	if err := store.RequestEvents.Create(request); err != nil {
+		t.Fatal(err)
+	}
+	if request.ApproverID != 0 || request.Decision != "" {
+		t.Errorf("created request has approver %d and decision %q, want none", request.ApproverID, request.Decision)
+	}
+
+	if _, err := store.Circulation.Approve(request.ReqID, admin.ID, time.Now().UTC(), CirculationConfig{LoanDays: 14}); err != nil {
+		t.Fatalf("Approve: %v", err)
+	}
+	if _, err := store.Circulation.Approve(request.ReqID, admin.ID, time.Now().UTC(), CirculationConfig{LoanDays: 14}); !errors.Is(err, errAlreadyDecided) {
+		t.Errorf("second Approve = %v, want errAlreadyDecided", err)
+	}
+}
+
+func TestIssueChangesRecordEvents(t *testing.T) {
+	store, _ := newTestStore(t)
+	library, admin, book := seedLibrary(t, store, 1)
+	now := time.Now().UTC()
+
+	issue := &IssueRegistery{ISBN: book.ISBN, ReaderID: admin.ID, IssueApproverID: admin.ID, IssueStatus: issueStatusIssued, IssueDate: now, ExpectedReturnDate: now.AddDate(0, 0, 14)}
+	if err := store.Issues.Create(issue); err != nil {
+		t.Fatal(err)
+	}
+	issue.ExpectedReturnDate = now.AddDate(0, 0, 21)
+	if err := store.Issues.Update(issue); err != nil {
+		t.Fatal(err)
+	}
+	issue.IssueStatus = issueStatusReturned
+	issue.ReturnDate = now
+	if err := store.Issues.Update(issue); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := store.Outbox.After(0, library.ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []string
+	for _, entry := range entries {
+		if entry.Event != eventBookCreated {
+			events = append(events, entry.Event)
+		}
+	}
+	if fmt.Sprint(events) != fmt.Sprint([]string{eventIssueApproved, eventIssueReturned}) {
+		t.Errorf("recorded events %v, want [%s %s]", events, eventIssueApproved, eventIssueReturned)
+	}
+}
+
+func TestIssueRepositoryKeepsCopiesConsistent(t *testing.T) {
+	store, _ := newTestStore(t)
+	_, admin, book := seedLibrary(t, store, 2)
+	now := time.Now().UTC()
+
+	available := func(want int) {
+		t.Helper()
+		after, err := store.Books.Get(book.ISBN)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if after.AvailableCopies != want {
+			t.Errorf("AvailableCopies = %d, want %d", after.AvailableCopies, want)
+		}
+	}
+	newLoan := func(status string) (*IssueRegistery, error) {
+		loan := &IssueRegistery{ISBN: book.ISBN, ReaderID: admin.ID, IssueApproverID: admin.ID, IssueStatus: status, IssueDate: now, ExpectedReturnDate: now.AddDate(0, 0, 14)}
+		return loan, store.Issues.Create(loan)
+	}
+
+	first, err := newLoan(issueStatusIssued)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := newLoan(issueStatusOverdue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	available(0)
+	if _, err := newLoan(issueStatusIssued); !errors.Is(err, errNoCopiesAvailable) {
+		t.Errorf("loan without a copy on the shelf: %v, want errNoCopiesAvailable", err)
+	}
+	if _, err := newLoan(issueStatusReturned); err != nil {
+		t.Fatal(err)
+	}
+	available(0)
+
+	first.IssueStatus = issueStatusReturned
+	first.ReturnDate = now
+	if err := store.Issues.Update(first); err != nil {
+		t.Fatal(err)
+	}
+	available(1)
+	if err := store.Issues.Delete(second.IssueID); err != nil {
+		t.Fatal(err)
+	}
+	available(2)
+	if err := store.Issues.Delete(first.IssueID); err != nil {
+		t.Fatal(err)
+	}
+	available(2)
+
+	open, err := store.Issues.CountOpen(LoanFilter{ISBN: book.ISBN})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if open != 0 {
+		t.Errorf("%d open loans, want 0", open)
+	}
+}
+
+func TestDecideRequestOfOtherLibrary(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store, _ := newTestStore(t)
+	library, _, book := seedLibrary(t, store, 1)
+	reader := &User{Name: "Reader", Email: "reader@example.org", Role: "reader", LibID: library.ID}
+	if err := store.Users.Create(reader); err != nil {
+		t.Fatal(err)
+	}
+	request := &RequestEvent{BookID: book.ISBN, ReaderID: reader.ID, RequestType: requestTypeIssue, RequestDate: time.Now().UTC()}
+	if err := store.RequestEvents.Create(request); err != nil {
+		t.Fatal(err)
+	}
+
+	other := &Library{Name: "Elsewhere"}
+	if err := store.Libraries.Create(other); err != nil {
+		t.Fatal(err)
+	}
+	stranger := &User{Name: "Stranger", Email: "stranger@example.org", Role: "admin", LibID: other.ID}
+	if err := store.Users.Create(stranger); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{config: &Config{Circulation: CirculationConfig{LoanDays: 14}}, store: store}
+	router := gin.New()
+	router.Use(func(c *gin.Context) { c.Set("user", *stranger) })
+	router.POST("/admin/requests/:reqID", s.approveIssueRequest)
+	router.POST("/admin/requests/:reqID/reject", s.rejectIssueRequest)
+
+	for _, path := range []string{"/admin/requests/%d", "/admin/requests/%d/reject"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, fmt.Sprintf(path, request.ReqID), nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("POST %s by an admin of another library: %d, want %d", path, w.Code, http.StatusNotFound)
+		}
+	}
+
+	after, err := store.RequestEvents.Get(request.ReqID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Decision != "" {
+		t.Errorf("request was decided: %q", after.Decision)
+	}
+	if book, err := store.Books.Get(book.ISBN); err != nil || book.AvailableCopies != 1 {
+		t.Errorf("AvailableCopies changed: %v %v", book, err)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// app bundles what every subcommand needs once the configuration is loaded
+// and the database is open.
+type app struct {
+	config   *Config
+	conn     *dbConn
+	store    *Store
+	notifier Notifier
+}
+
+type command struct {
+	usage   string
+	summary string
+	run     func(a *app, args []string) error
+}
+
+// commands are the operator entry points of the binary. All of them work on
+// the configured database directly; only serve starts the HTTP server.
+var commands = map[string]command{
+	"serve": {
+		usage:   "serve",
+		summary: "run the HTTP server (default)",
+		run:     runServeCommand,
+	},
+	"migrate": {
+		usage:   "migrate",
+		summary: "create or upgrade the database schema and exit",
+		run: func(a *app, args []string) error {
+			fmt.Println("Schema is up to date")
+			return nil
+		},
+	},
+	"create-owner": {
+		usage:   "create-owner -email ADDR [-name N] [-password P] [-lib ID] [-reset]",
+		summary: "add an owner account or reset its password",
+		run: func(a *app, args []string) error {
+			return runCreateOwnerCommand(a.store, a.config.Owner, args)
+		},
+	},
+	"import-books": {
+		usage:   "import-books [-lib ID] [-format csv|ndjson] [-update] [-dry-run] FILE",
+		summary: "add books from a CSV or NDJSON file",
+		run: func(a *app, args []string) error {
+			return runImportCommand(a.store, args)
+		},
+	},
+	"export": {
+		usage:   "export [-lib ID] [-format csv|ndjson|marcxml] [-out FILE]",
+		summary: "write a library catalog to a file or stdout",
+		run: func(a *app, args []string) error {
+			return runExportCommand(a.store, args)
+		},
+	},
+	"backup": {
+		usage:   "backup [-out FILE] [-list]",
+		summary: "write a consistent snapshot of the database",
+		run:     runBackupCommand,
+	},
+	"restore": {
+		usage:   "restore FILE",
+		summary: "verify a snapshot and replace the database with it",
+		run:     runRestoreCommand,
+	},
+	"check": {
+		usage:   "check",
+		summary: "report rows that reference missing users, books or libraries",
+		run:     runCheckCommand,
+	},
+	"reindex": {
+		usage:   "reindex",
+		summary: "rebuild author and subject links and database indexes",
+		run:     runReindexCommand,
+	},
+	"test-email": {
+		usage:   "test-email -to ADDR [-event NAME] [-lib ID]",
+		summary: "render a notification with sample data and send it",
+		run:     runTestEmailCommand,
+	},
+	"run-jobs": {
+		usage:   "run-jobs [JOB ...]",
+		summary: "run maintenance jobs once (all jobs when none are named)",
+		run: func(a *app, args []string) error {
+			return runJobsCommand(a, args)
+		},
+	},
+}
+
+func printUsage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(os.Stderr, "usage: library [global flags] [command] [command flags]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-14s %s\n", name, commands[name].summary)
+		fmt.Fprintf(os.Stderr, "  %-14s   library %s\n", "", commands[name].usage)
+	}
+	fmt.Fprintln(os.Stderr, "\nglobal flags (-config, -db-driver, -db-dsn, ...) go before the command; see library -h")
+}
+
+// lookupCommand splits args into the command to run and its own arguments.
+func lookupCommand(args []string) (command, []string, error) {
+	if len(args) == 0 {
+		return commands["serve"], nil, nil
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return command{}, nil, fmt.Errorf("unknown command %q", args[0])
+	}
+	return cmd, args[1:], nil
+}
+
+func runServeCommand(a *app, args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	flags.Parse(args)
+
+	// First run: create the initial owner, and never serve with default credentials
+	if err := bootstrapOwner(a.store, a.config.Owner); err != nil {
+		return err
+	}
+	if err := checkDefaultCredentials(a.store); err != nil {
+		return err
+	}
+
+	if a.config.LogLevel != "debug" {
+		gin.SetMode(gin.ReleaseMode)
+	}
+
+	backups := NewBackupManager(a.conn, a.config.Backup)
+	if a.conn.dialect == dialectSQLite && a.config.Backup.IntervalHours > 0 {
+		go backups.Schedule(context.Background(), time.Duration(a.config.Backup.IntervalHours)*time.Hour)
+	}
+	events := NewEventHub()
+	go NewOutboxDispatcher(a.store, a.notifier, events).Run(context.Background(), time.Second)
+	go NewWebhookDispatcher(a.store).Run(context.Background(), 5*time.Second)
+	if a.config.Jobs.IntervalHours > 0 {
+		go scheduleJobs(context.Background(), a, time.Duration(a.config.Jobs.IntervalHours)*time.Hour)
+	}
+
+	server := NewServer(a.config, a.store, setupMetadataProvider(a.config.MetadataFile, a.config.MetadataURL), setupCoverStore(a.config.CoverDir), backups, a.notifier, events)
+	router := server.Router()
+	if a.config.TLS.CertFile != "" {
+		return router.RunTLS(a.config.ListenAddr, a.config.TLS.CertFile, a.config.TLS.KeyFile)
+	}
+	return router.Run(a.config.ListenAddr)
+}
+
+// runBackupCommand writes a snapshot into the configured backup directory,
+// applying the retention limit, or to -out when given.
+func runBackupCommand(a *app, args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	out := flags.String("out", "", "write the snapshot to this file instead of the backup directory")
+	list := flags.Bool("list", false, "list the snapshots in the backup directory")
+	flags.Parse(args)
+
+	backups := NewBackupManager(a.conn, a.config.Backup)
+	if *list {
+		infos, err := backups.List()
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			fmt.Printf("%s\t%d\t%s\n", info.Name, info.Size, info.CreatedAt.Format(time.RFC3339))
+		}
+		return nil
+	}
+
+	if *out != "" {
+		if err := backupDatabase(a.conn, *out); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote backup to %s\n", *out)
+		return nil
+	}
+
+	info, err := backups.Create()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Wrote backup to %s\n", filepath.Join(backups.Dir, info.Name))
+	return nil
+}
+
+// runRestoreCommand replaces the database with a verified snapshot. The
+// current content is saved to the backup directory first so a mistaken
+// restore can itself be undone.
+func runRestoreCommand(a *app, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("restore: exactly one snapshot file is required")
+	}
+	path := flags.Arg(0)
+
+	if err := verifyBackup(path); err != nil {
+		return err
+	}
+	// Not Create: pruning could delete the very snapshot being restored
+	safety, err := NewBackupManager(a.conn, a.config.Backup).Snapshot()
+	if err != nil {
+		return fmt.Errorf("saving the current database before restoring: %w", err)
+	}
+	fmt.Printf("Saved the current database as %s\n", safety.Name)
+
+	if err := restoreDatabase(a.conn, path); err != nil {
+		return err
+	}
+	// Snapshots from older releases may predate the current schema
+	if err := migrate(a.conn); err != nil {
+		return fmt.Errorf("upgrading the restored database: %w", err)
+	}
+	fmt.Printf("Restored %s\n", path)
+	return nil
+}
+
+func runReindexCommand(a *app, args []string) error {
+	flags := flag.NewFlagSet("reindex", flag.ExitOnError)
+	flags.Parse(args)
+
+	count, err := a.store.Books.Reindex()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Reindexed %d books\n", count)
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestLookupCommand(t *testing.T) {
+	cmd, rest, err := lookupCommand(nil)
+	if err != nil || cmd.usage != "serve" || len(rest) != 0 {
+		t.Errorf("no arguments: %q, %q, %v; want serve", cmd.usage, rest, err)
+	}
+	cmd, rest, err = lookupCommand([]string{"export", "-lib", "2"})
+	if err != nil || !strings.HasPrefix(cmd.usage, "export") || strings.Join(rest, " ") != "-lib 2" {
+		t.Errorf("export: %q, %q, %v", cmd.usage, rest, err)
+	}
+	if _, _, err := lookupCommand([]string{"-lib"}); err == nil || !strings.Contains(err.Error(), `unknown command "-lib"`) {
+		t.Errorf("unknown command: err = %v", err)
+	}
+	for name, cmd := range commands {
+		if !strings.HasPrefix(cmd.usage, name) || cmd.summary == "" || cmd.run == nil {
+			t.Errorf("command %s is missing its usage, summary or run", name)
+		}
+	}
+}
+
+func TestImportCatalog(t *testing.T) {
+	store, _ := newTestStore(t)
+	library, _, book := seedLibrary(t, store, 1)
+	lib := strconv.Itoa(library.ID)
+	csvFile := "isbn,libID,title,totalCopies,availableCopies\n" +
+		"9780140449136,99,The Odyssey,2,2\n" +
+		book.ISBN + "," + lib + ",Renamed,3,3\n" +
+		"9780262033848," + lib + ",Too many,1,2\n"
+	read := func() catalogReader {
+		r, err := newCatalogReader(strings.NewReader(csvFile), "csv")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	var report bytes.Buffer
+	result, err := importCatalog(store, read(), library.ID, false, true, &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != (importResult{Created: 1, Skipped: 1, Failed: 1}) {
+		t.Errorf("dry run = %+v, want 1 created, 1 skipped, 1 failed", result)
+	}
+	if !strings.Contains(report.String(), "record 3 (9780262033848)") {
+		t.Errorf("report %q does not name the invalid record", report.String())
+	}
+	if _, err := store.Books.Get("9780140449136"); err == nil {
+		t.Error("dry run wrote a book")
+	}
+
+	result, err = importCatalog(store, read(), library.ID, true, false, &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != (importResult{Created: 1, Updated: 1, Failed: 1}) {
+		t.Errorf("import = %+v, want 1 created, 1 updated, 1 failed", result)
+	}
+	created, err := store.Books.Get("9780140449136")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.LibID != library.ID || created.Title != "The Odyssey" {
+		t.Errorf("imported %+v, want The Odyssey in library %d", created, library.ID)
+	}
+	if updated, err := store.Books.Get(book.ISBN); err != nil || updated.Title != "Renamed" {
+		t.Errorf("updated book = %+v, %v", updated, err)
+	}
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	source, _ := newTestStore(t)
+	library := seedExport(t, source)
+	path := filepath.Join(t.TempDir(), "catalog.csv")
+	if err := runExportCommand(source, []string{"-lib", strconv.Itoa(library.ID), "-out", path}); err != nil {
+		t.Fatal(err)
+	}
+
+	target, _ := newTestStore(t)
+	if err := target.Libraries.Create(&Library{Name: "Copy"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := runImportCommand(target, []string{path}); err != nil {
+		t.Fatal(err)
+	}
+
+	var want, got bytes.Buffer
+	if err := exportCatalog(source.Books, &want, library.ID, "ndjson"); err != nil {
+		t.Fatal(err)
+	}
+	if err := exportCatalog(target.Books, &got, library.ID, "ndjson"); err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != want.String() {
+		t.Errorf("imported catalog differs from the exported one:\n got %s\nwant %s", got.String(), want.String())
+	}
+}
+
+func TestRestoreCommandKeepsCurrentDatabase(t *testing.T) {
+	store, conn := newTestStore(t)
+	_, _, book := seedLibrary(t, store, 1)
+	a := &app{config: defaultConfig(), conn: conn, store: store}
+	a.config.Backup.Dir = t.TempDir()
+
+	snapshot := filepath.Join(t.TempDir(), "before.db")
+	if err := runBackupCommand(a, []string{"-out", snapshot}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Books.Delete(book.ISBN); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runRestoreCommand(a, []string{snapshot}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Books.Get(book.ISBN); err != nil {
+		t.Errorf("book not restored: %v", err)
+	}
+
+	saved, err := os.ReadDir(a.config.Backup.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 {
+		t.Fatalf("backup directory has %d files, want the database saved before restoring", len(saved))
+	}
+	if err := verifyBackup(filepath.Join(a.config.Backup.Dir, saved[0].Name())); err != nil {
+		t.Error(err)
+	}
+
+	if err := runRestoreCommand(a, []string{filepath.Join(t.TempDir(), "missing.db")}); err == nil {
+		t.Error("restoring a missing snapshot succeeded")
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type TLSConfig struct {
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+}
+
+type DatabaseConfig struct {
+	Driver string `json:"driver"`
+	DSN    string `json:"dsn"`
+	// BusyTimeoutMS is how long a SQLite write waits for a competing one.
+	BusyTimeoutMS int `json:"busyTimeoutMS"`
+}
+
+// OwnerConfig describes the owner account created when the database is empty.
+type OwnerConfig struct {
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Contact  string `json:"contact"`
+	Password string `json:"password"`
+	LibID    int    `json:"libID"`
+}
+
+// CirculationConfig holds the default lending policies applied to every library.
+type CirculationConfig struct {
+	LoanDays          int `json:"loanDays"`
+	MaxLoansPerReader int `json:"maxLoansPerReader"`
+	ReminderDaysAhead int `json:"reminderDaysAhead"`
+}
+
+// BackupConfig controls the snapshots of the SQLite database. Snapshots are
+// taken every IntervalHours (never when zero) and only the newest Retain are
+// kept (all when zero).
+type BackupConfig struct {
+	Dir           string `json:"dir"`
+	Retain        int    `json:"retain"`
+	IntervalHours int    `json:"intervalHours"`
+}
+
+// MailConfig controls email notifications. Without an SMTP host, email is
+// disabled: reminders wait until one is configured, other messages are
+// dropped and only their event and recipient are logged. Libraries overrides SMTP for the readers of individual libraries,
+// keyed by library ID; empty fields fall back to SMTP. TemplateDir may hold
+// <event>.tmpl files replacing the built-in templates.
+type MailConfig struct {
+	SMTP        SMTPConfig         `json:"smtp"`
+	Libraries   map[int]SMTPConfig `json:"libraries"`
+	TemplateDir string             `json:"templateDir"`
+}
+
+// SMTPConfig describes a mail server. From may include a display name, as in
+// "City Library <library@example.org>".
+type SMTPConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	From     string `json:"from"`
+}
+
+// serverFor returns the SMTP settings for readers of libID.
+func (cfg MailConfig) serverFor(libID int) SMTPConfig {
+	server := cfg.SMTP
+	override, ok := cfg.Libraries[libID]
+	if !ok {
+		return server
+	}
+	if override.Host != "" {
+		server.Host = override.Host
+	}
+	if override.Port != 0 {
+		server.Port = override.Port
+	}
+	if override.Username != "" {
+		server.Username = override.Username
+		server.Password = override.Password
+	}
+	if override.From != "" {
+		server.From = override.From
+	}
+	return server
+}
+
+// JobsConfig controls the in-process scheduler of the maintenance jobs. They
+// run at startup and then every IntervalHours; zero leaves them to run-jobs.
+type JobsConfig struct {
+	IntervalHours int `json:"intervalHours"`
+}
+
+type Config struct {
+	ListenAddr   string            `json:"listenAddr"`
+	TLS          TLSConfig         `json:"tls"`
+	Database     DatabaseConfig    `json:"database"`
+	LogLevel     string            `json:"logLevel"`
+	Owner        OwnerConfig       `json:"owner"`
+	Circulation  CirculationConfig `json:"circulation"`
+	MetadataFile string            `json:"metadataFile"`
+	MetadataURL  string            `json:"metadataURL"`
+	CoverDir     string            `json:"coverDir"`
+	Backup       BackupConfig      `json:"backup"`
+	Jobs         JobsConfig        `json:"jobs"`
+	Mail         MailConfig        `json:"mail"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		ListenAddr: ":8081",
+		Database:   DatabaseConfig{Driver: string(dialectSQLite), DSN: "./library.db", BusyTimeoutMS: 5000},
+		LogLevel:   "info",
+		Owner: OwnerConfig{
+			Name:  "Root",
+			Email: defaultOwnerEmail,
+			LibID: 1,
+		},
+		Circulation: CirculationConfig{
+			LoanDays:          14,
+			MaxLoansPerReader: 5,
+			ReminderDaysAhead: 2,
+		},
+		CoverDir: "covers",
+		Backup: BackupConfig{
+			Dir:           "backups",
+			Retain:        7,
+			IntervalHours: 24,
+		},
+		Jobs: JobsConfig{IntervalHours: 24},
+		Mail: MailConfig{
+			SMTP: SMTPConfig{Port: 587},
+		},
+	}
+}
+
+// loadConfig builds the configuration from, in increasing priority, built-in
+// defaults, a JSON file (-config or LIBRARY_CONFIG), LIBRARY_* environment
+// variables and command line flags. It returns the arguments left after the
+// flags, which name the subcommand to run.
+func loadConfig(args []string) (*Config, []string, error) {
+	cfg := defaultConfig()
+
+	flags := flag.NewFlagSet("library", flag.ContinueOnError)
+	configPath := flags.String("config", os.Getenv("LIBRARY_CONFIG"), "path to a JSON configuration file")
+	listenAddr := flags.String("listen", "", "listen address, e.g. :8081")
+	tlsCert := flags.String("tls-cert", "", "TLS certificate file")
+	tlsKey := flags.String("tls-key", "", "TLS private key file")
+	driver := flags.String("db-driver", "", "storage driver: sqlite3 or postgres")
+	dsn := flags.String("db-dsn", "", "storage data source name")
+	logLevel := flags.String("log-level", "", "debug, info, warn or error")
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	if *configPath != "" {
+		data, err := os.ReadFile(*configPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := json.Unmarshal(data, cfg); err != nil {
+			return nil, nil, fmt.Errorf("parsing %s: %w", *configPath, err)
+		}
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, nil, err
+	}
+
+	setString := func(dst *string, value string) {
+		if value != "" {
+			*dst = value
+		}
+	}
+	setString(&cfg.ListenAddr, *listenAddr)
+	setString(&cfg.TLS.CertFile, *tlsCert)
+	setString(&cfg.TLS.KeyFile, *tlsKey)
+	setString(&cfg.Database.Driver, *driver)
+	setString(&cfg.Database.DSN, *dsn)
+	setString(&cfg.LogLevel, *logLevel)
+
+	if err := cfg.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return cfg, flags.Args(), nil
+}
+
+func (cfg *Config) applyEnv() error {
+	stringVars := map[string]*string{
+		"LIBRARY_LISTEN_ADDR":    &cfg.ListenAddr,
+		"LIBRARY_TLS_CERT":       &cfg.TLS.CertFile,
+		"LIBRARY_TLS_KEY":        &cfg.TLS.KeyFile,
+		"LIBRARY_DB_DRIVER":      &cfg.Database.Driver,
+		"LIBRARY_DB_DSN":         &cfg.Database.DSN,
+		"LIBRARY_LOG_LEVEL":      &cfg.LogLevel,
+		"LIBRARY_OWNER_NAME":     &cfg.Owner.Name,
+		"LIBRARY_OWNER_EMAIL":    &cfg.Owner.Email,
+		"LIBRARY_OWNER_PASSWORD": &cfg.Owner.Password,
+		"LIBRARY_OWNER_CONTACT":  &cfg.Owner.Contact,
+		"LIBRARY_METADATA_FILE":  &cfg.MetadataFile,
+		"LIBRARY_METADATA_URL":   &cfg.MetadataURL,
+		"LIBRARY_COVER_DIR":      &cfg.CoverDir,
+		"LIBRARY_BACKUP_DIR":     &cfg.Backup.Dir,
+		"LIBRARY_SMTP_HOST":      &cfg.Mail.SMTP.Host,
+		"LIBRARY_SMTP_USERNAME":  &cfg.Mail.SMTP.Username,
+		"LIBRARY_SMTP_PASSWORD":  &cfg.Mail.SMTP.Password,
+		"LIBRARY_SMTP_FROM":      &cfg.Mail.SMTP.From,
+		"LIBRARY_MAIL_TEMPLATES": &cfg.Mail.TemplateDir,
+	}
+	for name, dst := range stringVars {
+		if value, ok := os.LookupEnv(name); ok {
+			*dst = value
+		}
+	}
+
+	intVars := map[string]*int{
+		"LIBRARY_DB_BUSY_TIMEOUT_MS":    &cfg.Database.BusyTimeoutMS,
+		"LIBRARY_OWNER_LIB_ID":          &cfg.Owner.LibID,
+		"LIBRARY_LOAN_DAYS":             &cfg.Circulation.LoanDays,
+		"LIBRARY_MAX_LOANS":             &cfg.Circulation.MaxLoansPerReader,
+		"LIBRARY_REMINDER_DAYS_AHEAD":   &cfg.Circulation.ReminderDaysAhead,
+		"LIBRARY_BACKUP_RETAIN":         &cfg.Backup.Retain,
+		"LIBRARY_BACKUP_INTERVAL_HOURS": &cfg.Backup.IntervalHours,
+		"LIBRARY_JOBS_INTERVAL_HOURS":   &cfg.Jobs.IntervalHours,
+		"LIBRARY_SMTP_PORT":             &cfg.Mail.SMTP.Port,
+	}
+	for name, dst := range intVars {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		*dst = n
+	}
+	return nil
+}
+
+// Validate reports every problem with the configuration at once so operators
+// can fix them in a single pass.
+func (cfg *Config) Validate() error {
+	var problems []string
+	fail := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if cfg.ListenAddr == "" {
+		fail("listenAddr is required")
+	}
+	if (cfg.TLS.CertFile == "") != (cfg.TLS.KeyFile == "") {
+		fail("tls.certFile and tls.keyFile must be set together")
+	}
+	for _, file := range []string{cfg.TLS.CertFile, cfg.TLS.KeyFile} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			fail("tls: %v", err)
+		}
+	}
+
+	switch Dialect(cfg.Database.Driver) {
+	case dialectSQLite, dialectPostgres:
+	default:
+		fail("database.driver must be %q or %q", dialectSQLite, dialectPostgres)
+	}
+	if cfg.Database.DSN == "" {
+		fail("database.dsn is required")
+	}
+	if cfg.Database.BusyTimeoutMS < 0 {
+		fail("database.busyTimeoutMS must not be negative")
+	}
+
+	switch cfg.LogLevel {
+	case "debug", "info", "warn", "error":
+	default:
+		fail("logLevel must be one of debug, info, warn, error")
+	}
+
+	if cfg.Owner.Email != "" && !strings.Contains(cfg.Owner.Email, "@") {
+		fail("owner.email is not an email address")
+	}
+	if cfg.Owner.LibID <= 0 {
+		fail("owner.libID must be positive")
+	}
+
+	if cfg.Circulation.LoanDays <= 0 {
+		fail("circulation.loanDays must be positive")
+	}
+	if cfg.Circulation.MaxLoansPerReader < 0 {
+		fail("circulation.maxLoansPerReader must not be negative")
+	}
+	if cfg.Circulation.ReminderDaysAhead < 0 {
+		fail("circulation.reminderDaysAhead must not be negative")
+	}
+
+	if cfg.Backup.Dir == "" {
+		fail("backup.dir is required")
+	}
+	if cfg.Backup.Retain < 0 {
+		fail("backup.retain must not be negative")
+	}
+	if cfg.Backup.IntervalHours < 0 {
+		fail("backup.intervalHours must not be negative")
+	}
+	if cfg.Jobs.IntervalHours < 0 {
+		fail("jobs.intervalHours must not be negative")
+	}
+	for libID, smtp := range cfg.Mail.Libraries {
+		merged := cfg.Mail.serverFor(libID)
+		if merged.Host != "" && merged.From == "" {
+			fail("mail.libraries.%d: from is required when an SMTP host is set", libID)
+		}
+		if smtp.Port < 0 || smtp.Port > 65535 {
+			fail("mail.libraries.%d.port is out of range", libID)
+		}
+	}
+	if cfg.Mail.SMTP.Host != "" && cfg.Mail.SMTP.From == "" {
+		fail("mail.smtp.from is required when mail.smtp.host is set")
+	}
+	if cfg.Mail.SMTP.Port <= 0 || cfg.Mail.SMTP.Port > 65535 {
+		fail("mail.smtp.port is out of range")
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
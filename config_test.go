@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "library.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `{
+		"listenAddr": ":9000",
+		"logLevel": "warn",
+		"database": {"dsn": "file.db"},
+		"circulation": {"loanDays": 21},
+		"mail": {"smtp": {"host": "smtp.example.org", "from": "library@example.org"}}
+	}`)
+	t.Setenv("LIBRARY_CONFIG", path)
+	t.Setenv("LIBRARY_LOG_LEVEL", "debug")
+	t.Setenv("LIBRARY_LOAN_DAYS", "7")
+	t.Setenv("LIBRARY_SMTP_PORT", "2525")
+
+	cfg, rest, err := loadConfig([]string{"-listen", ":9100", "serve", "-x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checks := []struct {
+		name      string
+		got, want interface{}
+	}{
+		{"flag over env and file", cfg.ListenAddr, ":9100"},
+		{"env over file", cfg.LogLevel, "debug"},
+		{"env int over file", cfg.Circulation.LoanDays, 7},
+		{"env int over default", cfg.Mail.SMTP.Port, 2525},
+		{"file over default", cfg.Database.DSN, "file.db"},
+		{"nested file value", cfg.Mail.SMTP.Host, "smtp.example.org"},
+		{"default kept beside file values", cfg.Database.Driver, string(dialectSQLite)},
+		{"default kept in a section the file sets", cfg.Circulation.ReminderDaysAhead, 2},
+	}
+	for _, check := range checks {
+		if check.got != check.want {
+			t.Errorf("%s: got %v, want %v", check.name, check.got, check.want)
+		}
+	}
+	if strings.Join(rest, " ") != "serve -x" {
+		t.Errorf("remaining args = %q, want the subcommand and its flags", rest)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	t.Run("bad env number", func(t *testing.T) {
+		t.Setenv("LIBRARY_LOAN_DAYS", "two weeks")
+		_, _, err := loadConfig(nil)
+		if err == nil || !strings.Contains(err.Error(), "LIBRARY_LOAN_DAYS") {
+			t.Errorf("err = %v, want one naming LIBRARY_LOAN_DAYS", err)
+		}
+	})
+
+	t.Run("bad file", func(t *testing.T) {
+		path := writeConfigFile(t, `{"listenAddr": `)
+		_, _, err := loadConfig([]string{"-config", path})
+		if err == nil || !strings.Contains(err.Error(), path) {
+			t.Errorf("err = %v, want one naming %s", err, path)
+		}
+	})
+
+	t.Run("every problem reported", func(t *testing.T) {
+		path := writeConfigFile(t, `{"logLevel": "loud", "circulation": {"loanDays": 0}, "backup": {"retain": -1}}`)
+		_, _, err := loadConfig([]string{"-config", path, "-db-driver", "mysql"})
+		if err == nil {
+			t.Fatal("invalid configuration accepted")
+		}
+		for _, want := range []string{"database.driver", "logLevel", "circulation.loanDays", "backup.retain"} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("err = %v, want it to mention %s", err, want)
+			}
+		}
+	})
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maxCoverSize = 10 << 20
+const thumbnailWidth = 200
+
+// coverFormOverhead is what a multipart upload may add to maxCoverSize for
+// boundaries, headers and other fields.
+const coverFormOverhead = 64 << 10
+
+// maxCoverPixels bounds width*height of uploaded covers. A small compressed
+// file can declare huge dimensions, and decoding allocates for all of its
+// pixels: up to 64 MB here.
+const maxCoverPixels = 16_000_000
+
+var errBlobNotFound = errors.New("blob not found")
+
+// BlobStore stores opaque objects by key. The disk store is the default; other
+// backends only need to implement these three methods.
+type BlobStore interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, time.Time, error)
+	Delete(key string) error
+}
+
+// DiskBlobStore keeps each blob as a file below Dir.
+type DiskBlobStore struct {
+	Dir string
+}
+
+func (s *DiskBlobStore) path(key string) (string, error) {
+	if key == "" || strings.Contains(key, "..") || strings.ContainsAny(key, `\`) {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(s.Dir, filepath.FromSlash(key)), nil
+}
+
+func (s *DiskBlobStore) Put(key string, data []byte) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so readers never see a partial image.
+	// Each write gets its own file, so concurrent uploads of the same key
+	// cannot interleave; the last rename wins.
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *DiskBlobStore) Get(key string) ([]byte, time.Time, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, time.Time{}, errBlobNotFound
+		}
+		return nil, time.Time{}, err
+	}
+	data, err := os.ReadFile(path)
+	return data, info.ModTime(), err
+}
+
+func (s *DiskBlobStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// setupCoverStore stores covers on disk below dir.
+func setupCoverStore(dir string) BlobStore {
+	return &DiskBlobStore{Dir: dir}
+}
+
+func coverKey(isbn, size string) (string, error) {
+	isbn = normalizeISBN(isbn)
+	if isbn == "" || strings.ContainsAny(isbn, `/\.`) {
+		return "", fmt.Errorf("invalid ISBN %q", isbn)
+	}
+	return isbn + "/" + size, nil
+}
+
+// thumbnail scales img down to width pixels wide, averaging the source pixels
+// that fall into each destination pixel.
+func thumbnail(img image.Image, width int) image.Image {
+	bounds := img.Bounds()
+	if bounds.Dx() <= width {
+		return img
+	}
+	height := bounds.Dy() * width / bounds.Dx()
+	if height < 1 {
+		height = 1
+	}
+
+	thumb := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := bounds.Min.Y + (y+1)*bounds.Dy()/height
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := bounds.Min.X + (x+1)*bounds.Dx()/width
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			if n == 0 {
+				continue
+			}
+			thumb.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(b / n), uint16(a / n)})
+		}
+	}
+	return thumb
+}
+
+func (s *Server) uploadCover(c *gin.Context) {
+	admin := c.MustGet("user").(User)
+	isbn := c.Param("isbn")
+
+	if _, err := s.libraryBook(isbn, admin.LibID); err != nil {
+		respondBookError(c, err)
+		return
+	}
+
+	// Accept either a multipart form field named "cover" or a raw image body.
+	// The whole body is capped before a multipart form gets parsed, which
+	// would otherwise buffer every part.
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxCoverSize+coverFormOverhead)
+	var reader io.Reader = c.Request.Body
+	if mediaType, _, _ := mime.ParseMediaType(c.ContentType()); mediaType == "multipart/form-data" {
+		file, _, err := c.Request.FormFile("cover")
+		if err != nil {
+			if isBodyTooLarge(err) {
+				respondError(c, coverTooLarge())
+				return
+			}
+			respondError(c, badRequest("Multipart upload has no cover field"))
+			return
+		}
+		defer file.Close()
+		reader = file
+	}
+	data, err := io.ReadAll(io.LimitReader(reader, maxCoverSize+1))
+	if err != nil {
+		if isBodyTooLarge(err) {
+			respondError(c, coverTooLarge())
+			return
+		}
+		respondError(c, badRequest(err.Error()))
+		return
+	}
+	if len(data) > maxCoverSize {
+		respondError(c, coverTooLarge())
+		return
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		respondError(c, badRequest("Unsupported image: "+err.Error()))
+		return
+	}
+	if int64(config.Width)*int64(config.Height) > maxCoverPixels {
+		respondError(c, newAPIError(http.StatusRequestEntityTooLarge, codePayloadTooLarge,
+			fmt.Sprintf("Cover image must have at most %d pixels", maxCoverPixels)))
+		return
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		respondError(c, badRequest("Unsupported image: "+err.Error()))
+		return
+	}
+
+	var thumb bytes.Buffer
+	if err := jpeg.Encode(&thumb, thumbnail(img, thumbnailWidth), &jpeg.Options{Quality: 85}); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	originalKey, err := coverKey(isbn, "original")
+	if err != nil {
+		respondError(c, badRequest(err.Error()))
+		return
+	}
+	thumbKey, _ := coverKey(isbn, "thumb")
+
+	if err := s.covers.Put(originalKey, data); err != nil {
+		respondError(c, err)
+		return
+	}
+	if err := s.covers.Put(thumbKey, thumb.Bytes()); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	bounds := img.Bounds()
+	cover := gin.H{"isbn": isbn, "format": format, "width": bounds.Dx(), "height": bounds.Dy()}
+	s.audit(c, "upload_cover", "book", isbn, nil, cover)
+
+	c.JSON(http.StatusCreated, cover)
+}
+
+func coverTooLarge() *APIError {
+	return newAPIError(http.StatusRequestEntityTooLarge, codePayloadTooLarge, "Cover image too large")
+}
+
+func isBodyTooLarge(err error) bool {
+	var tooLarge *http.MaxBytesError
+	return errors.As(err, &tooLarge)
+}
+
+// getCover serves the original cover, or the thumbnail with ?size=thumb.
+// Responses carry an ETag and Last-Modified so clients can revalidate cheaply.
+func (s *Server) getCover(c *gin.Context) {
+	size := "original"
+	if c.Query("size") == "thumb" {
+		size = "thumb"
+	}
+
+	key, err := coverKey(c.Param("isbn"), size)
+	if err != nil {
+		respondError(c, badRequest(err.Error()))
+		return
+	}
+
+	data, modified, err := s.covers.Get(key)
+	if err != nil {
+		if errors.Is(err, errBlobNotFound) {
+			respondError(c, notFoundError("Cover not found"))
+			return
+		}
+
+		respondError(c, err)
+		return
+	}
+
+	sum := sha256.Sum256(data)
+	c.Header("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	c.Header("Cache-Control", "public, max-age=86400")
+	c.Header("Content-Type", http.DetectContentType(data))
+	http.ServeContent(c.Writer, c.Request, "", modified, bytes.NewReader(data))
+}
+
+func (s *Server) deleteCover(c *gin.Context) {
+	admin := c.MustGet("user").(User)
+	if _, err := s.libraryBook(c.Param("isbn"), admin.LibID); err != nil {
+		respondBookError(c, err)
+		return
+	}
+
+	for _, size := range []string{"original", "thumb"} {
+		key, err := coverKey(c.Param("isbn"), size)
+		if err != nil {
+			respondError(c, badRequest(err.Error()))
+			return
+		}
+		if err := s.covers.Delete(key); err != nil {
+			respondError(c, err)
+			return
+		}
+	}
+	s.audit(c, "delete_cover", "book", c.Param("isbn"), nil, nil)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Cover deleted"})
+}
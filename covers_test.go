@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func pngImage(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	if err := png.Encode(&b, image.NewGray(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestUploadCover(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store, _ := newTestStore(t)
+	_, admin, book := seedLibrary(t, store, 1)
+	other := &Library{Name: "Elsewhere"}
+	if err := store.Libraries.Create(other); err != nil {
+		t.Fatal(err)
+	}
+	stranger := &User{Name: "Stranger", Email: "stranger@example.org", Role: "admin", LibID: other.ID}
+	if err := store.Users.Create(stranger); err != nil {
+		t.Fatal(err)
+	}
+	covers := &DiskBlobStore{Dir: t.TempDir()}
+	s := &Server{config: defaultConfig(), store: store, covers: covers}
+
+	upload := func(user *User, contentType string, body []byte) *httptest.ResponseRecorder {
+		router := gin.New()
+		router.Use(func(c *gin.Context) { c.Set("user", *user) })
+		router.POST("/admin/books/:isbn/cover", s.uploadCover)
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/admin/books/"+book.ISBN+"/cover", bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		router.ServeHTTP(w, req)
+		return w
+	}
+	multipartBody := func(field string, data []byte) (string, []byte) {
+		var b bytes.Buffer
+		form := multipart.NewWriter(&b)
+		part, err := form.CreateFormFile(field, "cover.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(data)
+		form.Close()
+		return form.FormDataContentType(), b.Bytes()
+	}
+
+	if w := upload(admin, "image/png", pngImage(t, 40, 60)); w.Code != http.StatusCreated {
+		t.Fatalf("raw upload: %d %s", w.Code, w.Body)
+	}
+	thumbKey, _ := coverKey(book.ISBN, "thumb")
+	if _, _, err := covers.Get(thumbKey); err != nil {
+		t.Errorf("thumbnail not stored: %v", err)
+	}
+	contentType, body := multipartBody("cover", pngImage(t, 40, 60))
+	if w := upload(admin, contentType, body); w.Code != http.StatusCreated {
+		t.Errorf("multipart upload: %d %s", w.Code, w.Body)
+	}
+
+	noCoverType, noCover := multipartBody("image", pngImage(t, 40, 60))
+	hugeFormType, hugeForm := multipartBody("cover", make([]byte, maxCoverSize+coverFormOverhead))
+	tests := []struct {
+		name        string
+		user        *User
+		contentType string
+		body        []byte
+		want        int
+	}{
+		{"other library", stranger, "image/png", pngImage(t, 40, 60), http.StatusNotFound},
+		{"too many pixels", admin, "image/png", pngImage(t, 5000, 4000), http.StatusRequestEntityTooLarge},
+		{"raw body too large", admin, "image/png", make([]byte, maxCoverSize+coverFormOverhead+1), http.StatusRequestEntityTooLarge},
+		{"not an image", admin, "image/png", []byte("hello"), http.StatusBadRequest},
+		{"multipart without cover", admin, noCoverType, noCover, http.StatusBadRequest},
+		{"multipart body too large", admin, hugeFormType, hugeForm, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		if w := upload(tt.user, tt.contentType, tt.body); w.Code != tt.want {
+			t.Errorf("%s: %d, want %d: %.200s", tt.name, w.Code, tt.want, w.Body)
+		}
+	}
+}
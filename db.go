@@ -0,0 +1,272 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// sqliteDSN adds the connection options every SQLite connection needs. They
+// go in the DSN rather than a PRAGMA so that each pooled connection gets them.
+// WAL lets readers continue while a write is in progress, the busy timeout
+// makes competing writers wait instead of failing, and immediate transactions
+// take the write lock up front so a transaction that read the database cannot
+// fail when it later writes. Options already present in dsn are kept.
+func sqliteDSN(dsn string, busyTimeoutMS int) string {
+	options := []struct{ key, value string }{
+		{"_foreign_keys", "on"},
+		{"_journal_mode", "WAL"},
+		{"_busy_timeout", strconv.Itoa(busyTimeoutMS)},
+		{"_txlock", "immediate"},
+	}
+	for _, option := range options {
+		if strings.Contains(dsn, option.key+"=") {
+			continue
+		}
+		separator := "?"
+		if strings.Contains(dsn, "?") {
+			separator = "&"
+		}
+		dsn += separator + option.key + "=" + option.value
+	}
+	return dsn
+}
+
+// Dialect identifies the SQL flavour of the configured database. Repositories
+// write queries with "?" placeholders and SQLite syntax; the dialect rewrites
+// the few constructs that differ.
+type Dialect string
+
+const (
+	dialectSQLite   Dialect = "sqlite3"
+	dialectPostgres Dialect = "postgres"
+)
+
+// Rebind converts "?" placeholders to PostgreSQL's "$1", "$2", ... form.
+// Question marks inside string literals are left alone.
+func (d Dialect) Rebind(query string) string {
+	if d != dialectPostgres {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	inString := false
+	for _, r := range query {
+		switch {
+		case r == '\'':
+			inString = !inString
+		case r == '?' && !inString:
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// InsertIgnore builds an INSERT that silently skips rows violating a unique
+// constraint.
+func (d Dialect) InsertIgnore(table string, columns ...string) string {
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(columns)), ",")
+	insert := fmt.Sprintf("INTO %s (%s) VALUES (%s)", table, strings.Join(columns, ", "), placeholders)
+	if d == dialectPostgres {
+		return "INSERT " + insert + " ON CONFLICT DO NOTHING"
+	}
+	return "INSERT OR IGNORE " + insert
+}
+
+// sqlExecutor is what the SQL repositories run their statements on. dbConn
+// and dbTx both implement it, so the same repositories can work inside a
+// transaction; see Store.Atomic.
+type sqlExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+	InsertID(idColumn, query string, args ...interface{}) (int, error)
+	InTx(fn func(tx *dbTx) error) error
+	Dialect() Dialect
+}
+
+// dbConn wraps a *sql.DB so repositories can stay dialect agnostic.
+type dbConn struct {
+	*sql.DB
+	dialect Dialect
+}
+
+func (c *dbConn) Dialect() Dialect {
+	return c.dialect
+}
+
+// Statements run through dbConn and dbTx are timed; see observeQuery.
+func (c *dbConn) Exec(query string, args ...interface{}) (sql.Result, error) {
+	start := time.Now()
+	result, err := c.DB.Exec(c.dialect.Rebind(query), args...)
+	observeQuery(query, start, err)
+	return result, err
+}
+
+func (c *dbConn) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	start := time.Now()
+	rows, err := c.DB.Query(c.dialect.Rebind(query), args...)
+	observeQuery(query, start, err)
+	return rows, err
+}
+
+func (c *dbConn) QueryRow(query string, args ...interface{}) *sql.Row {
+	start := time.Now()
+	row := c.DB.QueryRow(c.dialect.Rebind(query), args...)
+	observeQuery(query, start, row.Err())
+	return row
+}
+
+// dbTx is a transaction with the same dialect handling as dbConn.
+type dbTx struct {
+	*sql.Tx
+	dialect Dialect
+}
+
+func (t *dbTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	start := time.Now()
+	result, err := t.Tx.Exec(t.dialect.Rebind(query), args...)
+	observeQuery(query, start, err)
+	return result, err
+}
+
+func (t *dbTx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	start := time.Now()
+	rows, err := t.Tx.Query(t.dialect.Rebind(query), args...)
+	observeQuery(query, start, err)
+	return rows, err
+}
+
+func (t *dbTx) QueryRow(query string, args ...interface{}) *sql.Row {
+	start := time.Now()
+	row := t.Tx.QueryRow(t.dialect.Rebind(query), args...)
+	observeQuery(query, start, row.Err())
+	return row
+}
+
+func (t *dbTx) Dialect() Dialect {
+	return t.dialect
+}
+
+// InTx runs fn in t itself, so that a repository method opening a
+// transaction joins the one it is called in.
+func (t *dbTx) InTx(fn func(tx *dbTx) error) error {
+	return fn(t)
+}
+
+// InsertID mirrors dbConn.InsertID inside the transaction.
+func (t *dbTx) InsertID(idColumn, query string, args ...interface{}) (int, error) {
+	if t.dialect == dialectPostgres {
+		var id int
+		err := t.QueryRow(query+" RETURNING "+idColumn, args...).Scan(&id)
+		return id, err
+	}
+
+	result, err := t.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+// InTx runs fn in a transaction, committing when it returns nil and rolling
+// back otherwise.
+func (c *dbConn) InTx(fn func(tx *dbTx) error) error {
+	tx, err := c.DB.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(&dbTx{Tx: tx, dialect: c.dialect}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// InsertID runs an INSERT and returns the generated value of idColumn. The
+// PostgreSQL driver does not implement LastInsertId, so RETURNING is used there.
+func (c *dbConn) InsertID(idColumn, query string, args ...interface{}) (int, error) {
+	if c.dialect == dialectPostgres {
+		var id int
+		err := c.QueryRow(query+" RETURNING "+idColumn, args...).Scan(&id)
+		return id, err
+	}
+
+	result, err := c.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+// openDatabase opens the configured database and checks that it is reachable.
+func openDatabase(cfg DatabaseConfig) (*dbConn, error) {
+	driver := Dialect(cfg.Driver)
+	if driver != dialectSQLite && driver != dialectPostgres {
+		return nil, fmt.Errorf("unsupported database driver %q", driver)
+	}
+
+	dsn := cfg.DSN
+	if driver == dialectSQLite {
+		dsn = sqliteDSN(dsn, cfg.BusyTimeoutMS)
+	}
+
+	handle, err := sql.Open(string(driver), dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := handle.Ping(); err != nil {
+		handle.Close()
+		return nil, err
+	}
+	return &dbConn{DB: handle, dialect: driver}, nil
+}
+
+// migrate brings the schema up to date for the connection's dialect. It stops
+// at the first step that fails; the server must not run on a schema that is
+// only partly upgraded.
+func migrate(conn *dbConn) error {
+	if conn.dialect == dialectPostgres {
+		return migratePostgres(conn)
+	}
+
+	// Table rebuilds drop and recreate referenced tables, which SQLite only
+	// allows with enforcement off. The pragma is per connection, so the pool
+	// is pinned to a single one for the duration.
+	conn.SetMaxOpenConns(1)
+	defer conn.SetMaxOpenConns(0)
+	if _, err := conn.Exec("PRAGMA foreign_keys = OFF"); err != nil {
+		return err
+	}
+	defer conn.Exec("PRAGMA foreign_keys = ON")
+
+	steps := []func() error{
+		createLibraryTable,
+		createUsersTable,
+		createBookInventoryTable,
+		createRequestEventsTable,
+		createIssueRegisteryTable,
+		createCatalogTables,
+		createAuditTable,
+		createJobTables,
+		createWebhookTables,
+		createOutboxTable,
+		createNotificationTables,
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return err
+		}
+	}
+	return cleanupZeroReferences(conn)
+}
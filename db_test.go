@@ -0,0 +1,266 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRebind(t *testing.T) {
+	tests := []struct {
+		dialect Dialect
+		query   string
+		want    string
+	}{
+		{dialectSQLite, "SELECT * FROM t WHERE a =? AND b =?", "SELECT * FROM t WHERE a =? AND b =?"},
+		{dialectPostgres, "SELECT * FROM t WHERE a =? AND b =?", "SELECT * FROM t WHERE a =$1 AND b =$2"},
+		{dialectPostgres, "SELECT * FROM t WHERE a = '?' AND b IN (?, ?)", "SELECT * FROM t WHERE a = '?' AND b IN ($1, $2)"},
+		{dialectPostgres, "UPDATE t SET a = 'it''s ?' WHERE id =?", "UPDATE t SET a = 'it''s ?' WHERE id =$1"},
+		{dialectPostgres, "SELECT 1", "SELECT 1"},
+	}
+	for _, tt := range tests {
+		if got := tt.dialect.Rebind(tt.query); got != tt.want {
+			t.Errorf("%s Rebind(%q) = %q, want %q", tt.dialect, tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestInsertIgnore(t *testing.T) {
+	if got, want := dialectSQLite.InsertIgnore("t", "a", "b"), "INSERT OR IGNORE INTO t (a, b) VALUES (?,?)"; got != want {
+		t.Errorf("sqlite InsertIgnore = %q, want %q", got, want)
+	}
+	if got, want := dialectPostgres.InsertIgnore("t", "a", "b"), "INSERT INTO t (a, b) VALUES (?,?) ON CONFLICT DO NOTHING"; got != want {
+		t.Errorf("postgres InsertIgnore = %q, want %q", got, want)
+	}
+}
+
+// newPostgresTestStore migrates a fresh schema of the database named by
+// LIBRARY_TEST_POSTGRES_DSN and drops the schema when the test ends.
+func newPostgresTestStore(t *testing.T) *Store {
+	t.Helper()
+	dsn := os.Getenv("LIBRARY_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("LIBRARY_TEST_POSTGRES_DSN is not set")
+	}
+
+	admin, err := openDatabase(DatabaseConfig{Driver: string(dialectPostgres), DSN: dsn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := fmt.Sprintf("library_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		admin.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec("DROP SCHEMA " + schema + " CASCADE"); err != nil {
+			t.Errorf("dropping test schema %s: %v", schema, err)
+		}
+		admin.Close()
+	})
+
+	// lib/pq passes unknown options on as run-time parameters
+	if u, err := url.Parse(dsn); err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql") {
+		query := u.Query()
+		query.Set("search_path", schema)
+		u.RawQuery = query.Encode()
+		dsn = u.String()
+	} else {
+		dsn += " search_path=" + schema
+	}
+	conn, err := openDatabase(DatabaseConfig{Driver: string(dialectPostgres), DSN: dsn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	db = conn.DB
+	if err := migrate(conn); err != nil {
+		t.Fatal(err)
+	}
+	return NewSQLStore(conn)
+}
+
+func TestRepositoriesSQLite(t *testing.T) {
+	store, _ := newTestStore(t)
+	testRepositories(t, store)
+}
+
+func TestRepositoriesPostgres(t *testing.T) {
+	testRepositories(t, newPostgresTestStore(t))
+}
+
+// testRepositories takes every repository through one round trip, so that
+// each dialect runs each kind of query at least once.
+func testRepositories(t *testing.T, store *Store) {
+	now := time.Now().UTC().Truncate(time.Second)
+	check := func(what string, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("%s: %v", what, err)
+		}
+	}
+
+	library := &Library{Name: "Central"}
+	check("Libraries.Create", store.Libraries.Create(library))
+	library.Name = "Central Library"
+	check("Libraries.Update", store.Libraries.Update(library))
+	if got, err := store.Libraries.Get(library.ID); err != nil || got.Name != library.Name {
+		t.Errorf("Libraries.Get = %+v, %v", got, err)
+	}
+
+	admin := &User{Name: "Admin", Email: "admin@example.org", Role: "admin", LibID: library.ID}
+	check("Users.Create", store.Users.Create(admin))
+	reader := &User{Name: "Reader", Email: "reader@example.org", Role: "reader", LibID: library.ID}
+	check("Users.Create", store.Users.Create(reader))
+	check("Users.SetPassword", store.Users.SetPassword(reader.ID, "hash", true))
+	if got, err := store.Users.GetByEmail(reader.Email); err != nil || got.Password != "hash" || !got.MustChangePassword {
+		t.Errorf("Users.GetByEmail = %+v, %v", got, err)
+	}
+	if readers, err := store.Users.ListByRole("reader"); err != nil || len(readers) != 1 {
+		t.Errorf("Users.ListByRole = %d users, %v", len(readers), err)
+	}
+
+	book := &BookInventory{ISBN: "9780441172719", LibID: library.ID, Title: "Dune", Authors: "Frank Herbert", Subjects: []string{"Science fiction"}, TotalCopies: 2, AvailableCopies: 2}
+	check("Books.Create", store.Books.Create(book))
+	book.TotalCopies = 3
+	check("Books.Update", store.Books.Update(book))
+	if got, err := store.Books.Get(book.ISBN); err != nil || got.AvailableCopies != 3 || len(got.AuthorList) != 1 || len(got.Subjects) != 1 {
+		t.Errorf("Books.Get = %+v, %v", got, err)
+	}
+	if books, err := store.Books.List(BookFilter{LibID: library.ID, Author: "Frank Herbert"}); err != nil || len(books) != 1 {
+		t.Errorf("Books.List = %d books, %v", len(books), err)
+	}
+
+	issue := &RequestEvent{BookID: book.ISBN, ReaderID: reader.ID, RequestType: requestTypeIssue, RequestDate: now}
+	check("RequestEvents.Create", store.RequestEvents.Create(issue))
+	declined := &RequestEvent{BookID: book.ISBN, ReaderID: reader.ID, RequestType: requestTypeIssue, RequestDate: now}
+	check("RequestEvents.Create", store.RequestEvents.Create(declined))
+	loan, err := store.Circulation.Approve(issue.ReqID, admin.ID, now, CirculationConfig{LoanDays: 14})
+	check("Circulation.Approve", err)
+	_, err = store.Circulation.Reject(declined.ReqID, admin.ID, "duplicate", now)
+	check("Circulation.Reject", err)
+	if got, err := store.RequestEvents.Get(issue.ReqID); err != nil || got.Decision != requestDecisionApproved {
+		t.Errorf("RequestEvents.Get = %+v, %v", got, err)
+	}
+
+	if open, err := store.Issues.CountOpen(LoanFilter{LibID: library.ID}); err != nil || open != 1 {
+		t.Errorf("Issues.CountOpen = %d, %v", open, err)
+	}
+	overdue, err := store.Issues.MarkOverdue(now.AddDate(0, 0, 15))
+	check("Issues.MarkOverdue", err)
+	if len(overdue) != 1 || overdue[0].IssueID != loan.IssueID {
+		t.Errorf("Issues.MarkOverdue = %+v", overdue)
+	}
+	claimed, err := store.Issues.ClaimReminder(loan.IssueID, reminderOverdue, now)
+	check("Issues.ClaimReminder", err)
+	again, err := store.Issues.ClaimReminder(loan.IssueID, reminderOverdue, now)
+	check("Issues.ClaimReminder", err)
+	if !claimed || again {
+		t.Errorf("Issues.ClaimReminder = %v, then %v", claimed, again)
+	}
+	check("Issues.ReleaseReminder", store.Issues.ReleaseReminder(loan.IssueID, reminderOverdue))
+	if pending, err := store.Issues.PendingReminders(reminderOverdue, issueStatusOverdue, now.AddDate(0, 0, 15)); err != nil || len(pending) != 1 {
+		t.Errorf("Issues.PendingReminders = %d loans, %v", len(pending), err)
+	}
+
+	check("Audit.Record", store.Audit.Record(&AuditEntry{ActorID: admin.ID, Action: "update", Entity: "book", EntityID: book.ISBN, After: []byte(`{}`), CreatedAt: now}))
+	if entries, err := store.Audit.List(AuditFilter{Entity: "book", Since: now.Add(-time.Minute)}); err != nil || len(entries) != 1 {
+		t.Errorf("Audit.List = %d entries, %v", len(entries), err)
+	}
+
+	check("JobRuns.Record", store.JobRuns.Record(&JobRun{Job: "mark-overdue", TriggeredBy: "test", StartedAt: now, FinishedAt: now, Status: jobStatusOK}))
+	if run, err := store.JobRuns.Latest("mark-overdue"); err != nil || run.Status != jobStatusOK {
+		t.Errorf("JobRuns.Latest = %+v, %v", run, err)
+	}
+
+	entries, err := store.Outbox.After(0, library.ID, 10)
+	check("Outbox.After", err)
+	if len(entries) < 3 {
+		t.Fatalf("Outbox.After = %d entries, want the events of the book, the loan and the requests", len(entries))
+	}
+	hook := &Webhook{LibID: library.ID, URL: "https://example.org/hook", Events: []string{entries[0].Event}, Secret: "s", CreatedAt: now}
+	check("Webhooks.Create", store.Webhooks.Create(hook))
+	queued, err := store.Webhooks.Enqueue(entries[0].ID, entries[0].Event, library.ID, entries[0].Data, now)
+	check("Webhooks.Enqueue", err)
+	requeued, err := store.Webhooks.Enqueue(entries[0].ID, entries[0].Event, library.ID, entries[0].Data, now)
+	check("Webhooks.Enqueue", err)
+	if queued != 1 || requeued != 0 {
+		t.Errorf("Webhooks.Enqueue queued %d, then %d", queued, requeued)
+	}
+	deliveries, err := store.Webhooks.DueDeliveries(now, 10)
+	check("Webhooks.DueDeliveries", err)
+	if len(deliveries) != 1 || deliveries[0].URL != hook.URL {
+		t.Fatalf("Webhooks.DueDeliveries = %+v", deliveries)
+	}
+	deliveries[0].Status, deliveries[0].Attempts, deliveries[0].DeliveredAt = deliveryDelivered, 1, &now
+	check("Webhooks.UpdateDelivery", store.Webhooks.UpdateDelivery(&deliveries[0]))
+	if log, err := store.Webhooks.ListDeliveries(hook.ID, 10); err != nil || len(log) != 1 || log[0].Status != deliveryDelivered {
+		t.Errorf("Webhooks.ListDeliveries = %+v, %v", log, err)
+	}
+
+	due, err := store.Outbox.Due(now.Add(time.Minute), 10)
+	check("Outbox.Due", err)
+	for i := range due {
+		due[i].Attempts, due[i].ProcessedAt = 1, &now
+		check("Outbox.Update", store.Outbox.Update(&due[i]))
+	}
+	pruned, err := store.Outbox.Prune(now.Add(time.Second))
+	check("Outbox.Prune", err)
+	if pruned != len(due) || pruned == 0 {
+		t.Errorf("Outbox.Prune = %d, want %d", pruned, len(due))
+	}
+
+	check("Notifications.SetPreferences", store.Notifications.SetPreferences(reader.ID, map[string]string{notifyOverdue: channelInApp}))
+	if prefs, err := store.Notifications.Preferences(reader.ID); err != nil || prefs[notifyOverdue] != channelInApp {
+		t.Errorf("Notifications.Preferences = %v, %v", prefs, err)
+	}
+	check("Notifications.Create", store.Notifications.Create(&Notification{UserID: reader.ID, Event: notifyOverdue, Subject: "Overdue", Body: "Body", CreatedAt: now}))
+	if read, err := store.Notifications.MarkAllRead(reader.ID, now); err != nil || read != 1 {
+		t.Errorf("Notifications.MarkAllRead = %d, %v", read, err)
+	}
+	if unread, err := store.Notifications.List(reader.ID, true, 10); err != nil || len(unread) != 0 {
+		t.Errorf("Notifications.List = %d unread, %v", len(unread), err)
+	}
+
+	from, end := now.AddDate(0, 0, -1), now.AddDate(0, 0, 1)
+	if loans, err := store.Stats.Loans(library.ID, from, end); err != nil || len(loans) != 1 {
+		t.Errorf("Stats.Loans = %d loans, %v", len(loans), err)
+	}
+	if top, err := store.Stats.TopTitles(library.ID, from, end, 5); err != nil || len(top) != 1 || top[0].Title != "Dune" {
+		t.Errorf("Stats.TopTitles = %+v, %v", top, err)
+	}
+	if requests, err := store.Stats.Requests(library.ID, from, end); err != nil || requests != (RequestStats{Total: 2, Approved: 1, Rejected: 1}) {
+		t.Errorf("Stats.Requests = %+v, %v", requests, err)
+	}
+	if copies, err := store.Stats.TotalCopies(library.ID); err != nil || copies != 3 {
+		t.Errorf("Stats.TotalCopies = %d, %v", copies, err)
+	}
+	if circulation, err := store.Stats.Circulation(now.AddDate(0, 0, 15)); err != nil || len(circulation) != 1 || circulation[0].OverdueLoans != 1 {
+		t.Errorf("Stats.Circulation = %+v, %v", circulation, err)
+	}
+
+	errRollback := errors.New("rollback")
+	err = store.Atomic(func(tx *Store) error {
+		if err := tx.Libraries.Create(&Library{Name: "Annex"}); err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if !errors.Is(err, errRollback) {
+		t.Errorf("Atomic = %v", err)
+	}
+	if libraries, err := store.Libraries.List(); err != nil || len(libraries) != 1 {
+		t.Errorf("Atomic left %d libraries, %v", len(libraries), err)
+	}
+
+	check("Books.Delete", store.Books.Delete(book.ISBN))
+	check("Books.Restore", store.Books.Restore(book.ISBN))
+	check("Users.Delete", store.Users.Delete(reader.ID))
+	if deleted, err := store.Users.ListDeleted(); err != nil || len(deleted) != 1 {
+		t.Errorf("Users.ListDeleted = %d users, %v", len(deleted), err)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// blockedByOpenLoans answers 409 when loans matching filter are still open,
+// unless the request passes ?force=true. It reports whether the handler must
+// stop.
+func (s *Server) blockedByOpenLoans(c *gin.Context, filter LoanFilter, entity string) bool {
+	if force, _ := strconv.ParseBool(c.Query("force")); force {
+		return false
+	}
+
+	open, err := s.store.Issues.CountOpen(filter)
+	if err != nil {
+		respondError(c, err)
+		return true
+	}
+	if open > 0 {
+		respondError(c, newAPIError(http.StatusConflict, codeOpenLoans, entity+" has open loans; pass force=true to delete it anyway").
+			with("openLoans", open))
+		return true
+	}
+	return false
+}
+
+func (s *Server) restoreUser(c *gin.Context) {
+	id, ok := paramID(c, "id")
+	if !ok {
+		return
+	}
+
+	var user *User
+	err := s.store.Atomic(func(tx *Store) error {
+		if err := tx.Users.Restore(id); err != nil {
+			return err
+		}
+		var err error
+		if user, err = tx.Users.Get(id); err != nil {
+			return err
+		}
+		return auditTx(c, tx, "restore", "user", strconv.Itoa(id), nil, user)
+	})
+	if err != nil {
+		if errors.Is(err, errNotFound) {
+			respondError(c, notFoundError("Deleted user not found"))
+			return
+		}
+
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, user)
+}
+
+func (s *Server) restoreBook(c *gin.Context) {
+	admin := c.MustGet("user").(User)
+	isbn := c.Param("isbn")
+
+	var book *BookInventory
+	err := s.store.Atomic(func(tx *Store) error {
+		if err := tx.Books.Restore(isbn); err != nil {
+			return err
+		}
+		var err error
+		if book, err = tx.Books.Get(isbn); err != nil {
+			return err
+		}
+		// A book of another library: undo the restore
+		if book.LibID != admin.LibID {
+			return errNotFound
+		}
+		return auditTx(c, tx, "restore", "book", isbn, nil, book)
+	})
+	if err != nil {
+		if errors.Is(err, errNotFound) {
+			respondError(c, notFoundError("Deleted book not found"))
+			return
+		}
+
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, book)
+}
+
+func (s *Server) restoreLibrary(c *gin.Context) {
+	id, ok := paramID(c, "id")
+	if !ok {
+		return
+	}
+
+	var library *Library
+	err := s.store.Atomic(func(tx *Store) error {
+		if err := tx.Libraries.Restore(id); err != nil {
+			return err
+		}
+		var err error
+		if library, err = tx.Libraries.Get(id); err != nil {
+			return err
+		}
+		return auditTx(c, tx, "restore", "library", strconv.Itoa(id), nil, library)
+	})
+	if err != nil {
+		if errors.Is(err, errNotFound) {
+			respondError(c, notFoundError("Deleted library not found"))
+			return
+		}
+
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, library)
+}
+
+// listDeleted shows owners what can be restored.
+func (s *Server) listDeleted(c *gin.Context) {
+	users, err := s.store.Users.ListDeleted()
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	libraries, err := s.store.Libraries.ListDeleted()
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	books, err := s.store.Books.List(BookFilter{Deleted: true})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"users": users, "libraries": libraries, "books": books})
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDeleteLibraryCascades(t *testing.T) {
+	store, _ := newTestStore(t)
+	library, admin, book := seedLibrary(t, store, 1)
+	owner := &User{Name: "Owner", Email: "owner@example.org", Role: defaultOwnerRole, LibID: library.ID}
+	if err := store.Users.Create(owner); err != nil {
+		t.Fatal(err)
+	}
+	gone := &BookInventory{ISBN: "9780441172719", LibID: library.ID, Title: "Gone", TotalCopies: 1, AvailableCopies: 1}
+	if err := store.Books.Create(gone); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Books.Delete(gone.ISBN); err != nil {
+		t.Fatal(err)
+	}
+	// DeletedAt of the library must differ from that of the book
+	time.Sleep(10 * time.Millisecond)
+
+	if err := store.Libraries.Delete(library.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Books.Get(book.ISBN); !errors.Is(err, errNotFound) {
+		t.Errorf("book of a deleted library: %v, want errNotFound", err)
+	}
+	if books, err := store.Books.List(BookFilter{}); err != nil || len(books) != 0 {
+		t.Errorf("catalog of a deleted library lists %d books (%v)", len(books), err)
+	}
+	if _, err := store.Users.GetByEmail(admin.Email); !errors.Is(err, errNotFound) {
+		t.Errorf("admin of a deleted library can still sign in: %v", err)
+	}
+	if _, err := store.Users.GetByEmail(owner.Email); err != nil {
+		t.Errorf("owner was deleted with the library: %v", err)
+	}
+
+	if err := store.Libraries.Restore(library.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Books.Get(book.ISBN); err != nil {
+		t.Errorf("book not restored with the library: %v", err)
+	}
+	if _, err := store.Users.GetByEmail(admin.Email); err != nil {
+		t.Errorf("admin not restored with the library: %v", err)
+	}
+	if _, err := store.Books.Get(gone.ISBN); !errors.Is(err, errNotFound) {
+		t.Errorf("book deleted on its own was restored with the library: %v", err)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+var exportContentTypes = map[string]string{
+	"csv":     "text/csv; charset=utf-8",
+	"ndjson":  "application/x-ndjson",
+	"marcxml": "application/marcxml+xml",
+}
+
+var exportExtensions = map[string]string{
+	"csv":     "csv",
+	"ndjson":  "ndjson",
+	"marcxml": "xml",
+}
+
+// catalogWriter receives books one at a time so exports never hold the whole
+// catalog in memory.
+type catalogWriter interface {
+	Begin() error
+	Write(book *BookInventory) error
+	End() error
+}
+
+func newCatalogWriter(w io.Writer, format string) (catalogWriter, error) {
+	switch format {
+	case "csv":
+		return &csvCatalogWriter{w: csv.NewWriter(w)}, nil
+	case "ndjson":
+		return &ndjsonCatalogWriter{enc: json.NewEncoder(w)}, nil
+	case "marcxml":
+		return &marcCatalogWriter{w: w, enc: xml.NewEncoder(w)}, nil
+	}
+	return nil, fmt.Errorf("unsupported export format %q", format)
+}
+
+// exportCatalog streams every book of libID to w in the given format.
+func exportCatalog(books BookRepository, w io.Writer, libID int, format string) error {
+	out, err := newCatalogWriter(w, format)
+	if err != nil {
+		return err
+	}
+
+	if err := out.Begin(); err != nil {
+		return err
+	}
+	if err := books.ForEach(libID, out.Write); err != nil {
+		return err
+	}
+	return out.End()
+}
+
+type csvCatalogWriter struct {
+	w     *csv.Writer
+	count int
+}
+
+func (cw *csvCatalogWriter) Begin() error {
+	return cw.w.Write([]string{"isbn", "libID", "title", "authors", "publisher", "version", "totalCopies", "availableCopies",
+		"seriesName", "seriesNumber", "language", "publicationYear", "subjects"})
+}
+
+func (cw *csvCatalogWriter) Write(book *BookInventory) error {
+	err := cw.w.Write([]string{
+		book.ISBN,
+		strconv.Itoa(book.LibID),
+		book.Title,
+		book.Authors,
+		book.Publisher,
+		book.Version,
+		strconv.Itoa(book.TotalCopies),
+		strconv.Itoa(book.AvailableCopies),
+		book.SeriesName,
+		strconv.Itoa(book.SeriesNumber),
+		book.Language,
+		strconv.Itoa(book.PublicationYear),
+		strings.Join(book.Subjects, "; "),
+	})
+	if err != nil {
+		return err
+	}
+
+	cw.count++
+	if cw.count%500 == 0 {
+		cw.w.Flush()
+		return cw.w.Error()
+	}
+	return nil
+}
+
+func (cw *csvCatalogWriter) End() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+type ndjsonCatalogWriter struct {
+	enc *json.Encoder
+}
+
+func (nw *ndjsonCatalogWriter) Begin() error { return nil }
+
+func (nw *ndjsonCatalogWriter) Write(book *BookInventory) error { return nw.enc.Encode(book) }
+
+func (nw *ndjsonCatalogWriter) End() error { return nil }
+
+type marcControlField struct {
+	Tag   string `xml:"tag,attr"`
+	Value string `xml:",chardata"`
+}
+
+type marcSubfield struct {
+	Code  string `xml:"code,attr"`
+	Value string `xml:",chardata"`
+}
+
+type marcDataField struct {
+	Tag       string         `xml:"tag,attr"`
+	Ind1      string         `xml:"ind1,attr"`
+	Ind2      string         `xml:"ind2,attr"`
+	Subfields []marcSubfield `xml:"subfield"`
+}
+
+type marcRecord struct {
+	XMLName       xml.Name           `xml:"record"`
+	Leader        string             `xml:"leader"`
+	ControlFields []marcControlField `xml:"controlfield"`
+	DataFields    []marcDataField    `xml:"datafield"`
+}
+
+func marcField(tag string, subfields ...string) marcDataField {
+	field := marcDataField{Tag: tag, Ind1: " ", Ind2: " "}
+	for i := 0; i+1 < len(subfields); i += 2 {
+		if subfields[i+1] != "" {
+			field.Subfields = append(field.Subfields, marcSubfield{Code: subfields[i], Value: subfields[i+1]})
+		}
+	}
+	return field
+}
+
+// marcFromBook maps a book onto the MARC 21 bibliographic fields we can fill.
+func marcFromBook(book *BookInventory) marcRecord {
+	record := marcRecord{
+		Leader:        "00000nam a2200000 a 4500",
+		ControlFields: []marcControlField{{Tag: "001", Value: book.ISBN}},
+	}
+
+	add := func(field marcDataField) {
+		if len(field.Subfields) > 0 {
+			record.DataFields = append(record.DataFields, field)
+		}
+	}
+
+	year := ""
+	if book.PublicationYear > 0 {
+		year = strconv.Itoa(book.PublicationYear)
+	}
+	seriesNumber := ""
+	if book.SeriesNumber > 0 {
+		seriesNumber = strconv.Itoa(book.SeriesNumber)
+	}
+
+	add(marcField("020", "a", book.ISBN))
+	add(marcField("041", "a", book.Language))
+
+	authors := book.AuthorList
+	if len(authors) == 0 {
+		authors = splitAuthors(book.Authors)
+	}
+	if len(authors) > 0 {
+		add(marcField("100", "a", authors[0].Name))
+	}
+	add(marcField("245", "a", book.Title))
+	add(marcField("250", "a", book.Version))
+	add(marcField("264", "b", book.Publisher, "c", year))
+	add(marcField("490", "a", book.SeriesName, "v", seriesNumber))
+	for _, subject := range book.Subjects {
+		add(marcField("650", "a", subject))
+	}
+	for i := 1; i < len(authors); i++ {
+		add(marcField("700", "a", authors[i].Name))
+	}
+	return record
+}
+
+type marcCatalogWriter struct {
+	w   io.Writer
+	enc *xml.Encoder
+}
+
+func (mw *marcCatalogWriter) Begin() error {
+	_, err := io.WriteString(mw.w, xml.Header+`<collection xmlns="http://www.loc.gov/MARC21/slim">`+"\n")
+	return err
+}
+
+func (mw *marcCatalogWriter) Write(book *BookInventory) error {
+	if err := mw.enc.Encode(marcFromBook(book)); err != nil {
+		return err
+	}
+	_, err := io.WriteString(mw.w, "\n")
+	return err
+}
+
+func (mw *marcCatalogWriter) End() error {
+	_, err := io.WriteString(mw.w, "</collection>\n")
+	return err
+}
+
+// exportLibraryCatalog streams the catalog as ?format=csv|ndjson|marcxml.
+// Owners pass the library in the URL; admins export their own library.
+func (s *Server) exportLibraryCatalog(c *gin.Context) {
+	format := c.DefaultQuery("format", "csv")
+	contentType, ok := exportContentTypes[format]
+	if !ok {
+		respondError(c, badRequest("format must be one of csv, ndjson, marcxml"))
+		return
+	}
+
+	var libID int
+	if c.Param("id") != "" {
+		var ok bool
+		if libID, ok = paramID(c, "id"); !ok {
+			return
+		}
+		if _, err := s.store.Libraries.Get(libID); err != nil {
+			if errors.Is(err, errNotFound) {
+				respondError(c, notFoundError("Library not found"))
+				return
+			}
+
+			respondError(c, err)
+			return
+		}
+	} else {
+		libID = c.MustGet("user").(User).LibID
+	}
+
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="library-%d.%s"`, libID, exportExtensions[format]))
+	c.Status(http.StatusOK)
+
+	// Headers are already sent, so a failure can only be logged
+	if err := exportCatalog(s.store.Books, c.Writer, libID, format); err != nil {
+		requestLog(c).Error("exporting catalog", "lib_id", libID, "err", err)
+	}
+}
+
+// runExportCommand implements `export -lib ID [-format csv] [-out file]`.
+func runExportCommand(store *Store, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	libID := flags.Int("lib", 1, "library ID to export")
+	format := flags.String("format", "csv", "csv, ndjson or marcxml")
+	out := flags.String("out", "", "output file (default stdout)")
+	flags.Parse(args)
+
+	if _, ok := exportContentTypes[*format]; !ok {
+		return fmt.Errorf("unsupported export format %q: use csv, ndjson or marcxml", *format)
+	}
+	exists, err := store.Libraries.Exists(*libID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("library %d does not exist; pass its ID with -lib", *libID)
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	buffered := bufio.NewWriter(w)
+	if err := exportCatalog(store.Books, buffered, *libID, *format); err != nil {
+		return err
+	}
+	return buffered.Flush()
+}
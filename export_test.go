@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// seedExport adds a second book to the seeded library and a book of another
+// library that must never show up in the export.
+func seedExport(t *testing.T, store *Store) *Library {
+	t.Helper()
+	library, _, _ := seedLibrary(t, store, 2)
+	book := &BookInventory{ISBN: "9780140449136", LibID: library.ID, Title: "The Odyssey", Authors: "Homer, Emily Wilson",
+		Publisher: "Penguin", TotalCopies: 1, AvailableCopies: 1, Language: "en", PublicationYear: 2018, Subjects: []string{"Epic poetry"}}
+	if err := store.Books.Create(book); err != nil {
+		t.Fatal(err)
+	}
+
+	other := &Library{Name: "Branch"}
+	if err := store.Libraries.Create(other); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Books.Create(&BookInventory{ISBN: "9780262033848", LibID: other.ID, Title: "Other", TotalCopies: 1, AvailableCopies: 1}); err != nil {
+		t.Fatal(err)
+	}
+	return library
+}
+
+func TestExportFormats(t *testing.T) {
+	store, _ := newTestStore(t)
+	library := seedExport(t, store)
+
+	t.Run("csv", func(t *testing.T) {
+		var out bytes.Buffer
+		if err := exportCatalog(store.Books, &out, library.ID, "csv"); err != nil {
+			t.Fatal(err)
+		}
+		records, err := csv.NewReader(&out).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 3 {
+			t.Fatalf("got %d rows, want a header and 2 books", len(records))
+		}
+		if records[0][0] != "isbn" || records[0][len(records[0])-1] != "subjects" {
+			t.Errorf("header = %v", records[0])
+		}
+		odyssey := records[1]
+		if odyssey[0] != "9780140449136" || odyssey[2] != "The Odyssey" || odyssey[3] != "Homer, Emily Wilson" || odyssey[12] != "Epic poetry" {
+			t.Errorf("first row = %v, want The Odyssey sorted by ISBN", odyssey)
+		}
+		if records[2][0] != "9780306406157" {
+			t.Errorf("second row = %v", records[2])
+		}
+	})
+
+	t.Run("ndjson", func(t *testing.T) {
+		var out bytes.Buffer
+		if err := exportCatalog(store.Books, &out, library.ID, "ndjson"); err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		if len(lines) != 2 {
+			t.Fatalf("got %d lines, want 2:\n%s", len(lines), out.String())
+		}
+		for _, line := range lines {
+			var book BookInventory
+			if err := json.Unmarshal([]byte(line), &book); err != nil {
+				t.Fatalf("%q: %v", line, err)
+			}
+			if book.LibID != library.ID {
+				t.Errorf("exported book %s of library %d", book.ISBN, book.LibID)
+			}
+		}
+	})
+
+	t.Run("marcxml", func(t *testing.T) {
+		var out bytes.Buffer
+		if err := exportCatalog(store.Books, &out, library.ID, "marcxml"); err != nil {
+			t.Fatal(err)
+		}
+		var collection struct {
+			XMLName xml.Name     `xml:"http://www.loc.gov/MARC21/slim collection"`
+			Records []marcRecord `xml:"record"`
+		}
+		if err := xml.Unmarshal(out.Bytes(), &collection); err != nil {
+			t.Fatalf("%v:\n%s", err, out.String())
+		}
+		if len(collection.Records) != 2 {
+			t.Fatalf("got %d records, want 2", len(collection.Records))
+		}
+
+		fields := map[string][]string{}
+		for _, field := range collection.Records[0].DataFields {
+			for _, sub := range field.Subfields {
+				fields[field.Tag+"$"+sub.Code] = append(fields[field.Tag+"$"+sub.Code], sub.Value)
+			}
+		}
+		want := map[string]string{"020$a": "9780140449136", "100$a": "Homer", "245$a": "The Odyssey", "264$c": "2018", "650$a": "Epic poetry", "700$a": "Emily Wilson"}
+		for key, value := range want {
+			if len(fields[key]) != 1 || fields[key][0] != value {
+				t.Errorf("%s = %v, want %q", key, fields[key], value)
+			}
+		}
+	})
+
+	if err := exportCatalog(store.Books, &bytes.Buffer{}, library.ID, "pdf"); err == nil {
+		t.Error("exporting as pdf succeeded")
+	}
+}
+
+func TestExportCommand(t *testing.T) {
+	store, _ := newTestStore(t)
+	library := seedExport(t, store)
+	dir := t.TempDir()
+
+	missing := filepath.Join(dir, "missing.csv")
+	err := runExportCommand(store, []string{"-lib", "99", "-out", missing})
+	if err == nil || !strings.Contains(err.Error(), "library 99 does not exist") {
+		t.Errorf("exporting an unknown library: err = %v", err)
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("exporting an unknown library created %s", missing)
+	}
+
+	if err := runExportCommand(store, []string{"-lib", strconv.Itoa(library.ID), "-format", "pdf", "-out", missing}); err == nil {
+		t.Error("exporting as pdf succeeded")
+	}
+
+	out := filepath.Join(dir, "catalog.ndjson")
+	if err := runExportCommand(store, []string{"-lib", strconv.Itoa(library.ID), "-format", "ndjson", "-out", out}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "\n"); n != 2 {
+		t.Errorf("wrote %d books, want 2", n)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// catalogReader yields books from an import file one at a time. Next returns
+// io.EOF once the input is exhausted. An error returned together with a book
+// only invalidates that record; an error without one ends the import.
+type catalogReader interface {
+	Next() (*BookInventory, error)
+}
+
+func newCatalogReader(r io.Reader, format string) (catalogReader, error) {
+	switch format {
+	case "csv":
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = -1
+		header, err := cr.Read()
+		if err != nil {
+			return nil, fmt.Errorf("reading CSV header: %w", err)
+		}
+		columns := make(map[string]int, len(header))
+		for i, name := range header {
+			columns[strings.TrimSpace(name)] = i
+		}
+		if _, ok := columns["isbn"]; !ok {
+			return nil, errors.New("CSV header has no isbn column")
+		}
+		return &csvCatalogReader{r: cr, columns: columns}, nil
+	case "ndjson":
+		return &ndjsonCatalogReader{scanner: bufio.NewScanner(r)}, nil
+	}
+	return nil, fmt.Errorf("unsupported import format %q", format)
+}
+
+// csvCatalogReader reads the layout written by csvCatalogWriter. Columns are
+// matched by header name, so files with fewer or reordered columns work too.
+type csvCatalogReader struct {
+	r       *csv.Reader
+	columns map[string]int
+}
+
+func (cr *csvCatalogReader) Next() (*BookInventory, error) {
+	record, err := cr.r.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	field := func(name string) string {
+		if i, ok := cr.columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+	var badNumber error
+	number := func(name string) int {
+		value := field(name)
+		if value == "" {
+			return 0
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil && badNumber == nil {
+			badNumber = fmt.Errorf("%s: %q is not a number", name, value)
+		}
+		return n
+	}
+
+	book := &BookInventory{
+		ISBN:            field("isbn"),
+		LibID:           number("libID"),
+		Title:           field("title"),
+		Authors:         field("authors"),
+		Publisher:       field("publisher"),
+		Version:         field("version"),
+		TotalCopies:     number("totalCopies"),
+		AvailableCopies: number("availableCopies"),
+		SeriesName:      field("seriesName"),
+		SeriesNumber:    number("seriesNumber"),
+		Language:        field("language"),
+		PublicationYear: number("publicationYear"),
+	}
+	for _, heading := range strings.Split(field("subjects"), ";") {
+		if heading = strings.TrimSpace(heading); heading != "" {
+			book.Subjects = append(book.Subjects, heading)
+		}
+	}
+	return book, badNumber
+}
+
+type ndjsonCatalogReader struct {
+	scanner *bufio.Scanner
+}
+
+func (nr *ndjsonCatalogReader) Next() (*BookInventory, error) {
+	for nr.scanner.Scan() {
+		line := strings.TrimSpace(nr.scanner.Text())
+		if line == "" {
+			continue
+		}
+		var book BookInventory
+		if err := json.Unmarshal([]byte(line), &book); err != nil {
+			return &book, err
+		}
+		return &book, nil
+	}
+	if err := nr.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+type importResult struct {
+	Created int
+	Updated int
+	Skipped int
+	Failed  int
+}
+
+// importCatalog adds every book read from r. Existing ISBNs are skipped, or
+// overwritten when update is set. Invalid records are reported on report and
+// do not stop the import. When libID is positive it overrides the library
+// named in the file.
+func importCatalog(store *Store, r catalogReader, libID int, update, dryRun bool, report io.Writer) (importResult, error) {
+	var result importResult
+	for record := 1; ; record++ {
+		book, err := r.Next()
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil && book == nil {
+			return result, fmt.Errorf("record %d: %w", record, err)
+		}
+		if err != nil {
+			fmt.Fprintf(report, "record %d: %v\n", record, err)
+			result.Failed++
+			continue
+		}
+
+		if libID > 0 {
+			book.LibID = libID
+		}
+		var errs ValidationErrors
+		if err := validateBook(book, true, store.Libraries); errors.As(err, &errs) {
+			fmt.Fprintf(report, "record %d (%s): %v\n", record, book.ISBN, errs)
+			result.Failed++
+			continue
+		} else if err != nil {
+			return result, err
+		}
+
+		_, err = store.Books.Get(book.ISBN)
+		exists := err == nil
+		if err != nil && !errors.Is(err, errNotFound) {
+			return result, err
+		}
+		if exists && !update {
+			result.Skipped++
+			continue
+		}
+
+		if dryRun {
+			err = nil
+		} else if exists {
+			err = store.Books.Update(book)
+		} else {
+			err = store.Books.Create(book)
+		}
+		if errors.Is(err, errDeleted) {
+			err = errors.New("book was deleted; restore it before importing")
+		}
+		if err != nil {
+			fmt.Fprintf(report, "record %d (%s): %v\n", record, book.ISBN, err)
+			result.Failed++
+			continue
+		}
+		if exists {
+			result.Updated++
+		} else {
+			result.Created++
+		}
+	}
+}
+
+func runImportCommand(store *Store, args []string) error {
+	flags := flag.NewFlagSet("import-books", flag.ExitOnError)
+	libID := flags.Int("lib", 0, "library to import into (default: the libID column of each record)")
+	format := flags.String("format", "", "csv or ndjson (default: from the file extension)")
+	update := flags.Bool("update", false, "overwrite books whose ISBN already exists")
+	dryRun := flags.Bool("dry-run", false, "validate the file without writing to the database")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("import-books: exactly one input file is required")
+	}
+	path := flags.Arg(0)
+
+	if *format == "" {
+		*format = "csv"
+		if ext := strings.ToLower(filepath.Ext(path)); ext == ".ndjson" || ext == ".jsonl" {
+			*format = "ndjson"
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader, err := newCatalogReader(file, *format)
+	if err != nil {
+		return err
+	}
+
+	result, err := importCatalog(store, reader, *libID, *update, *dryRun, os.Stderr)
+	fmt.Printf("Created %d, updated %d, skipped %d, failed %d\n", result.Created, result.Updated, result.Skipped, result.Failed)
+	if err != nil {
+		return err
+	}
+	if result.Failed > 0 {
+		return fmt.Errorf("%d records could not be imported", result.Failed)
+	}
+	return nil
+}
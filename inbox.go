@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Notification channels a user can choose per event. Email is the default.
+const (
+	channelEmail = "email"
+	channelInApp = "in_app"
+	channelNone  = "none"
+)
+
+const (
+	defaultInboxLimit = 50
+	maxInboxLimit     = 500
+)
+
+// Notification is a message delivered to a user's in-app inbox. It holds the
+// same rendered subject and body an email would have.
+type Notification struct {
+	ID        int        `json:"id"`
+	UserID    int        `json:"userID"`
+	Event     string     `json:"event"`
+	Subject   string     `json:"subject"`
+	Body      string     `json:"body"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ReadAt    *time.Time `json:"readAt,omitempty"`
+}
+
+func createNotificationTables() error {
+	createNotificationTablesSQL := []string{
+		`CREATE TABLE IF NOT EXISTS notification_preferences (
+        "UserID" INTEGER NOT NULL,
+        "Event" TEXT NOT NULL,
+        "Channel" TEXT NOT NULL,
+        PRIMARY KEY ("UserID", "Event"),
+        FOREIGN KEY ("UserID") REFERENCES users("ID") ON DELETE CASCADE
+    );`,
+		`CREATE TABLE IF NOT EXISTS notifications (
+        "ID" INTEGER PRIMARY KEY AUTOINCREMENT,
+        "UserID" INTEGER NOT NULL,
+        "Event" TEXT NOT NULL,
+        "Subject" TEXT NOT NULL,
+        "Body" TEXT NOT NULL,
+        "CreatedAt" TIMESTAMP NOT NULL,
+        "ReadAt" TIMESTAMP,
+        FOREIGN KEY ("UserID") REFERENCES users("ID") ON DELETE CASCADE
+    );`,
+		`CREATE INDEX IF NOT EXISTS notifications_user ON notifications ("UserID", "ID");`,
+	}
+
+	for _, stmt := range createNotificationTablesSQL {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notificationChannel returns the channel prefs choose for event.
+func notificationChannel(prefs map[string]string, event string) string {
+	if channel, ok := prefs[event]; ok {
+		return channel
+	}
+	return channelEmail
+}
+
+// getNotificationPreferences serves GET /account/notifications/preferences
+// with the channel of every event, defaults included.
+func (s *Server) getNotificationPreferences(c *gin.Context) {
+	user := c.MustGet("user").(User)
+	s.respondPreferences(c, user.ID)
+}
+
+// updateNotificationPreferences serves PUT /account/notifications/preferences.
+// The body maps events to channels; events it leaves out keep their channel.
+func (s *Server) updateNotificationPreferences(c *gin.Context) {
+	user := c.MustGet("user").(User)
+
+	var prefs map[string]string
+	if err := c.ShouldBindJSON(&prefs); err != nil {
+		respondError(c, badRequest(err.Error()))
+		return
+	}
+	for event, channel := range prefs {
+		if _, ok := defaultTemplates[event]; !ok {
+			respondError(c, fieldError(event, "unknown event"))
+			return
+		}
+		if channel != channelEmail && channel != channelInApp && channel != channelNone {
+			respondError(c, fieldError(event, "channel must be email, in_app or none"))
+			return
+		}
+	}
+
+	before, _ := s.store.Notifications.Preferences(user.ID)
+	if err := s.store.Atomic(func(tx *Store) error {
+		if err := tx.Notifications.SetPreferences(user.ID, prefs); err != nil {
+			return err
+		}
+		return auditTx(c, tx, "update", "notification_preferences", strconv.Itoa(user.ID), before, prefs)
+	}); err != nil {
+		respondError(c, err)
+		return
+	}
+	s.respondPreferences(c, user.ID)
+}
+
+func (s *Server) respondPreferences(c *gin.Context, userID int) {
+	prefs, err := s.store.Notifications.Preferences(userID)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	channels := make(map[string]string, len(defaultTemplates))
+	for event := range defaultTemplates {
+		channels[event] = notificationChannel(prefs, event)
+	}
+	c.JSON(http.StatusOK, channels)
+}
+
+// listNotifications serves GET /account/notifications, newest first. With
+// unread=true only unread notifications are listed.
+func (s *Server) listNotifications(c *gin.Context) {
+	user := c.MustGet("user").(User)
+	limit := defaultInboxLimit
+	if value := c.Query("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+			respondError(c, badRequest("Invalid limit"))
+			return
+		}
+		if limit > maxInboxLimit {
+			limit = maxInboxLimit
+		}
+	}
+	unreadOnly, err := strconv.ParseBool(c.DefaultQuery("unread", "false"))
+	if err != nil {
+		respondError(c, badRequest("Invalid unread"))
+		return
+	}
+
+	notifications, err := s.store.Notifications.List(user.ID, unreadOnly, limit)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, notifications)
+}
+
+// markNotificationRead serves POST /account/notifications/:id/read.
+func (s *Server) markNotificationRead(c *gin.Context) {
+	user := c.MustGet("user").(User)
+	id, ok := paramID(c, "id")
+	if !ok {
+		return
+	}
+
+	if err := s.store.Notifications.MarkRead(user.ID, id, time.Now().UTC()); err != nil {
+		if errors.Is(err, errNotFound) {
+			respondError(c, notFoundError("Notification not found"))
+			return
+		}
+
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Notification marked as read"})
+}
+
+// markAllNotificationsRead serves POST /account/notifications/read.
+func (s *Server) markAllNotificationsRead(c *gin.Context) {
+	user := c.MustGet("user").(User)
+	n, err := s.store.Notifications.MarkAllRead(user.ID, time.Now().UTC())
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"marked": n})
+}
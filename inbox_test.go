@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestInboxFollowsPreferences(t *testing.T) {
+	store, _ := newTestStore(t)
+	library, admin, book := seedLibrary(t, store, 1)
+	reader := &User{Name: "Ada", Email: "ada@example.org", Role: "reader", LibID: library.ID}
+	if err := store.Users.Create(reader); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{store: store}
+
+	const path = "/account/notifications/preferences"
+	w := serveAs(reader, path, s.updateNotificationPreferences, http.MethodPut, path,
+		`{"`+notifyOverdue+`": "`+channelInApp+`", "`+notifyDueSoon+`": "`+channelNone+`"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("update preferences: %d %s", w.Code, w.Body.String())
+	}
+	var channels map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &channels); err != nil {
+		t.Fatal(err)
+	}
+	if channels[notifyOverdue] != channelInApp || channels[notifyDueSoon] != channelNone || channels[notifyRequestApproved] != channelEmail {
+		t.Errorf("channels = %v, want overdue in the inbox, due soon off and the rest by email", channels)
+	}
+	for _, body := range []string{`{"overdue": "pigeon"}`, `{"birthday": "email"}`} {
+		if w := serveAs(reader, path, s.updateNotificationPreferences, http.MethodPut, path, body); w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%s: status %d, want 422", body, w.Code)
+		}
+	}
+
+	notifier, err := newNotifier(MailConfig{}, store.Notifications)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	loan := &IssueRegistery{ISBN: book.ISBN, IssueDate: now.AddDate(0, 0, -20), ExpectedReturnDate: now.AddDate(0, 0, -6)}
+	request := &RequestEvent{BookID: book.ISBN, ReaderID: reader.ID, RequestType: requestTypeIssue, RequestDate: now.AddDate(0, 0, -21)}
+	data := NotificationData{User: reader, Title: book.Title, Loan: loan, Request: request}
+	if err := notifier.Notify(notifyOverdue, data); err != nil {
+		t.Errorf("in-app notification: %v", err)
+	}
+	if err := notifier.Notify(notifyDueSoon, data); err != nil {
+		t.Errorf("muted notification: %v", err)
+	}
+	if err := notifier.Notify(notifyRequestApproved, data); !errors.Is(err, errMailDisabled) {
+		t.Errorf("email without a mail server: err = %v, want errMailDisabled", err)
+	}
+
+	list := func(query string) []Notification {
+		t.Helper()
+		w := serveAs(reader, "/account/notifications", s.listNotifications, http.MethodGet, "/account/notifications"+query, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("list: %d %s", w.Code, w.Body.String())
+		}
+		var notifications []Notification
+		if err := json.Unmarshal(w.Body.Bytes(), &notifications); err != nil {
+			t.Fatal(err)
+		}
+		return notifications
+	}
+	inbox := list("?unread=true")
+	if len(inbox) != 1 || inbox[0].Event != notifyOverdue || inbox[0].Subject == "" || inbox[0].ReadAt != nil {
+		t.Fatalf("inbox = %+v, want one unread overdue notification", inbox)
+	}
+
+	id := strconv.Itoa(inbox[0].ID)
+	if w := serveAs(admin, "/account/notifications/:id/read", s.markNotificationRead, http.MethodPost, "/account/notifications/"+id+"/read", ""); w.Code != http.StatusNotFound {
+		t.Errorf("marking another user's notification: status %d, want 404", w.Code)
+	}
+	if w := serveAs(reader, "/account/notifications/:id/read", s.markNotificationRead, http.MethodPost, "/account/notifications/"+id+"/read", ""); w.Code != http.StatusOK {
+		t.Fatalf("mark read: %d %s", w.Code, w.Body.String())
+	}
+	if unread := list("?unread=true"); len(unread) != 0 {
+		t.Errorf("%d unread after marking read", len(unread))
+	}
+	if all := list(""); len(all) != 1 || all[0].ReadAt == nil {
+		t.Errorf("inbox = %+v, want the notification marked read", all)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// errInvalidReference is returned by repositories when a row points at a user,
+// book or library that does not exist.
+var errInvalidReference = errors.New("invalid reference")
+
+// foreignKey describes one reference between tables. The list drives the
+// PostgreSQL constraint migration and the check command; the SQLite schemas
+// spell out the same rules in their CREATE TABLE statements.
+type foreignKey struct {
+	Table        string
+	Column       string
+	Parent       string
+	ParentColumn string
+	OnDelete     string
+	// Key identifies the child row in check reports.
+	Key string
+}
+
+// History rows (requests and loans) keep their users and books alive, while
+// catalog links go away with what they link. Users, books and libraries are
+// soft deleted, so RESTRICT only guards against manual hard deletes.
+var foreignKeys = []foreignKey{
+	{"users", "LibID", "library", "ID", "RESTRICT", "ID"},
+	{"book_inventory", "LibID", "library", "ID", "RESTRICT", "ISBN"},
+	{"RequestEvents", "BookID", "book_inventory", "ISBN", "RESTRICT", "ReqID"},
+	{"RequestEvents", "ReaderID", "users", "ID", "RESTRICT", "ReqID"},
+	{"RequestEvents", "ApproverID", "users", "ID", "RESTRICT", "ReqID"},
+	{"IssueRegistery", "ISBN", "book_inventory", "ISBN", "RESTRICT", "IssueID"},
+	{"IssueRegistery", "ReaderID", "users", "ID", "RESTRICT", "IssueID"},
+	{"IssueRegistery", "IssueApproverID", "users", "ID", "RESTRICT", "IssueID"},
+	{"IssueRegistery", "ReturnApproverID", "users", "ID", "RESTRICT", "IssueID"},
+	{"book_authors", "ISBN", "book_inventory", "ISBN", "CASCADE", "ISBN"},
+	{"book_authors", "AuthorID", "authors", "ID", "CASCADE", "ISBN"},
+	{"book_subjects", "ISBN", "book_inventory", "ISBN", "CASCADE", "ISBN"},
+	{"book_subjects", "SubjectID", "subjects", "ID", "CASCADE", "ISBN"},
+	{"loan_reminders", "IssueID", "IssueRegistery", "IssueID", "CASCADE", "IssueID"},
+	{"webhooks", "LibID", "library", "ID", "RESTRICT", "ID"},
+	{"webhook_deliveries", "WebhookID", "webhooks", "ID", "CASCADE", "ID"},
+	{"notification_preferences", "UserID", "users", "ID", "CASCADE", "UserID"},
+	{"notifications", "UserID", "users", "ID", "CASCADE", "ID"},
+}
+
+// zeroReferenceCleanup turns the 0 and "" placeholders earlier releases wrote
+// for "no user" or "no book" into NULL, which foreign keys accept.
+var zeroReferenceCleanup = []string{
+	"UPDATE RequestEvents SET BookID = NULL WHERE BookID = '' OR BookID = '0'",
+	"UPDATE RequestEvents SET ReaderID = NULL WHERE ReaderID = 0",
+	"UPDATE RequestEvents SET ApproverID = NULL WHERE ApproverID = 0",
+	"UPDATE IssueRegistery SET ISBN = NULL WHERE ISBN = ''",
+	"UPDATE IssueRegistery SET ReaderID = NULL WHERE ReaderID = 0",
+	"UPDATE IssueRegistery SET IssueApproverID = NULL WHERE IssueApproverID = 0",
+	"UPDATE IssueRegistery SET ReturnApproverID = NULL WHERE ReturnApproverID = 0",
+}
+
+func cleanupZeroReferences(conn *dbConn) error {
+	for _, stmt := range zeroReferenceCleanup {
+		if _, err := conn.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebuildTableIfOutdated recreates a SQLite table from schema when its stored
+// definition lacks any of the given markers. SQLite cannot change column
+// types or constraints with ALTER TABLE, so the rows are copied into a fresh
+// table. If existing rows violate the new constraints the copy fails and the
+// old table is kept; the error is fatal, because the server relies on the
+// constraints being in place. Foreign key enforcement must be off while this
+// runs; migrate takes care of that.
+func rebuildTableIfOutdated(table, schema string, markers ...string) error {
+	var current string
+	err := db.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&current)
+	if err != nil {
+		return fmt.Errorf("upgrading table %s: %w", table, err)
+	}
+	outdated := false
+	for _, marker := range markers {
+		if !strings.Contains(current, marker) {
+			outdated = true
+		}
+	}
+	if !outdated {
+		return nil
+	}
+
+	columns, err := tableColumns(table)
+	if err != nil {
+		return fmt.Errorf("upgrading table %s: %w", table, err)
+	}
+	columnList := `"` + strings.Join(columns, `", "`) + `"`
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("upgrading table %s: %w", table, err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`CREATE TABLE ` + table + `_new ` + schema); err != nil {
+		return fmt.Errorf("upgrading table %s: %w", table, err)
+	}
+	copyRows := `INSERT INTO ` + table + `_new (` + columnList + `) SELECT ` + columnList + ` FROM ` + table
+	if _, err := tx.Exec(copyRows); err != nil {
+		return fmt.Errorf("upgrading table %s: existing rows violate the new constraints; fix them and run migrate again: %w", table, err)
+	}
+	statements := []string{
+		`DROP TABLE ` + table,
+		`ALTER TABLE ` + table + `_new RENAME TO ` + table,
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("upgrading table %s: %w", table, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("upgrading table %s: %w", table, err)
+	}
+	return nil
+}
+
+func tableColumns(table string) ([]string, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt interface{}
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			return nil, err
+		}
+		columns = append(columns, name)
+	}
+	return columns, rows.Err()
+}
+
+// postgresForeignKeys replaces the default constraints of databases created by
+// earlier releases with ones carrying the ON DELETE rules. Each statement is a
+// no-op once the constraint has the expected rule.
+func postgresForeignKeys() []string {
+	actions := map[string]string{"RESTRICT": "r", "CASCADE": "c"}
+
+	var statements []string
+	for _, fk := range foreignKeys {
+		name := strings.ToLower(fk.Table + "_" + fk.Column + "_fkey")
+		statements = append(statements, fmt.Sprintf(`DO $$ BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = '%s' AND confdeltype = '%s') THEN
+        ALTER TABLE %s DROP CONSTRAINT IF EXISTS %s;
+        ALTER TABLE %s ADD CONSTRAINT %s FOREIGN KEY (%s) REFERENCES %s(%s) ON DELETE %s;
+    END IF;
+END $$`, name, actions[fk.OnDelete], fk.Table, name, fk.Table, name, fk.Column, fk.Parent, fk.ParentColumn, fk.OnDelete))
+	}
+	return statements
+}
+
+// isForeignKeyViolation recognises the constraint errors of both drivers.
+func isForeignKeyViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintForeignKey
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23503"
+	}
+	return false
+}
+
+// isUniqueViolation recognises unique and primary key violations of both
+// drivers.
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique || sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23505"
+	}
+	return false
+}
+
+func referenceError(err error) error {
+	if isForeignKeyViolation(err) {
+		return errInvalidReference
+	}
+	return err
+}
+
+// orphan is a row whose reference points at a missing parent.
+type orphan struct {
+	fk    foreignKey
+	key   string
+	value string
+}
+
+func (o orphan) String() string {
+	return fmt.Sprintf("%s %s=%s: %s %s not found in %s.%s", o.fk.Table, o.fk.Key, o.key, o.fk.Column, o.value, o.fk.Parent, o.fk.ParentColumn)
+}
+
+// findOrphans lists every row that breaks one of foreignKeys. It works on both
+// dialects and on databases where enforcement was off when the rows were written.
+func findOrphans(conn *dbConn) ([]orphan, error) {
+	var orphans []orphan
+	for _, fk := range foreignKeys {
+		query := fmt.Sprintf(`SELECT CAST(c.%s AS TEXT), CAST(c.%s AS TEXT) FROM %s c
+			LEFT JOIN %s p ON p.%s = c.%s
+			WHERE c.%s IS NOT NULL AND p.%s IS NULL`,
+			fk.Key, fk.Column, fk.Table, fk.Parent, fk.ParentColumn, fk.Column, fk.Column, fk.ParentColumn)
+		rows, err := conn.Query(query)
+		if err != nil {
+			return nil, fmt.Errorf("checking %s.%s: %w", fk.Table, fk.Column, err)
+		}
+		for rows.Next() {
+			o := orphan{fk: fk}
+			if err := rows.Scan(&o.key, &o.value); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			orphans = append(orphans, o)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return orphans, nil
+}
+
+// runCheckCommand implements `check`, reporting orphaned rows. It exits with
+// an error when any are found so it can gate scripts.
+func runCheckCommand(a *app, args []string) error {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	flags.Parse(args)
+
+	orphans, err := findOrphans(a.conn)
+	if err != nil {
+		return err
+	}
+	for _, o := range orphans {
+		fmt.Println(o)
+	}
+	if len(orphans) > 0 {
+		return fmt.Errorf("found %d orphaned rows", len(orphans))
+	}
+	fmt.Println("No orphaned rows found")
+	return nil
+}
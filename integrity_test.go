@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// execWithoutForeignKeys runs stmts on one connection with enforcement off, the
+// way rows written by releases before foreign keys could look.
+func execWithoutForeignKeys(t *testing.T, conn *dbConn, stmts ...string) {
+	t.Helper()
+	ctx := context.Background()
+	pinned, err := conn.DB.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pinned.Close()
+	if _, err := pinned.ExecContext(ctx, "PRAGMA foreign_keys = OFF"); err != nil {
+		t.Fatal(err)
+	}
+	defer pinned.ExecContext(ctx, "PRAGMA foreign_keys = ON")
+	for _, stmt := range stmts {
+		if _, err := pinned.ExecContext(ctx, stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+}
+
+func TestForeignKeysEnforced(t *testing.T) {
+	store, conn := newTestStore(t)
+	library, admin, book := seedLibrary(t, store, 2)
+	book.Subjects = []string{"Physics"}
+	if err := store.Books.Update(book); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC()
+	err := store.Issues.Create(&IssueRegistery{ISBN: book.ISBN, ReaderID: 9999, IssueApproverID: admin.ID, IssueStatus: issueStatusIssued, IssueDate: now, ExpectedReturnDate: now})
+	if !errors.Is(err, errInvalidReference) {
+		t.Errorf("loan for a missing reader: err = %v, want errInvalidReference", err)
+	}
+	if err := store.Users.Create(&User{Name: "Ghost", Email: "ghost@example.org", Role: "reader", LibID: library.ID + 1}); !errors.Is(err, errInvalidReference) {
+		t.Errorf("user of a missing library: err = %v, want errInvalidReference", err)
+	}
+
+	// Loans keep their book alive; catalog links go with it
+	if err := store.Issues.Create(&IssueRegistery{ISBN: book.ISBN, ReaderID: admin.ID, IssueApproverID: admin.ID, IssueStatus: issueStatusIssued, IssueDate: now, ExpectedReturnDate: now}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Exec("DELETE FROM book_inventory WHERE ISBN = ?", book.ISBN); err == nil || !strings.Contains(err.Error(), "FOREIGN KEY") {
+		t.Errorf("hard deleting a book with loans: err = %v, want a foreign key failure", err)
+	}
+	if _, err := conn.Exec("DELETE FROM IssueRegistery"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Exec("DELETE FROM book_inventory WHERE ISBN = ?", book.ISBN); err != nil {
+		t.Fatal(err)
+	}
+	var links int
+	if err := conn.QueryRow("SELECT COUNT(*) FROM book_subjects").Scan(&links); err != nil {
+		t.Fatal(err)
+	}
+	if links != 0 {
+		t.Errorf("%d subject links outlived their book", links)
+	}
+}
+
+func TestFindOrphans(t *testing.T) {
+	store, conn := newTestStore(t)
+	_, admin, book := seedLibrary(t, store, 1)
+	a := &app{config: defaultConfig(), conn: conn, store: store}
+
+	if err := runCheckCommand(a, nil); err != nil {
+		t.Errorf("check on a clean database: %v", err)
+	}
+
+	execWithoutForeignKeys(t, conn,
+		`INSERT INTO RequestEvents (BookID, ReaderID, RequestType) VALUES ('`+book.ISBN+`', 0, 'issue')`,
+		`INSERT INTO RequestEvents (BookID, ReaderID, RequestType) VALUES ('9780000000002', `+strconv.Itoa(admin.ID)+`, 'issue')`,
+	)
+
+	// The 0 placeholder of earlier releases means "no reader", not a missing one
+	if err := cleanupZeroReferences(conn); err != nil {
+		t.Fatal(err)
+	}
+	orphans, err := findOrphans(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 1 {
+		t.Fatalf("found %v, want only the request for the missing book", orphans)
+	}
+	if got := orphans[0].String(); !strings.Contains(got, "RequestEvents") || !strings.Contains(got, "BookID 9780000000002 not found in book_inventory.ISBN") {
+		t.Errorf("orphan = %q", got)
+	}
+	if err := runCheckCommand(a, nil); err == nil || !strings.Contains(err.Error(), "found 1 orphaned rows") {
+		t.Errorf("check with an orphan: err = %v", err)
+	}
+}
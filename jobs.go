@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	issueStatusIssued   = "issued"
+	issueStatusOverdue  = "overdue"
+	issueStatusReturned = "returned"
+)
+
+// Reminder kinds; each loan gets at most one reminder of each kind.
+const (
+	reminderDue     = "due"
+	reminderOverdue = "overdue"
+)
+
+var reminderEvents = map[string]string{
+	reminderDue:     notifyDueSoon,
+	reminderOverdue: notifyOverdue,
+}
+
+const (
+	jobStatusOK     = "ok"
+	jobStatusFailed = "failed"
+)
+
+// Job is a maintenance task. The scheduler started by serve runs every job
+// each jobs.intervalHours, and run-jobs runs them on demand. Run returns a
+// short human readable summary of what it did.
+type Job struct {
+	Name        string
+	Description string
+	Run         func(a *app, now time.Time) (string, error)
+}
+
+// jobs run in this order, so the reminders see the loans mark-overdue has
+// just flagged.
+var jobs = []Job{
+	{Name: "mark-overdue", Description: "flag loans past their return date as overdue", Run: markOverdueJob},
+	{Name: "due-reminders", Description: "remind readers of loans due within circulation.reminderDaysAhead days", Run: dueRemindersJob},
+	{Name: "overdue-reminders", Description: "remind readers of overdue loans", Run: overdueRemindersJob},
+	{Name: "prune-outbox", Description: "delete events dispatched more than 30 days ago", Run: pruneOutboxJob},
+}
+
+// JobRun is the recorded outcome of one run of a job.
+type JobRun struct {
+	ID          int       `json:"id"`
+	Job         string    `json:"job"`
+	TriggeredBy string    `json:"triggeredBy"`
+	StartedAt   time.Time `json:"startedAt"`
+	FinishedAt  time.Time `json:"finishedAt"`
+	Status      string    `json:"status"`
+	Summary     string    `json:"summary"`
+}
+
+func createJobTables() error {
+	createJobTablesSQL := []string{
+		`CREATE TABLE IF NOT EXISTS loan_reminders (
+        "IssueID" INTEGER NOT NULL,
+        "Kind" TEXT NOT NULL,
+        "SentAt" TIMESTAMP NOT NULL,
+        PRIMARY KEY ("IssueID", "Kind"),
+        FOREIGN KEY ("IssueID") REFERENCES IssueRegistery("IssueID") ON DELETE CASCADE
+    );`,
+		`CREATE TABLE IF NOT EXISTS job_runs (
+        "ID" INTEGER PRIMARY KEY AUTOINCREMENT,
+        "Job" TEXT NOT NULL,
+        "TriggeredBy" TEXT NOT NULL,
+        "StartedAt" TIMESTAMP NOT NULL,
+        "FinishedAt" TIMESTAMP NOT NULL,
+        "Status" TEXT NOT NULL,
+        "Summary" TEXT NOT NULL DEFAULT ''
+    );`,
+		`CREATE INDEX IF NOT EXISTS job_runs_job ON job_runs ("Job", "StartedAt");`,
+	}
+
+	for _, stmt := range createJobTablesSQL {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func markOverdueJob(a *app, now time.Time) (string, error) {
+	loans, err := a.store.Issues.MarkOverdue(now)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("marked %d loans overdue", len(loans)), nil
+}
+
+func dueRemindersJob(a *app, now time.Time) (string, error) {
+	days := a.config.Circulation.ReminderDaysAhead
+	if days == 0 {
+		return "disabled by circulation.reminderDaysAhead", nil
+	}
+	return sendReminders(a, reminderDue, issueStatusIssued, now.AddDate(0, 0, days), now)
+}
+
+func overdueRemindersJob(a *app, now time.Time) (string, error) {
+	return sendReminders(a, reminderOverdue, issueStatusOverdue, now, now)
+}
+
+// sendReminders notifies the readers of loans in status due before dueBefore
+// that have not had a reminder of kind. A reminder that cannot be delivered,
+// including for want of a mail server, is released so the next run tries
+// again; loans of deleted readers are skipped for good.
+func sendReminders(a *app, kind, status string, dueBefore, now time.Time) (string, error) {
+	loans, err := a.store.Issues.PendingReminders(kind, status, dueBefore)
+	if err != nil {
+		return "", err
+	}
+
+	sent, skipped, held, failed := 0, 0, 0, 0
+	for i := range loans {
+		loan := &loans[i]
+		claimed, err := a.store.Issues.ClaimReminder(loan.IssueID, kind, now)
+		if err != nil {
+			return "", err
+		}
+		if !claimed {
+			continue
+		}
+
+		reader, err := a.store.Users.Get(loan.ReaderID)
+		if errors.Is(err, errNotFound) {
+			skipped++
+			continue
+		}
+		if err == nil {
+			err = a.notifier.Notify(reminderEvents[kind], NotificationData{User: reader, Title: bookTitle(a.store, loan.ISBN), Loan: loan})
+		}
+		if err != nil {
+			if errors.Is(err, errMailDisabled) {
+				held++
+			} else {
+				slog.Error("sending reminder", "kind", kind, "issue_id", loan.IssueID, "err", err)
+				failed++
+			}
+			if err := a.store.Issues.ReleaseReminder(loan.IssueID, kind); err != nil {
+				return "", err
+			}
+			continue
+		}
+		sent++
+	}
+
+	summary := fmt.Sprintf("sent %d %s reminders, skipped %d", sent, kind, skipped)
+	if held > 0 {
+		summary += fmt.Sprintf(", kept %d until mail is configured", held)
+	}
+	if failed > 0 {
+		return summary, fmt.Errorf("%d %s reminders could not be sent", failed, kind)
+	}
+	return summary, nil
+}
+
+func bookTitle(store *Store, isbn string) string {
+	if book, err := store.Books.Get(isbn); err == nil && book.Title != "" {
+		return book.Title
+	}
+	return isbn
+}
+
+func findJob(name string) (Job, bool) {
+	for _, job := range jobs {
+		if job.Name == name {
+			return job, true
+		}
+	}
+	return Job{}, false
+}
+
+// runJob runs job once and records the outcome. A failed run keeps whatever
+// summary the job produced before the error.
+func runJob(a *app, job Job, trigger string) (*JobRun, error) {
+	run := &JobRun{Job: job.Name, TriggeredBy: trigger, StartedAt: time.Now().UTC(), Status: jobStatusOK}
+	summary, err := job.Run(a, run.StartedAt)
+	run.FinishedAt = time.Now().UTC()
+	run.Summary = summary
+	if err != nil {
+		run.Status = jobStatusFailed
+		if summary != "" {
+			run.Summary = summary + ": " + err.Error()
+		} else {
+			run.Summary = err.Error()
+		}
+	}
+
+	if err := a.store.JobRuns.Record(run); err != nil {
+		slog.Error("recording job run", "job", run.Job, "err", err)
+	}
+	return run, err
+}
+
+// runJobs runs the selected jobs in order. Every job runs even if an earlier
+// one fails; the first failure is returned at the end.
+func runJobs(a *app, selected []Job, trigger string) error {
+	var firstErr error
+	for _, job := range selected {
+		run, err := runJob(a, job, trigger)
+		if err != nil {
+			slog.Error("job failed", "job", job.Name, "trigger", trigger, "summary", run.Summary)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		slog.Info("job finished", "job", job.Name, "trigger", trigger, "summary", run.Summary)
+	}
+	return firstErr
+}
+
+// scheduleJobs runs every job at startup and then every interval until ctx is
+// cancelled, so a restart never skips a day.
+func scheduleJobs(ctx context.Context, a *app, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		runJobs(a, jobs, "schedule")
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runJobsCommand implements `run-jobs [JOB ...]`.
+func runJobsCommand(a *app, args []string) error {
+	selected := jobs
+	if len(args) > 0 {
+		selected = nil
+		for _, name := range args {
+			job, ok := findJob(name)
+			if !ok {
+				return fmt.Errorf("unknown job %q", name)
+			}
+			selected = append(selected, job)
+		}
+	}
+	return runJobs(a, selected, "cli")
+}
+
+type jobStatus struct {
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	LastRun     *JobRun `json:"lastRun"`
+}
+
+// listJobs serves GET /owner/jobs with the outcome of each job's latest run,
+// whether it came from the scheduler or from run-jobs.
+func (s *Server) listJobs(c *gin.Context) {
+	statuses := []jobStatus{}
+	for _, job := range jobs {
+		status := jobStatus{Name: job.Name, Description: job.Description}
+		run, err := s.store.JobRuns.Latest(job.Name)
+		if err != nil && !errors.Is(err, errNotFound) {
+			respondError(c, err)
+			return
+		}
+		status.LastRun = run
+		statuses = append(statuses, status)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"intervalHours": s.config.Jobs.IntervalHours, "jobs": statuses})
+}
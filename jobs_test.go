@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMarkOverdueJob(t *testing.T) {
+	store, _ := newTestStore(t)
+	library, admin, book := seedLibrary(t, store, 3)
+	reader := &User{Name: "Ada", Email: "ada@example.org", Role: "reader", LibID: library.ID}
+	if err := store.Users.Create(reader); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC()
+	loan := func(status string, due time.Time) *IssueRegistery {
+		t.Helper()
+		issue := &IssueRegistery{ISBN: book.ISBN, ReaderID: reader.ID, IssueApproverID: admin.ID, IssueStatus: status, IssueDate: due.AddDate(0, 0, -14), ExpectedReturnDate: due}
+		if err := store.Issues.Create(issue); err != nil {
+			t.Fatal(err)
+		}
+		return issue
+	}
+	late := loan(issueStatusIssued, now.AddDate(0, 0, -2))
+	notDue := loan(issueStatusIssued, now.AddDate(0, 0, 5))
+	returned := loan(issueStatusReturned, now.AddDate(0, 0, -2))
+
+	a := &app{config: defaultConfig(), store: store}
+	summary, err := markOverdueJob(a, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary != "marked 1 loans overdue" {
+		t.Errorf("summary = %q", summary)
+	}
+
+	want := map[int]string{late.IssueID: issueStatusOverdue, notDue.IssueID: issueStatusIssued, returned.IssueID: issueStatusReturned}
+	for id, status := range want {
+		issue, err := store.Issues.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if issue.IssueStatus != status {
+			t.Errorf("loan %d is %s, want %s", id, issue.IssueStatus, status)
+		}
+	}
+
+	entries, err := store.Outbox.After(0, library.ID, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	overdue := 0
+	for _, entry := range entries {
+		if entry.Event == eventIssueOverdue {
+			overdue++
+		}
+	}
+	if overdue != 1 {
+		t.Errorf("recorded %d %s events, want 1", overdue, eventIssueOverdue)
+	}
+
+	// A loan already flagged is not flagged again
+	if summary, err := markOverdueJob(a, now); err != nil || summary != "marked 0 loans overdue" {
+		t.Errorf("second run = %q, %v", summary, err)
+	}
+}
+
+func TestRunJobRecordsOutcome(t *testing.T) {
+	store, _ := newTestStore(t)
+	a := &app{config: defaultConfig(), store: store}
+
+	if _, err := store.JobRuns.Latest("mark-overdue"); !errors.Is(err, errNotFound) {
+		t.Fatalf("Latest before any run: err = %v, want errNotFound", err)
+	}
+
+	job, _ := findJob("mark-overdue")
+	if _, err := runJob(a, job, "cli"); err != nil {
+		t.Fatal(err)
+	}
+	failing := Job{Name: "failing", Run: func(a *app, now time.Time) (string, error) {
+		return "did half", errors.New("disk full")
+	}}
+	if _, err := runJob(a, failing, "schedule"); err == nil {
+		t.Error("failing job reported no error")
+	}
+
+	run, err := store.JobRuns.Latest("mark-overdue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.Status != jobStatusOK || run.TriggeredBy != "cli" || run.Summary != "marked 0 loans overdue" {
+		t.Errorf("mark-overdue run = %+v", run)
+	}
+	run, err = store.JobRuns.Latest("failing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.Status != jobStatusFailed || run.Summary != "did half: disk full" {
+		t.Errorf("failing run = %+v", run)
+	}
+
+	if err := runJobsCommand(a, []string{"no-such-job"}); err == nil {
+		t.Error("run-jobs accepted an unknown job")
+	}
+}
+
+func TestDueRemindersDisabled(t *testing.T) {
+	store, _ := newTestStore(t)
+	a := &app{config: defaultConfig(), store: store}
+	a.config.Circulation.ReminderDaysAhead = 0
+
+	summary, err := dueRemindersJob(a, time.Now().UTC())
+	if err != nil || summary != "disabled by circulation.reminderDaysAhead" {
+		t.Errorf("dueRemindersJob = %q, %v", summary, err)
+	}
+}
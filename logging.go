@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	requestIDHeader    = "X-Request-ID"
+	requestIDKey       = "requestID"
+	maxRequestIDLength = 128
+)
+
+// newLogger returns a JSON logger at the configured level. Config validation
+// guarantees level is one of debug, info, warn and error.
+func newLogger(w io.Writer, level string) *slog.Logger {
+	var l slog.Level
+	l.UnmarshalText([]byte(level))
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: l}))
+}
+
+// validRequestID accepts the IDs proxies and clients commonly send: UUIDs and
+// similar tokens. Anything else is replaced so it cannot forge log lines.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDMiddleware adopts the caller's X-Request-ID or generates one, and
+// echoes it in the response.
+func requestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if !validRequestID(id) {
+			b := make([]byte, 16)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		c.Set(requestIDKey, id)
+		c.Header(requestIDHeader, id)
+		c.Next()
+	}
+}
+
+// requestLog returns the logger for a request, carrying its ID and, once
+// authenticated, the user's ID.
+func requestLog(c *gin.Context) *slog.Logger {
+	logger := slog.Default().With("request_id", c.GetString(requestIDKey))
+	if value, ok := c.Get("user"); ok {
+		logger = logger.With("user_id", value.(User).ID)
+	}
+	return logger
+}
+
+// logRequests writes one line per request once it has been served.
+func logRequests() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		switch {
+		case status >= http.StatusInternalServerError:
+			level = slog.LevelError
+		case status >= http.StatusBadRequest:
+			level = slog.LevelWarn
+		}
+		requestLog(c).Log(c.Request.Context(), level, "request",
+			"method", c.Request.Method,
+			"route", c.FullPath(),
+			"path", c.Request.URL.Path,
+			"status", status,
+			"duration_ms", float64(time.Since(start).Microseconds())/1000,
+			"bytes", c.Writer.Size(),
+			"client_ip", c.ClientIP(),
+		)
+	}
+}
+
+// recoverPanics logs a panicking handler with its stack and answers 500.
+func recoverPanics() gin.HandlerFunc {
+	return gin.CustomRecoveryWithWriter(io.Discard, func(c *gin.Context, recovered interface{}) {
+		requestLog(c).Error("panic serving request", "panic", recovered, "stack", string(debug.Stack()))
+		writeProblem(c, newAPIError(http.StatusInternalServerError, codeInternal, "Internal server error"))
+	})
+}
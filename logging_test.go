@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// captureLogs sends the default logger to a buffer for the rest of the test
+// and returns a function decoding the lines logged so far.
+func captureLogs(t *testing.T) func() []map[string]interface{} {
+	t.Helper()
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(newLogger(&buf, "debug"))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	return func() []map[string]interface{} {
+		var lines []map[string]interface{}
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			if line == "" {
+				continue
+			}
+			var entry map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("log line %q is not JSON: %v", line, err)
+			}
+			lines = append(lines, entry)
+		}
+		buf.Reset()
+		return lines
+	}
+}
+
+func TestRequestLogging(t *testing.T) {
+	logs := captureLogs(t)
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(requestIDMiddleware(), logRequests(), recoverPanics())
+	router.GET("/books/:isbn", func(c *gin.Context) {
+		c.Set("user", User{ID: 7})
+		c.Status(http.StatusOK)
+	})
+	router.GET("/panic", func(c *gin.Context) { panic("boom") })
+
+	serve := func(path, requestID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if requestID != "" {
+			req.Header.Set(requestIDHeader, requestID)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve("/books/9780306406157", "abc-123")
+	if got := w.Header().Get(requestIDHeader); got != "abc-123" {
+		t.Errorf("echoed request ID %q, want the caller's", got)
+	}
+	lines := logs()
+	if len(lines) != 1 {
+		t.Fatalf("logged %d lines, want 1", len(lines))
+	}
+	line := lines[0]
+	if line["request_id"] != "abc-123" || line["user_id"] != float64(7) || line["route"] != "/books/:isbn" || line["status"] != float64(200) || line["level"] != "INFO" {
+		t.Errorf("request line = %v", line)
+	}
+
+	// IDs that could forge log lines are replaced
+	w = serve("/books/9780306406157", "evil\"id")
+	generated := w.Header().Get(requestIDHeader)
+	if len(generated) != 32 || strings.Contains(generated, "evil") {
+		t.Errorf("request ID %q was not replaced", generated)
+	}
+	if lines := logs(); len(lines) != 1 || lines[0]["request_id"] != generated {
+		t.Errorf("logged %v, want the generated request ID %s", lines, generated)
+	}
+
+	w = serve("/panic", "panic-1")
+	if w.Code != http.StatusInternalServerError || !strings.Contains(w.Header().Get("Content-Type"), "problem+json") {
+		t.Errorf("panic answered %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	lines = logs()
+	if len(lines) != 2 {
+		t.Fatalf("logged %v, want the panic and the request", lines)
+	}
+	for _, line := range lines {
+		if line["request_id"] != "panic-1" || line["level"] != "ERROR" {
+			t.Errorf("panic line = %v", line)
+		}
+	}
+	if lines[0]["panic"] != "boom" || !strings.Contains(lines[0]["stack"].(string), "runtime/debug.Stack") {
+		t.Errorf("panic line has no panic value or stack: %v", lines[0])
+	}
+}
+
+func TestNewLoggerLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger := newLogger(&buf, "warn")
+	logger.Info("hidden")
+	logger.Warn("shown")
+	if strings.Contains(buf.String(), "hidden") || !strings.Contains(buf.String(), "shown") {
+		t.Errorf("warn logger wrote %q", buf.String())
+	}
+}
@@ -2,15 +2,20 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // type User struct {
@@ -30,35 +35,49 @@ type User struct {
 	Role     string `json:"role"`
 	LibID    int    `json:"lib_id"`
 	Password string `json:"-"`
+	// MustChangePassword blocks every route except the password change
+	// endpoint until the user has replaced a generated password.
+	MustChangePassword bool       `json:"mustChangePassword"`
+	DeletedAt          *time.Time `json:"deletedAt,omitempty"`
 }
 
 const defaultOwnerEmail = "default_owner@example.com"
 const defaultOwnerRole = "owner"
 
 type Library struct {
-	ID   int    `json:"id"`
-	Name string `json:"name"`
+	ID        int        `json:"id"`
+	Name      string     `json:"name"`
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
 }
 
 type BookInventory struct {
-	ISBN            string `json:"isbn"`
-	LibID           int    `json:"libID"`
-	Title           string `json:"title"`
-	Authors         string `json:"authors"`
-	Publisher       string `json:"publisher"`
-	Version         string `json:"version"`
-	TotalCopies     int    `json:"totalCopies"`
-	AvailableCopies int    `json:"availableCopies"`
+	ISBN            string     `json:"isbn"`
+	LibID           int        `json:"libID"`
+	Title           string     `json:"title"`
+	Authors         string     `json:"authors"`
+	Publisher       string     `json:"publisher"`
+	Version         string     `json:"version"`
+	TotalCopies     int        `json:"totalCopies"`
+	AvailableCopies int        `json:"availableCopies"`
+	SeriesName      string     `json:"seriesName"`
+	SeriesNumber    int        `json:"seriesNumber"`
+	Language        string     `json:"language"`
+	PublicationYear int        `json:"publicationYear"`
+	AuthorList      []Author   `json:"authorList,omitempty"`
+	Subjects        []string   `json:"subjects,omitempty"`
+	DeletedAt       *time.Time `json:"deletedAt,omitempty"`
 }
 
 type RequestEvent struct {
 	ReqID        int       `json:"req_id"`
-	BookID       int       `json:"book_id"`
+	BookID       string    `json:"book_id"`
 	ReaderID     int       `json:"reader_id"`
 	RequestDate  time.Time `json:"request_date"`
 	ApprovalDate time.Time `json:"approval_date"`
 	ApproverID   int       `json:"approver_id"`
 	RequestType  string    `json:"request_type"`
+	// Decision is empty while the request is pending, then approved or rejected.
+	Decision string `json:"decision"`
 }
 
 type IssueRegistery struct {
@@ -76,173 +95,296 @@ type IssueRegistery struct {
 var db *sql.DB
 var err error
 
-func initDatabase() {
-	db, err := sql.Open("sqlite3", "library.db")
+// Server holds the dependencies shared by the HTTP handlers.
+type Server struct {
+	config   *Config
+	store    *Store
+	metadata MetadataProvider
+	covers   BlobStore
+	backups  *BackupManager
+	notifier Notifier
+	events   *EventHub
+	metrics  *prometheus.Registry
+}
+
+func NewServer(config *Config, store *Store, metadata MetadataProvider, covers BlobStore, backups *BackupManager, notifier Notifier, events *EventHub) *Server {
+	return &Server{config: config, store: store, metadata: metadata, covers: covers, backups: backups, notifier: notifier, events: events,
+		metrics: newMetricsRegistry(store)}
+}
+
+func main() {
+	config, args, err := loadConfig(os.Args[1:])
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer db.Close()
+	slog.SetDefault(newLogger(os.Stderr, config.LogLevel))
 
-	// Check if a default owner user exists
-	var defaultUser User
-	defaultUser.Email = defaultOwnerEmail
-	defaultUser.Role = defaultOwnerRole
-	defaultUser.LibID = 1
-	err = db.QueryRow("SELECT ID, Name, Contact FROM Users WHERE Email = ? AND Role = ? AND LibID = ?", defaultUser.Email, defaultUser.Role, defaultUser.LibID).Scan(&defaultUser.ID, &defaultUser.Name, &defaultUser.Contact)
+	if len(args) > 0 && args[0] == "help" {
+		printUsage()
+		return
+	}
+	cmd, cmdArgs, err := lookupCommand(args)
 	if err != nil {
-		fmt.Println("Error querying Users table:", err)
-		// If not, create a default owner user
-		defaultUser.Name = "Root"
-		defaultUser.Contact = "1234567890"
-		defaultUser.Password = "password"
-		_, err = db.Exec("INSERT INTO Users (Name, Email, ContactNumber, Password, Role, LibID) VALUES (?, ?, ?, ?, ?, ?)", defaultUser.Name, defaultUser.Email, defaultUser.Contact, defaultUser.Password, defaultUser.Role, defaultUser.LibID)
-		if err != nil {
-			fmt.Println("Error inserting default owner user:", err)
-			return
-		}
+		fmt.Fprintln(os.Stderr, err)
+		printUsage()
+		os.Exit(2)
 	}
-}
 
-func main() {
-	db, err = sql.Open("sqlite3", "./library.db")
+	conn, err := openDatabase(config.Database)
 	if err != nil {
-		fmt.Println(err)
+		slog.Error("opening database", "err", err)
+		os.Exit(1)
 	}
+	db = conn.DB
 	defer db.Close()
 
 	// Ensure the tables exist
-	createLibraryTable()
-	createUsersTable()
-	createBookInventoryTable()
-	createRequestEventsTable()
-	createIssueRegisteryTable()
+	if err := migrate(conn); err != nil {
+		slog.Error("migrating database", "err", err)
+		os.Exit(1)
+	}
 
+	store := NewSQLStore(conn)
+	notifier, err := newNotifier(config.Mail, store.Notifications)
+	if err != nil {
+		slog.Error("loading mail templates", "err", err)
+		os.Exit(1)
+	}
+
+	if err := cmd.run(&app{config: config, conn: conn, store: store, notifier: notifier}, cmdArgs); err != nil {
+		slog.Error("command failed", "err", err)
+		os.Exit(1)
+	}
+}
+
+func (s *Server) Router() *gin.Engine {
 	// user routes
-	router := gin.Default()
-	owner := router.Group("/owner", AuthMiddleware("owner"))
+	router := gin.New()
+	router.Use(requestIDMiddleware(), logRequests(), recoverPanics(), metricsMiddleware())
+	router.NoRoute(func(c *gin.Context) {
+		respondError(c, notFoundError("No such endpoint"))
+	})
+	router.GET("/metrics", gin.WrapH(promhttp.HandlerFor(s.metrics, promhttp.HandlerOpts{})))
+
+	owner := router.Group("/owner", s.AuthMiddleware("owner"))
+	{
+		owner.POST("/library", s.createLibrary)
+		owner.POST("/users", s.createUser)
+		owner.GET("/library/:id/export", s.exportLibraryCatalog)
+		owner.GET("/library/:id/stats", s.circulationStats)
+		owner.GET("/backups", s.listBackups)
+		owner.POST("/backups", s.createBackup)
+		owner.GET("/audit", s.listAudit)
+		owner.GET("/deleted", s.listDeleted)
+		owner.GET("/jobs", s.listJobs)
+		owner.POST("/webhooks", s.createWebhook)
+		owner.GET("/webhooks", s.listWebhooks)
+		owner.DELETE("/webhooks/:id", s.deleteWebhook)
+		owner.GET("/webhooks/:id/deliveries", s.listWebhookDeliveries)
+		owner.POST("/users/:id/restore", s.restoreUser)
+		owner.POST("/library/:id/restore", s.restoreLibrary)
+	}
+
+	admin := router.Group("/admin", s.AuthMiddleware("admin"))
 	{
-		owner.POST("/library", createLibrary)
-		owner.POST("/users", createUser)
+		admin.POST("/books", s.createBook)
+		admin.PUT("/books/:isbn", s.updateBook)
+		admin.DELETE("/books/:isbn", s.deleteBook)
+		admin.POST("/books/:isbn/restore", s.restoreBook)
+		admin.GET("/metadata/:isbn", s.lookupMetadata)
+		admin.POST("/books/:isbn/cover", s.uploadCover)
+		admin.DELETE("/books/:isbn/cover", s.deleteCover)
+		admin.GET("/export", s.exportLibraryCatalog)
+		admin.GET("/stats", s.circulationStats)
+		admin.GET("/requests", s.listIssues)
+		admin.GET("/requests/stream", s.streamRequests)
+		admin.POST("/requests/:reqID", s.approveIssueRequest)
+		admin.POST("/requests/:reqID/reject", s.rejectIssueRequest)
+		admin.GET("/readers/:readerID", s.getReaderInfo)
 	}
 
-	admin := router.Group("/admin", AuthMiddleware("admin"))
+	reader := router.Group("/reader", s.AuthMiddleware("reader"))
 	{
-		admin.POST("/books", createBook)
-		admin.PUT("/books/:isbn", updateBook)
-		admin.DELETE("/books/:isbn", deleteBook)
-		admin.GET("/requests", listIssues)
-		admin.POST("/requests/:reqID", approveIssueRequest)
-		admin.GET("/readers/:readerID", getReaderInfo)
+		reader.POST("/requests", s.createRequestEvent)
+		reader.GET("/books", s.listAvailableBooks)
 	}
 
-	reader := router.Group("/reader", AuthMiddleware("reader"))
+	account := router.Group("/account", s.AuthMiddleware(""))
 	{
-		reader.POST("/requests", createRequestEvent)
-		reader.GET("/books", listAvailableBooks)
+		account.POST("/password", s.changePassword)
+		account.GET("/notifications", s.listNotifications)
+		account.POST("/notifications/read", s.markAllNotificationsRead)
+		account.POST("/notifications/:id/read", s.markNotificationRead)
+		account.GET("/notifications/preferences", s.getNotificationPreferences)
+		account.PUT("/notifications/preferences", s.updateNotificationPreferences)
 	}
 
+	// Routes below predate the role groups. Reads stay public; changes need
+	// the same role as their counterpart in the groups above, so that every
+	// audit entry names its actor.
 	// router.GET("/users/:id", getUser)
-	router.PUT("/users/:id", updateUser)
-	router.DELETE("/users/:id", deleteUser)
-	router.GET("/users", listUsers)
+	router.PUT("/users/:id", s.AuthMiddleware("owner"), s.updateUser)
+	router.DELETE("/users/:id", s.AuthMiddleware("owner"), s.deleteUser)
+	router.GET("/users", s.listUsers)
 	// bookInv Routes
 	router.POST("/books")
-	router.GET("/books/:isbn", getBook)
-	router.PUT("/books/:isbn", updateBook)
-	router.DELETE("/books/:isbn", deleteBook)
-	router.GET("/books", listBooks)
+	router.GET("/books/:isbn", s.getBook)
+	router.GET("/books/:isbn/cover", s.getCover)
+	router.PUT("/books/:isbn", s.AuthMiddleware("admin"), s.updateBook)
+	router.DELETE("/books/:isbn", s.AuthMiddleware("admin"), s.deleteBook)
+	router.GET("/books", s.listBooks)
+	router.GET("/authors", s.listAuthors)
+	router.GET("/subjects", s.listSubjects)
 	// Library routes
 
-	router.GET("/library/:id", getLibrary)
-	router.PUT("/library/:id", updateLibrary)
-	router.DELETE("/library/:id", deleteLibrary)
-	router.GET("/library", listLibraries)
+	router.GET("/library/:id", s.getLibrary)
+	router.PUT("/library/:id", s.AuthMiddleware("owner"), s.updateLibrary)
+	router.DELETE("/library/:id", s.AuthMiddleware("owner"), s.deleteLibrary)
+	router.GET("/library", s.listLibraries)
 	// RequestEvenets Routes
-	router.POST("/requestevents", createRequestEvent)
-	router.GET("/requestevents/:id", getRequestEvent)
-	router.PUT("/requestevents/:id", updateRequestEvent)
-	router.DELETE("/requestevents/:id", deleteRequestEvent)
-	router.GET("/requestevents", listRequestEvents)
+	router.POST("/requestevents", s.AuthMiddleware(""), s.createRequestEvent)
+	router.GET("/requestevents/:id", s.getRequestEvent)
+	router.PUT("/requestevents/:id", s.AuthMiddleware("admin"), s.updateRequestEvent)
+	router.DELETE("/requestevents/:id", s.AuthMiddleware("admin"), s.deleteRequestEvent)
+	router.GET("/requestevents", s.listRequestEvents)
 
 	// IssueReg Routes
-	router.POST("/issues", createIssue)
-	router.GET("/issues/:issueID", getIssue)
-	router.PUT("/issues/:issueID", updateIssue)
-	router.DELETE("/issues/:issueID", deleteIssue)
-	router.GET("/issues", listIssues)
-	router.Run(":8081")
+	router.POST("/issues", s.AuthMiddleware("admin"), s.createIssue)
+	router.GET("/issues/:issueID", s.getIssue)
+	router.PUT("/issues/:issueID", s.AuthMiddleware("admin"), s.updateIssue)
+	router.DELETE("/issues/:issueID", s.AuthMiddleware("admin"), s.deleteIssue)
+	router.GET("/issues", s.listIssues)
+	return router
 }
 
-func createUsersTable() {
-	createUsersTableSQL := `CREATE TABLE IF NOT EXISTS users (
+const usersSchema = `(
         "ID" INTEGER PRIMARY KEY AUTOINCREMENT,
         "Name" TEXT,
         "Email" TEXT,
         "Contact" TEXT,
         "Role" TEXT,
         "LibID" INTEGER NOT NULL,
-        FOREIGN KEY ("LibID") REFERENCES library("ID")
+        "Password" TEXT,
+        "MustChangePassword" INTEGER NOT NULL DEFAULT 0,
+        "DeletedAt" DATETIME,
+        FOREIGN KEY ("LibID") REFERENCES library("ID") ON DELETE RESTRICT
     );`
 
-	_, err := db.Exec(createUsersTableSQL)
-	if err != nil {
-		fmt.Println(err)
+func createUsersTable() error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS users ` + usersSchema); err != nil {
+		return err
+	}
+
+	// AuthMiddleware reads Password, which early databases did not have
+	if err := addColumnIfMissing("users", "Password", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("users", "MustChangePassword", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("users", "DeletedAt", "DATETIME"); err != nil {
+		return err
 	}
+
+	return rebuildTableIfOutdated("users", usersSchema, "ON DELETE")
 }
 
-func createRequestEventsTable() {
-	createRequestEventsTableSQL := `CREATE TABLE IF NOT EXISTS RequestEvents (
+// BookID holds the ISBN of the requested book; early releases declared it
+// INTEGER.
+const requestEventsSchema = `(
         "ReqID" INTEGER PRIMARY KEY AUTOINCREMENT,
-        "BookID" INTEGER,
+        "BookID" TEXT,
         "ReaderID" INTEGER,
         "RequestDate" DATETIME,
         "ApprovalDate" DATETIME,
         "ApproverID" INTEGER,
         "RequestType" TEXT,
-        FOREIGN KEY ("BookID") REFERENCES book_inventory("ISBN"),
-        FOREIGN KEY ("ReaderID") REFERENCES users("ID"),
-        FOREIGN KEY ("ApproverID") REFERENCES users("ID")
+        "Decision" TEXT,
+        FOREIGN KEY ("BookID") REFERENCES book_inventory("ISBN") ON DELETE RESTRICT,
+        FOREIGN KEY ("ReaderID") REFERENCES users("ID") ON DELETE RESTRICT,
+        FOREIGN KEY ("ApproverID") REFERENCES users("ID") ON DELETE RESTRICT
     );`
 
-	_, err := db.Exec(createRequestEventsTableSQL)
-	if err != nil {
-		fmt.Println(err)
+// backfillDecisionSQL marks requests approved before Decision existed. A
+// request is pending exactly while Decision is NULL.
+const backfillDecisionSQL = `UPDATE RequestEvents SET Decision = ? WHERE Decision IS NULL AND ApproverID IS NOT NULL AND ApproverID <> 0`
+
+func createRequestEventsTable() error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS RequestEvents ` + requestEventsSchema); err != nil {
+		return err
 	}
+
+	if err := addColumnIfMissing("RequestEvents", "Decision", "TEXT"); err != nil {
+		return err
+	}
+	if _, err := db.Exec(backfillDecisionSQL, requestDecisionApproved); err != nil {
+		return err
+	}
+	return rebuildTableIfOutdated("RequestEvents", requestEventsSchema, `"BookID" TEXT`, "ON DELETE")
 }
 
-func createBookInventoryTable() {
-	createBookInventoryTableSQL := `CREATE TABLE IF NOT EXISTS book_inventory (
+// bookInventorySchema is shared by table creation and the rebuild that adds the
+// CHECK constraints and ON DELETE rules to older tables.
+const bookInventorySchema = `(
         "ISBN" TEXT PRIMARY KEY,
         "LibID" INTEGER NOT NULL,
-        "Title" TEXT,
+        "Title" TEXT NOT NULL CHECK (length(trim("Title")) > 0),
         "Authors" TEXT,
         "Publisher" TEXT,
         "Version" TEXT,
-        "TotalCopies" INTEGER,
-        "AvailableCopies" INTEGER,
-        FOREIGN KEY ("LibID") REFERENCES library("ID")
+        "TotalCopies" INTEGER NOT NULL DEFAULT 0 CHECK ("TotalCopies" >= 0),
+        "AvailableCopies" INTEGER NOT NULL DEFAULT 0 CHECK ("AvailableCopies" >= 0),
+        "SeriesName" TEXT,
+        "SeriesNumber" INTEGER,
+        "Language" TEXT,
+        "PublicationYear" INTEGER,
+        "DeletedAt" DATETIME,
+        CHECK ("AvailableCopies" <= "TotalCopies"),
+        FOREIGN KEY ("LibID") REFERENCES library("ID") ON DELETE RESTRICT
     );`
 
-	_, err := db.Exec(createBookInventoryTableSQL)
-	if err != nil {
-		fmt.Println(err)
+func createBookInventoryTable() error {
+	createBookInventoryTableSQL := `CREATE TABLE IF NOT EXISTS book_inventory ` + bookInventorySchema
+
+	if _, err := db.Exec(createBookInventoryTableSQL); err != nil {
+		return err
+	}
+
+	// Older databases were created before the catalog metadata columns existed
+	if err := addColumnIfMissing("book_inventory", "SeriesName", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("book_inventory", "SeriesNumber", "INTEGER"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("book_inventory", "Language", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("book_inventory", "PublicationYear", "INTEGER"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("book_inventory", "DeletedAt", "DATETIME"); err != nil {
+		return err
 	}
+
+	return rebuildTableIfOutdated("book_inventory", bookInventorySchema, "CHECK", "ON DELETE")
 }
 
-func createLibraryTable() {
+func createLibraryTable() error {
 	createLibraryTableSQL := `CREATE TABLE IF NOT EXISTS library (
         "ID" INTEGER PRIMARY KEY AUTOINCREMENT,
-        "Name" TEXT
+        "Name" TEXT,
+        "DeletedAt" DATETIME
     );`
 
-	_, err := db.Exec(createLibraryTableSQL)
-	if err != nil {
-		fmt.Println(err)
+	if _, err := db.Exec(createLibraryTableSQL); err != nil {
+		return err
 	}
+
+	return addColumnIfMissing("library", "DeletedAt", "DATETIME")
 }
 
-func createIssueRegisteryTable() {
-	createIssueRegisteryTableSQL := `CREATE TABLE IF NOT EXISTS IssueRegistery (
+const issueRegisterySchema = `(
         "IssueID" INTEGER PRIMARY KEY AUTOINCREMENT,
         "ISBN" TEXT,
         "ReaderID" INTEGER,
@@ -252,324 +394,464 @@ func createIssueRegisteryTable() {
         "ExpectedReturnDate" DATETIME,
         "ReturnDate" DATETIME,
         "ReturnApproverID" INTEGER,
-        FOREIGN KEY ("ISBN") REFERENCES book_inventory("ISBN"),
-        FOREIGN KEY ("ReaderID") REFERENCES users("ID"),
-        FOREIGN KEY ("IssueApproverID") REFERENCES users("ID"),
-        FOREIGN KEY ("ReturnApproverID") REFERENCES users("ID")
+        FOREIGN KEY ("ISBN") REFERENCES book_inventory("ISBN") ON DELETE RESTRICT,
+        FOREIGN KEY ("ReaderID") REFERENCES users("ID") ON DELETE RESTRICT,
+        FOREIGN KEY ("IssueApproverID") REFERENCES users("ID") ON DELETE RESTRICT,
+        FOREIGN KEY ("ReturnApproverID") REFERENCES users("ID") ON DELETE RESTRICT
     );`
 
-	_, err := db.Exec(createIssueRegisteryTableSQL)
+func createIssueRegisteryTable() error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS IssueRegistery ` + issueRegisterySchema); err != nil {
+		return err
+	}
+
+	return rebuildTableIfOutdated("IssueRegistery", issueRegisterySchema, "ON DELETE")
+}
+
+// paramID parses an integer path parameter, answering 400 when it is malformed.
+func paramID(c *gin.Context, name string) (int, bool) {
+	id, err := strconv.Atoi(c.Param(name))
 	if err != nil {
-		fmt.Println(err)
+		respondError(c, badRequest("Invalid "+name))
+		return 0, false
 	}
+	return id, true
 }
 
-func createUser(c *gin.Context) {
+func (s *Server) createUser(c *gin.Context) {
 	var newUser User
 
-	if err := c.BindJSON(&newUser); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if err := c.ShouldBindJSON(&newUser); err != nil {
+		respondError(c, badRequest(err.Error()))
 		return
 	}
 
-	statement, _ := db.Prepare("INSERT INTO users (Name, Email, Contact, Role, LibID) VALUES (?,?,?,?,?)")
-	result, err := statement.Exec(newUser.Name, newUser.Email, newUser.Contact, newUser.Role, newUser.LibID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
+	if err := s.store.Atomic(func(tx *Store) error {
+		if err := tx.Users.Create(&newUser); err != nil {
+			return err
+		}
+		return auditTx(c, tx, "create", "user", strconv.Itoa(newUser.ID), nil, newUser)
+	}); err != nil {
+		if errors.Is(err, errInvalidReference) {
+			respondError(c, invalidReference("lib_id does not name an existing library"))
+			return
+		}
 
-	id, err := result.LastInsertId()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondError(c, err)
 		return
 	}
 
-	newUser.ID = int(id)
 	c.JSON(http.StatusCreated, newUser)
 }
 
-func getUser(c *gin.Context) {
-	id := c.Param("id")
-	var user User
+func (s *Server) getUser(c *gin.Context) {
+	id, ok := paramID(c, "id")
+	if !ok {
+		return
+	}
 
-	row := db.QueryRow("SELECT * FROM users WHERE ID =?", id)
-	err := row.Scan(&user.ID, &user.Name, &user.Email, &user.Contact, &user.Role, &user.LibID)
+	user, err := s.store.Users.Get(id)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		if errors.Is(err, errNotFound) {
+			respondError(c, notFoundError("User not found"))
 			return
 		}
 
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondError(c, err)
 		return
 	}
 
 	c.JSON(http.StatusOK, user)
 }
 
-// AuthMiddleware is a middleware for authentication
-func AuthMiddleware(role string) gin.HandlerFunc {
+// AuthMiddleware is a middleware for authentication. An empty role admits any
+// authenticated user.
+func (s *Server) AuthMiddleware(role string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		email, password, ok := c.Request.BasicAuth()
 		if !ok {
-			c.AbortWithStatus(http.StatusUnauthorized)
+			respondError(c, newAPIError(http.StatusUnauthorized, codeUnauthorized, "Authentication required"))
 			return
 		}
 
-		db, err := sql.Open("sqlite3", "library.db")
+		user, err := s.store.Users.GetByEmail(email)
 		if err != nil {
-			c.AbortWithError(http.StatusInternalServerError, err)
+			if errors.Is(err, errNotFound) {
+				respondError(c, newAPIError(http.StatusUnauthorized, codeUnauthorized, "Authentication required"))
+				return
+			}
+
+			respondError(c, err)
 			return
 		}
-		defer db.Close()
 
-		var user User
-		err = db.QueryRow("SELECT ID, Name, Email, Contact, Role, LibID, Password FROM Users WHERE Email =?", email).Scan(&user.ID, &user.Name, &user.Email, &user.Contact, &user.Role, &user.LibID, &user.Password)
-		if err != nil {
-			c.AbortWithStatus(http.StatusUnauthorized)
+		if !checkPassword(user.Password, password) {
+			respondError(c, newAPIError(http.StatusUnauthorized, codeUnauthorized, "Authentication required"))
 			return
 		}
 
-		if user.Password != password {
-			c.AbortWithStatus(http.StatusUnauthorized)
+		// Upgrade passwords stored before hashing was introduced. A
+		// well-known one is not checked again once hashed, so it has to go.
+		if !isPasswordHash(user.Password) {
+			if isKnownDefaultPassword(password) {
+				user.MustChangePassword = true
+			}
+			if hash, err := hashPassword(password); err == nil {
+				s.store.Users.SetPassword(user.ID, hash, user.MustChangePassword)
+			}
+		}
+
+		if role != "" && !strings.EqualFold(user.Role, role) {
+			respondError(c, newAPIError(http.StatusForbidden, codeForbidden, "Your role may not use this endpoint"))
 			return
 		}
 
-		if !strings.EqualFold(user.Role, role) {
-			c.AbortWithStatus(http.StatusForbidden)
+		if user.MustChangePassword && c.FullPath() != "/account/password" {
+			respondError(c, newAPIError(http.StatusForbidden, codePasswordChangeRequired, "Password change required").
+				with("changePassword", "/account/password"))
 			return
 		}
 
-		c.Set("user", user)
+		c.Set("user", *user)
 		c.Next()
 	}
 }
 
-func updateUser(c *gin.Context) {
-	id := c.Param("id")
+func (s *Server) updateUser(c *gin.Context) {
+	id, ok := paramID(c, "id")
+	if !ok {
+		return
+	}
 	var user User
 
-	if err := c.BindJSON(&user); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if err := c.ShouldBindJSON(&user); err != nil {
+		respondError(c, badRequest(err.Error()))
 		return
 	}
 
-	_, err := db.Exec("UPDATE users SET Name =?, Email =?, Contact =?, Role =?, LibID =? WHERE ID =?", user.Name, user.Email, user.Contact, user.Role, user.LibID, id)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	user.ID = id
+	before, _ := s.store.Users.Get(id)
+	if err := s.store.Atomic(func(tx *Store) error {
+		if err := tx.Users.Update(&user); err != nil {
+			return err
+		}
+		return auditTx(c, tx, "update", "user", strconv.Itoa(id), before, user)
+	}); err != nil {
+		if errors.Is(err, errNotFound) {
+			respondError(c, notFoundError("User not found"))
+			return
+		}
+
+		if errors.Is(err, errInvalidReference) {
+			respondError(c, invalidReference("lib_id does not name an existing library"))
+			return
+		}
+
+		respondError(c, err)
 		return
 	}
 
-	user.ID, _ = strconv.Atoi(id)
 	c.JSON(http.StatusOK, user)
 }
 
-func deleteUser(c *gin.Context) {
-	id := c.Param("id")
+func (s *Server) deleteUser(c *gin.Context) {
+	id, ok := paramID(c, "id")
+	if !ok {
+		return
+	}
 
-	_, err := db.Exec("DELETE FROM users WHERE ID =?", id)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if s.blockedByOpenLoans(c, LoanFilter{ReaderID: id}, "User") {
+		return
+	}
+
+	before, _ := s.store.Users.Get(id)
+	if err := s.store.Atomic(func(tx *Store) error {
+		if err := tx.Users.Delete(id); err != nil {
+			return err
+		}
+		return auditTx(c, tx, "delete", "user", strconv.Itoa(id), before, nil)
+	}); err != nil {
+		if errors.Is(err, errNotFound) {
+			respondError(c, notFoundError("User not found"))
+			return
+		}
+
+		respondError(c, err)
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "User deleted"})
 }
 
-func listUsers(c *gin.Context) {
-	var users []User
-
-	rows, err := db.Query("SELECT * FROM users")
+func (s *Server) listUsers(c *gin.Context) {
+	users, err := s.store.Users.List()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondError(c, err)
 		return
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var user User
-		if err := rows.Scan(&user.ID, &user.Name, &user.Email, &user.Contact, &user.Role, &user.LibID); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-		users = append(users, user)
-	}
 
 	c.JSON(http.StatusOK, users)
 }
 
 // BookInventory Creation
-func createBook(c *gin.Context) {
+// createBook adds a book to the signed-in admin's library, whatever libID
+// the body names.
+func (s *Server) createBook(c *gin.Context) {
+	admin := c.MustGet("user").(User)
 	var newBook BookInventory
 
-	if err := c.BindJSON(&newBook); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if err := c.ShouldBindJSON(&newBook); err != nil {
+		respondError(c, badRequest(err.Error()))
+		return
+	}
+	newBook.LibID = admin.LibID
+
+	if err := enrichBook(s.metadata, &newBook); err != nil {
+		requestLog(c).Warn("looking up book metadata", "isbn", newBook.ISBN, "err", err)
+	}
+
+	if err := validateBook(&newBook, true, s.store.Libraries); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if err := s.store.Atomic(func(tx *Store) error {
+		if err := tx.Books.Create(&newBook); err != nil {
+			return err
+		}
+		return auditTx(c, tx, "create", "book", newBook.ISBN, nil, newBook)
+	}); err != nil {
+		if errors.Is(err, errDeleted) {
+			respondError(c, newAPIError(http.StatusConflict, codeDeleted, "Book was deleted; restore it instead").
+				with("restore", "/admin/books/"+newBook.ISBN+"/restore"))
+			return
+		}
+
+		respondError(c, err)
 		return
 	}
 
-	statement, _ := db.Prepare(`
-	INSERT INTO book_inventory (ISBN, LibID, Title, Authors, Publisher, Version, TotalCopies, AvailableCopies)
-	VALUES (?,?,?,?,?,?,?,?)
-`)
-	_, _ = statement.Exec(newBook.ISBN, newBook.LibID, newBook.Title, newBook.Authors, newBook.Publisher, newBook.Version, newBook.TotalCopies, newBook.AvailableCopies)
 	c.JSON(http.StatusCreated, newBook)
 }
 
-func getBook(c *gin.Context) {
-	isbn := c.Param("isbn")
-	var book BookInventory
-
-	row := db.QueryRow("SELECT * FROM book_inventory WHERE ISBN =?", isbn)
-	err := row.Scan(&book.ISBN, &book.LibID, &book.Title, &book.Authors, &book.Publisher, &book.Version, &book.TotalCopies, &book.AvailableCopies)
+func (s *Server) getBook(c *gin.Context) {
+	book, err := s.store.Books.Get(c.Param("isbn"))
 	if err != nil {
-		if err == sql.ErrNoRows {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Book not found"})
+		if errors.Is(err, errNotFound) {
+			respondError(c, notFoundError("Book not found"))
 			return
 		}
 
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondError(c, err)
 		return
 	}
 
 	c.JSON(http.StatusOK, book)
 }
 
-func updateBook(c *gin.Context) {
+func (s *Server) updateBook(c *gin.Context) {
+	admin := c.MustGet("user").(User)
 	isbn := c.Param("isbn")
 	var book BookInventory
 
-	if err := c.BindJSON(&book); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if err := c.ShouldBindJSON(&book); err != nil {
+		respondError(c, badRequest(err.Error()))
 		return
 	}
 
-	_, err := db.Exec("UPDATE book_inventory SET LibID =?, Title =?, Authors =?, Publisher =?, Version =?, TotalCopies =?, AvailableCopies =? WHERE ISBN =?", book.LibID, book.Title, book.Authors, book.Publisher, book.Version, book.TotalCopies, book.AvailableCopies, isbn)
+	before, err := s.libraryBook(isbn, admin.LibID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondBookError(c, err)
+		return
+	}
+
+	book.ISBN = isbn
+	book.LibID = admin.LibID
+	if err := validateBook(&book, false, s.store.Libraries); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if err := s.store.Atomic(func(tx *Store) error {
+		if err := tx.Books.Update(&book); err != nil {
+			return err
+		}
+		return auditTx(c, tx, "update", "book", isbn, before, book)
+	}); err != nil {
+		respondBookError(c, err)
 		return
 	}
 
 	c.JSON(http.StatusOK, book)
 }
 
-func deleteBook(c *gin.Context) {
+func (s *Server) deleteBook(c *gin.Context) {
+	admin := c.MustGet("user").(User)
 	isbn := c.Param("isbn")
-
-	_, err := db.Exec("DELETE FROM book_inventory WHERE ISBN =?", isbn)
+	before, err := s.libraryBook(isbn, admin.LibID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondBookError(c, err)
+		return
+	}
+	if s.blockedByOpenLoans(c, LoanFilter{ISBN: isbn}, "Book") {
+		return
+	}
+
+	if err := s.store.Atomic(func(tx *Store) error {
+		if err := tx.Books.Delete(isbn); err != nil {
+			return err
+		}
+		return auditTx(c, tx, "delete", "book", isbn, before, nil)
+	}); err != nil {
+		respondBookError(c, err)
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "Book deleted"})
 }
 
-func listBooks(c *gin.Context) {
-	var books []BookInventory
-
-	rows, err := db.Query("SELECT * FROM book_inventory")
+// libraryBook returns book isbn if it belongs to library libID. Books of
+// other libraries are reported as errNotFound, as for approvals.
+func (s *Server) libraryBook(isbn string, libID int) (*BookInventory, error) {
+	book, err := s.store.Books.Get(isbn)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, err
+	}
+	if book.LibID != libID {
+		return nil, errNotFound
+	}
+	return book, nil
+}
+
+func respondBookError(c *gin.Context, err error) {
+	if errors.Is(err, errNotFound) {
+		respondError(c, notFoundError("Book not found"))
 		return
 	}
-	defer rows.Close()
+	respondError(c, err)
+}
 
-	for rows.Next() {
-		var book BookInventory
-		if err := rows.Scan(&book.ISBN, &book.LibID, &book.Title, &book.Authors, &book.Publisher, &book.Version, &book.TotalCopies, &book.AvailableCopies); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-		books = append(books, book)
+func (s *Server) listBooks(c *gin.Context) {
+	books, err := s.store.Books.List(bookFilterFromQuery(c))
+	if err != nil {
+		respondError(c, err)
+		return
 	}
 
 	c.JSON(http.StatusOK, books)
 }
 
 // Library
-func listLibraries(c *gin.Context) {
-	var libraries []Library
-
-	rows, err := db.Query("SELECT * FROM library")
+func (s *Server) listLibraries(c *gin.Context) {
+	libraries, err := s.store.Libraries.List()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondError(c, err)
 		return
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var library Library
-		if err := rows.Scan(&library.ID, &library.Name); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-		libraries = append(libraries, library)
-	}
 
 	c.JSON(http.StatusOK, libraries)
 }
 
-func createLibrary(c *gin.Context) {
+func (s *Server) createLibrary(c *gin.Context) {
 	var newLibrary Library
 
-	if err := c.BindJSON(&newLibrary); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if err := c.ShouldBindJSON(&newLibrary); err != nil {
+		respondError(c, badRequest(err.Error()))
 		return
 	}
 
-	statement, _ := db.Prepare("INSERT INTO library (Name) VALUES (?)")
-	result, _ := statement.Exec(newLibrary.Name)
-	id, _ := result.LastInsertId()
+	if err := s.store.Atomic(func(tx *Store) error {
+		if err := tx.Libraries.Create(&newLibrary); err != nil {
+			return err
+		}
+		return auditTx(c, tx, "create", "library", strconv.Itoa(newLibrary.ID), nil, newLibrary)
+	}); err != nil {
+		respondError(c, err)
+		return
+	}
 
-	newLibrary.ID = int(id)
 	c.JSON(http.StatusCreated, newLibrary)
 }
 
-func getLibrary(c *gin.Context) {
-	id := c.Param("id")
-	var library Library
+func (s *Server) getLibrary(c *gin.Context) {
+	id, ok := paramID(c, "id")
+	if !ok {
+		return
+	}
 
-	row := db.QueryRow("SELECT * FROM library WHERE ID =?", id)
-	err := row.Scan(&library.ID, &library.Name)
+	library, err := s.store.Libraries.Get(id)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Library not found"})
+		if errors.Is(err, errNotFound) {
+			respondError(c, notFoundError("Library not found"))
 			return
 		}
 
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondError(c, err)
 		return
 	}
 
 	c.JSON(http.StatusOK, library)
 }
 
-func updateLibrary(c *gin.Context) {
-	id := c.Param("id")
+func (s *Server) updateLibrary(c *gin.Context) {
+	id, ok := paramID(c, "id")
+	if !ok {
+		return
+	}
 	var library Library
 
-	if err := c.BindJSON(&library); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if err := c.ShouldBindJSON(&library); err != nil {
+		respondError(c, badRequest(err.Error()))
 		return
 	}
 
-	_, err := db.Exec("UPDATE library SET Name =? WHERE ID =?", library.Name, id)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	library.ID = id
+	before, _ := s.store.Libraries.Get(id)
+	if err := s.store.Atomic(func(tx *Store) error {
+		if err := tx.Libraries.Update(&library); err != nil {
+			return err
+		}
+		return auditTx(c, tx, "update", "library", strconv.Itoa(id), before, library)
+	}); err != nil {
+		if errors.Is(err, errNotFound) {
+			respondError(c, notFoundError("Library not found"))
+			return
+		}
+
+		respondError(c, err)
 		return
 	}
 
-	library.ID, _ = strconv.Atoi(id)
 	c.JSON(http.StatusOK, library)
 }
 
-func deleteLibrary(c *gin.Context) {
-	id := c.Param("id")
+// deleteLibrary deletes a library together with its books and users. Loans
+// still open when it is forced through with force=true stay open: nobody of
+// the library can sign in to return or approve them until the library is
+// restored, which brings them back as they were.
+func (s *Server) deleteLibrary(c *gin.Context) {
+	id, ok := paramID(c, "id")
+	if !ok {
+		return
+	}
 
-	_, err := db.Exec("DELETE FROM library WHERE ID =?", id)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if s.blockedByOpenLoans(c, LoanFilter{LibID: id}, "Library") {
+		return
+	}
+
+	before, _ := s.store.Libraries.Get(id)
+	if err := s.store.Atomic(func(tx *Store) error {
+		if err := tx.Libraries.Delete(id); err != nil {
+			return err
+		}
+		return auditTx(c, tx, "delete", "library", strconv.Itoa(id), before, nil)
+	}); err != nil {
+		if errors.Is(err, errNotFound) {
+			respondError(c, notFoundError("Library not found"))
+			return
+		}
+
+		respondError(c, err)
 		return
 	}
 
@@ -578,90 +860,134 @@ func deleteLibrary(c *gin.Context) {
 
 // Request Events
 
-func createRequestEvent(c *gin.Context) {
+// createRequestEvent files a request. Readers always file for themselves and
+// only for books of their own library.
+func (s *Server) createRequestEvent(c *gin.Context) {
+	user := c.MustGet("user").(User)
 	var newRequestEvent RequestEvent
 
-	if err := c.BindJSON(&newRequestEvent); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if err := c.ShouldBindJSON(&newRequestEvent); err != nil {
+		respondError(c, badRequest(err.Error()))
 		return
 	}
+	if strings.EqualFold(user.Role, "reader") {
+		newRequestEvent.ReaderID = user.ID
+		if _, err := s.libraryBook(newRequestEvent.BookID, user.LibID); err != nil {
+			if errors.Is(err, errNotFound) {
+				respondError(c, invalidReference("book_id does not name a book of your library"))
+				return
+			}
+			respondError(c, err)
+			return
+		}
+	}
 
-	statement, _ := db.Prepare("INSERT INTO RequestEvents (BookID, ReaderID, RequestDate, ApprovalDate, ApproverID, RequestType) VALUES (?,?,?,?,?,?)")
-	result, _ := statement.Exec(newRequestEvent.BookID, newRequestEvent.ReaderID, newRequestEvent.RequestDate, newRequestEvent.ApprovalDate, newRequestEvent.ApproverID, newRequestEvent.RequestType)
-	id, _ := result.LastInsertId()
+	if err := s.store.Atomic(func(tx *Store) error {
+		if err := tx.RequestEvents.Create(&newRequestEvent); err != nil {
+			return err
+		}
+		return auditTx(c, tx, "create", "request_event", strconv.Itoa(newRequestEvent.ReqID), nil, newRequestEvent)
+	}); err != nil {
+		if errors.Is(err, errInvalidReference) {
+			respondError(c, invalidReference("book_id or reader_id does not name an existing book or user"))
+			return
+		}
+
+		respondError(c, err)
+		return
+	}
 
-	newRequestEvent.ReqID = int(id)
 	c.JSON(http.StatusCreated, newRequestEvent)
 }
 
-func getRequestEvent(c *gin.Context) {
-	id := c.Param("id")
-	var requestEvent RequestEvent
+func (s *Server) getRequestEvent(c *gin.Context) {
+	id, ok := paramID(c, "id")
+	if !ok {
+		return
+	}
 
-	row := db.QueryRow("SELECT * FROM RequestEvents WHERE ReqID =?", id)
-	err := row.Scan(&requestEvent.ReqID, &requestEvent.BookID, &requestEvent.ReaderID, &requestEvent.RequestDate, &requestEvent.ApprovalDate, &requestEvent.ApproverID, &requestEvent.RequestType)
+	requestEvent, err := s.store.RequestEvents.Get(id)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			c.JSON(http.StatusNotFound, gin.H{"error": "RequestEvent not found"})
+		if errors.Is(err, errNotFound) {
+			respondError(c, notFoundError("RequestEvent not found"))
 			return
 		}
 
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondError(c, err)
 		return
 	}
 
 	c.JSON(http.StatusOK, requestEvent)
 }
 
-func updateRequestEvent(c *gin.Context) {
-	id := c.Param("id")
+func (s *Server) updateRequestEvent(c *gin.Context) {
+	id, ok := paramID(c, "id")
+	if !ok {
+		return
+	}
 	var requestEvent RequestEvent
 
-	if err := c.BindJSON(&requestEvent); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if err := c.ShouldBindJSON(&requestEvent); err != nil {
+		respondError(c, badRequest(err.Error()))
 		return
 	}
 
-	_, err := db.Exec("UPDATE RequestEvents SET BookID =?, ReaderID =?, RequestDate =?, ApprovalDate =?, ApproverID =?, RequestType =? WHERE ReqID =?", requestEvent.BookID, requestEvent.ReaderID, requestEvent.RequestDate, requestEvent.ApprovalDate, requestEvent.ApproverID, requestEvent.RequestType, id)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	requestEvent.ReqID = id
+	before, _ := s.store.RequestEvents.Get(id)
+	if err := s.store.Atomic(func(tx *Store) error {
+		if err := tx.RequestEvents.Update(&requestEvent); err != nil {
+			return err
+		}
+		return auditTx(c, tx, "update", "request_event", strconv.Itoa(id), before, requestEvent)
+	}); err != nil {
+		if errors.Is(err, errNotFound) {
+			respondError(c, notFoundError("RequestEvent not found"))
+			return
+		}
+
+		if errors.Is(err, errInvalidReference) {
+			respondError(c, invalidReference("book_id, reader_id or approver_id does not name an existing book or user"))
+			return
+		}
+
+		respondError(c, err)
 		return
 	}
 
-	requestEvent.ReqID, _ = strconv.Atoi(id)
 	c.JSON(http.StatusOK, requestEvent)
 }
 
-func deleteRequestEvent(c *gin.Context) {
-	id := c.Param("id")
+func (s *Server) deleteRequestEvent(c *gin.Context) {
+	id, ok := paramID(c, "id")
+	if !ok {
+		return
+	}
+
+	before, _ := s.store.RequestEvents.Get(id)
+	if err := s.store.Atomic(func(tx *Store) error {
+		if err := tx.RequestEvents.Delete(id); err != nil {
+			return err
+		}
+		return auditTx(c, tx, "delete", "request_event", strconv.Itoa(id), before, nil)
+	}); err != nil {
+		if errors.Is(err, errNotFound) {
+			respondError(c, notFoundError("RequestEvent not found"))
+			return
+		}
 
-	_, err := db.Exec("DELETE FROM RequestEvents WHERE ReqID =?", id)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondError(c, err)
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "RequestEvent deleted"})
 }
 
-func listRequestEvents(c *gin.Context) {
-	var requestEvents []RequestEvent
-
-	rows, err := db.Query("SELECT * FROM RequestEvents")
+func (s *Server) listRequestEvents(c *gin.Context) {
+	requestEvents, err := s.store.RequestEvents.List()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondError(c, err)
 		return
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var requestEvent RequestEvent
-		if err := rows.Scan(&requestEvent.ReqID, &requestEvent.BookID, &requestEvent.ReaderID, &requestEvent.RequestDate, &requestEvent.ApprovalDate, &requestEvent.ApproverID, &requestEvent.RequestType); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-		requestEvents = append(requestEvents, requestEvent)
-	}
 
 	c.JSON(http.StatusOK, requestEvents)
 }
@@ -669,45 +995,47 @@ func listRequestEvents(c *gin.Context) {
 // Issue registry functions
 
 // Create a new issue registry entry
-func createIssue(c *gin.Context) {
+func (s *Server) createIssue(c *gin.Context) {
 	var newIssue IssueRegistery
 
-	if err := c.BindJSON(&newIssue); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if err := c.ShouldBindJSON(&newIssue); err != nil {
+		respondError(c, badRequest(err.Error()))
 		return
 	}
 
-	statement, _ := db.Prepare("INSERT INTO IssueRegistery (ISBN, ReaderID, IssueApproverID, IssueStatus, IssueDate, ExpectedReturnDate) VALUES (?,?,?,?,?,?)")
-	result, err := statement.Exec(newIssue.ISBN, newIssue.ReaderID, newIssue.IssueApproverID, newIssue.IssueStatus, newIssue.IssueDate, newIssue.ExpectedReturnDate)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
+	if err := s.store.Atomic(func(tx *Store) error {
+		if err := tx.Issues.Create(&newIssue); err != nil {
+			return err
+		}
+		return auditTx(c, tx, "create", "issue", strconv.Itoa(newIssue.IssueID), nil, newIssue)
+	}); err != nil {
+		if errors.Is(err, errInvalidReference) {
+			respondError(c, invalidReference("isbn or a user ID does not name an existing book or user"))
+			return
+		}
 
-	id, err := result.LastInsertId()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondError(c, err)
 		return
 	}
 
-	newIssue.IssueID = int(id)
 	c.JSON(http.StatusCreated, newIssue)
 }
 
 // Get an issue registry entry by ID
-func getIssue(c *gin.Context) {
-	id := c.Param("issueID")
-	var issue IssueRegistery
+func (s *Server) getIssue(c *gin.Context) {
+	id, ok := paramID(c, "issueID")
+	if !ok {
+		return
+	}
 
-	row := db.QueryRow("SELECT * FROM IssueRegistery WHERE IssueID =?", id)
-	err := row.Scan(&issue.IssueID, &issue.ISBN, &issue.ReaderID, &issue.IssueApproverID, &issue.IssueStatus, &issue.IssueDate, &issue.ExpectedReturnDate, &issue.ReturnDate, &issue.ReturnApproverID)
+	issue, err := s.store.Issues.Get(id)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Issue not found"})
+		if errors.Is(err, errNotFound) {
+			respondError(c, notFoundError("Issue not found"))
 			return
 		}
 
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondError(c, err)
 		return
 	}
 
@@ -715,18 +1043,37 @@ func getIssue(c *gin.Context) {
 }
 
 // Update an issue registry entry
-func updateIssue(c *gin.Context) {
-	id := c.Param("issueID")
+func (s *Server) updateIssue(c *gin.Context) {
+	id, ok := paramID(c, "issueID")
+	if !ok {
+		return
+	}
 	var updatedIssue IssueRegistery
 
-	if err := c.BindJSON(&updatedIssue); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if err := c.ShouldBindJSON(&updatedIssue); err != nil {
+		respondError(c, badRequest(err.Error()))
 		return
 	}
 
-	_, err := db.Exec("UPDATE IssueRegistery SET ISBN =?, ReaderID =?, IssueApproverID =?, IssueStatus =?, IssueDate =?, ExpectedReturnDate =?, ReturnDate =?, ReturnApproverID =? WHERE IssueID =?", updatedIssue.ISBN, updatedIssue.ReaderID, updatedIssue.IssueApproverID, updatedIssue.IssueStatus, updatedIssue.IssueDate, updatedIssue.ExpectedReturnDate, updatedIssue.ReturnDate, updatedIssue.ReturnApproverID, id)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	updatedIssue.IssueID = id
+	before, _ := s.store.Issues.Get(id)
+	if err := s.store.Atomic(func(tx *Store) error {
+		if err := tx.Issues.Update(&updatedIssue); err != nil {
+			return err
+		}
+		return auditTx(c, tx, "update", "issue", strconv.Itoa(id), before, updatedIssue)
+	}); err != nil {
+		if errors.Is(err, errNotFound) {
+			respondError(c, notFoundError("Issue not found"))
+			return
+		}
+
+		if errors.Is(err, errInvalidReference) {
+			respondError(c, invalidReference("isbn or a user ID does not name an existing book or user"))
+			return
+		}
+
+		respondError(c, err)
 		return
 	}
 
@@ -734,12 +1081,25 @@ func updateIssue(c *gin.Context) {
 }
 
 // Delete an issue registry entry
-func deleteIssue(c *gin.Context) {
-	id := c.Param("issueID")
+func (s *Server) deleteIssue(c *gin.Context) {
+	id, ok := paramID(c, "issueID")
+	if !ok {
+		return
+	}
 
-	_, err := db.Exec("DELETE FROM IssueRegistery WHERE IssueID =?", id)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	before, _ := s.store.Issues.Get(id)
+	if err := s.store.Atomic(func(tx *Store) error {
+		if err := tx.Issues.Delete(id); err != nil {
+			return err
+		}
+		return auditTx(c, tx, "delete", "issue", strconv.Itoa(id), before, nil)
+	}); err != nil {
+		if errors.Is(err, errNotFound) {
+			respondError(c, notFoundError("Issue not found"))
+			return
+		}
+
+		respondError(c, err)
 		return
 	}
 
@@ -747,24 +1107,12 @@ func deleteIssue(c *gin.Context) {
 }
 
 // List all issue registry entries
-func listIssues(c *gin.Context) {
-	var issues []IssueRegistery
-
-	rows, err := db.Query("SELECT * FROM IssueRegistery")
+func (s *Server) listIssues(c *gin.Context) {
+	issues, err := s.store.Issues.List()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondError(c, err)
 		return
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var issue IssueRegistery
-		if err := rows.Scan(&issue.IssueID, &issue.ISBN, &issue.ReaderID, &issue.IssueApproverID, &issue.IssueStatus, &issue.IssueDate, &issue.ExpectedReturnDate, &issue.ReturnDate, &issue.ReturnApproverID); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-		issues = append(issues, issue)
-	}
 
 	c.JSON(http.StatusOK, issues)
 }
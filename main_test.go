@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakeBooks serves Get from a map; the other BookRepository methods are not
+// used by the handlers under test.
+type fakeBooks struct {
+	BookRepository
+	books map[string]*BookInventory
+	err   error
+}
+
+func (f *fakeBooks) Get(isbn string) (*BookInventory, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if book, ok := f.books[isbn]; ok {
+		return book, nil
+	}
+	return nil, errNotFound
+}
+
+func TestGetBookWithFakeRepository(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	books := &fakeBooks{books: map[string]*BookInventory{"9780306406157": {ISBN: "9780306406157", Title: "Title", LibID: 1}}}
+	s := &Server{store: &Store{Books: books}}
+	router := gin.New()
+	router.GET("/books/:isbn", s.getBook)
+
+	get := func(isbn string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/books/"+isbn, nil))
+		return w
+	}
+
+	w := get("9780306406157")
+	var book BookInventory
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &book) != nil || book.Title != "Title" {
+		t.Errorf("existing book: %d %s", w.Code, w.Body)
+	}
+	if w := get("9780000000002"); w.Code != http.StatusNotFound || w.Header().Get("Content-Type") != "application/problem+json" {
+		t.Errorf("missing book: %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	books.err = errors.New("disk on fire")
+	if w := get("9780306406157"); w.Code != http.StatusInternalServerError {
+		t.Errorf("failing repository: %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+}
+
+// serveAs runs one request through handler as if user had signed in.
+func serveAs(user *User, route string, handler gin.HandlerFunc, method, path, body string) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(func(c *gin.Context) { c.Set("user", *user) })
+	router.Handle(method, route, handler)
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestBookWritesStayInLibrary(t *testing.T) {
+	store, _ := newTestStore(t)
+	library, admin, book := seedLibrary(t, store, 1)
+	other := &Library{Name: "Elsewhere"}
+	if err := store.Libraries.Create(other); err != nil {
+		t.Fatal(err)
+	}
+	stranger := &User{Name: "Stranger", Email: "stranger@example.org", Role: "admin", LibID: other.ID}
+	if err := store.Users.Create(stranger); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{config: defaultConfig(), store: store}
+
+	w := serveAs(admin, "/admin/books", s.createBook, http.MethodPost, "/admin/books",
+		fmt.Sprintf(`{"isbn":"9780441172719","title":"Dune","totalCopies":1,"availableCopies":1,"libID":%d}`, other.ID))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	if created, err := store.Books.Get("9780441172719"); err != nil || created.LibID != library.ID {
+		t.Errorf("book created in library %v (%v), want %d", created, err, library.ID)
+	}
+
+	if w := serveAs(stranger, "/admin/books/:isbn", s.updateBook, http.MethodPut, "/admin/books/"+book.ISBN, `{"title":"Mine","totalCopies":1}`); w.Code != http.StatusNotFound {
+		t.Errorf("update by another library: %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := serveAs(stranger, "/admin/books/:isbn", s.deleteBook, http.MethodDelete, "/admin/books/"+book.ISBN, ""); w.Code != http.StatusNotFound {
+		t.Errorf("delete by another library: %d, want %d", w.Code, http.StatusNotFound)
+	}
+	after, err := store.Books.Get(book.ISBN)
+	if err != nil || after.Title != book.Title || after.LibID != library.ID {
+		t.Errorf("book changed by another library: %+v %v", after, err)
+	}
+
+	if err := store.Books.Delete(book.ISBN); err != nil {
+		t.Fatal(err)
+	}
+	if w := serveAs(stranger, "/admin/books/:isbn/restore", s.restoreBook, http.MethodPost, "/admin/books/"+book.ISBN+"/restore", ""); w.Code != http.StatusNotFound {
+		t.Errorf("restore by another library: %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if _, err := store.Books.Get(book.ISBN); !errors.Is(err, errNotFound) {
+		t.Errorf("book restored by another library: %v", err)
+	}
+}
+
+func TestReadersRequestForThemselves(t *testing.T) {
+	store, _ := newTestStore(t)
+	library, _, book := seedLibrary(t, store, 1)
+	var readers []*User
+	for _, email := range []string{"one@example.org", "two@example.org"} {
+		reader := &User{Name: "Reader", Email: email, Role: "reader", LibID: library.ID}
+		if err := store.Users.Create(reader); err != nil {
+			t.Fatal(err)
+		}
+		readers = append(readers, reader)
+	}
+	s := &Server{config: defaultConfig(), store: store}
+
+	w := serveAs(readers[0], "/reader/requests", s.createRequestEvent, http.MethodPost, "/reader/requests",
+		fmt.Sprintf(`{"book_id":%q,"reader_id":%d,"request_type":"issue"}`, book.ISBN, readers[1].ID))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	var request RequestEvent
+	if err := json.Unmarshal(w.Body.Bytes(), &request); err != nil {
+		t.Fatal(err)
+	}
+	if request.ReaderID != readers[0].ID {
+		t.Errorf("request filed for reader %d, want %d", request.ReaderID, readers[0].ID)
+	}
+
+	other := &Library{Name: "Elsewhere"}
+	if err := store.Libraries.Create(other); err != nil {
+		t.Fatal(err)
+	}
+	outsider := &User{Name: "Outsider", Email: "out@example.org", Role: "reader", LibID: other.ID}
+	if err := store.Users.Create(outsider); err != nil {
+		t.Fatal(err)
+	}
+	w = serveAs(outsider, "/reader/requests", s.createRequestEvent, http.MethodPost, "/reader/requests",
+		fmt.Sprintf(`{"book_id":%q,"request_type":"issue"}`, book.ISBN))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("request for a book of another library: %d, want %d", w.Code, http.StatusUnprocessableEntity)
+	}
+}
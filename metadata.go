@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errMetadataNotFound = errors.New("no metadata found for ISBN")
+
+// BookMetadata is the bibliographic record a provider returns for an ISBN.
+type BookMetadata struct {
+	ISBN            string   `json:"isbn"`
+	Title           string   `json:"title"`
+	Authors         []string `json:"authors"`
+	Publisher       string   `json:"publisher"`
+	Version         string   `json:"version"`
+	SeriesName      string   `json:"seriesName"`
+	Language        string   `json:"language"`
+	PublicationYear int      `json:"publicationYear"`
+	Subjects        []string `json:"subjects"`
+}
+
+// MetadataProvider looks up bibliographic data by ISBN. Implementations return
+// errMetadataNotFound when they have no record for the ISBN.
+type MetadataProvider interface {
+	Lookup(isbn string) (*BookMetadata, error)
+}
+
+// openLibraryEdition is the subset of an OpenLibrary edition record we use.
+// It is shared by the dump reader and the HTTP provider.
+type openLibraryEdition struct {
+	Key         string   `json:"key"`
+	Title       string   `json:"title"`
+	Subtitle    string   `json:"subtitle"`
+	ISBN10      []string `json:"isbn_10"`
+	ISBN13      []string `json:"isbn_13"`
+	Publishers  []string `json:"publishers"`
+	PublishDate string   `json:"publish_date"`
+	EditionName string   `json:"edition_name"`
+	Series      []string `json:"series"`
+	Subjects    []string `json:"subjects"`
+	ByStatement string   `json:"by_statement"`
+	Languages   []struct {
+		Key string `json:"key"`
+	} `json:"languages"`
+	Authors []struct {
+		Key string `json:"key"`
+	} `json:"authors"`
+}
+
+type openLibraryRecord struct {
+	openLibraryEdition
+	Type struct {
+		Key string `json:"key"`
+	} `json:"type"`
+	Name string `json:"name"`
+}
+
+var yearPattern = regexp.MustCompile(`\b(1[0-9]{3}|20[0-9]{2})\b`)
+
+func (e *openLibraryEdition) metadata(isbn string, authorNames map[string]string) *BookMetadata {
+	meta := &BookMetadata{
+		ISBN:     isbn,
+		Title:    e.Title,
+		Version:  e.EditionName,
+		Subjects: e.Subjects,
+	}
+	if e.Subtitle != "" {
+		meta.Title = e.Title + ": " + e.Subtitle
+	}
+	if len(e.Publishers) > 0 {
+		meta.Publisher = e.Publishers[0]
+	}
+	if len(e.Series) > 0 {
+		meta.SeriesName = e.Series[0]
+	}
+	if len(e.Languages) > 0 {
+		meta.Language = strings.TrimPrefix(e.Languages[0].Key, "/languages/")
+	}
+	if year := yearPattern.FindString(e.PublishDate); year != "" {
+		meta.PublicationYear, _ = strconv.Atoi(year)
+	}
+	for _, author := range e.Authors {
+		if name := authorNames[author.Key]; name != "" {
+			meta.Authors = append(meta.Authors, name)
+		}
+	}
+	if len(meta.Authors) == 0 && e.ByStatement != "" {
+		meta.Authors = []string{strings.TrimSuffix(strings.TrimPrefix(e.ByStatement, "by "), ".")}
+	}
+	return meta
+}
+
+func (e *openLibraryEdition) isbns() []string {
+	var isbns []string
+	for _, isbn := range append(append([]string{}, e.ISBN13...), e.ISBN10...) {
+		isbns = append(isbns, normalizeISBN(isbn))
+	}
+	return isbns
+}
+
+func normalizeISBN(isbn string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(isbn))
+}
+
+// FileMetadataProvider serves lookups from a local OpenLibrary dump loaded into
+// memory. Each line is either a raw dump row (type, key, revision, modified,
+// JSON) or a bare JSON record. Author records in the same file resolve the
+// author keys referenced by editions.
+type FileMetadataProvider struct {
+	records map[string]*BookMetadata
+}
+
+func NewFileMetadataProvider(path string) (*FileMetadataProvider, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var editions []openLibraryEdition
+	authorNames := map[string]string{}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.LastIndex(line, "\t"); i >= 0 {
+			line = line[i+1:]
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		var record openLibraryRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			continue
+		}
+		if record.Type.Key == "/type/author" {
+			authorNames[record.Key] = record.Name
+			continue
+		}
+		editions = append(editions, record.openLibraryEdition)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	provider := &FileMetadataProvider{records: map[string]*BookMetadata{}}
+	for i := range editions {
+		for _, isbn := range editions[i].isbns() {
+			provider.records[isbn] = editions[i].metadata(isbn, authorNames)
+		}
+	}
+	return provider, nil
+}
+
+func (p *FileMetadataProvider) Lookup(isbn string) (*BookMetadata, error) {
+	meta, ok := p.records[normalizeISBN(isbn)]
+	if !ok {
+		return nil, errMetadataNotFound
+	}
+	copied := *meta
+	return &copied, nil
+}
+
+// HTTPMetadataProvider queries an OpenLibrary-compatible API at BaseURL using
+// GET /isbn/{isbn}.json and GET {authorKey}.json.
+type HTTPMetadataProvider struct {
+	BaseURL string
+	Client  *http.Client
+}
+
+func NewHTTPMetadataProvider(baseURL string) *HTTPMetadataProvider {
+	return &HTTPMetadataProvider{
+		BaseURL: strings.TrimRight(baseURL, "/"),
+		Client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *HTTPMetadataProvider) getJSON(path string, v interface{}) error {
+	resp, err := p.Client.Get(p.BaseURL + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errMetadataNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("metadata provider returned %s for %s", resp.Status, path)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (p *HTTPMetadataProvider) Lookup(isbn string) (*BookMetadata, error) {
+	isbn = normalizeISBN(isbn)
+
+	var edition openLibraryEdition
+	if err := p.getJSON("/isbn/"+isbn+".json", &edition); err != nil {
+		return nil, err
+	}
+
+	authorNames := map[string]string{}
+	for _, author := range edition.Authors {
+		var record openLibraryRecord
+		if err := p.getJSON(author.Key+".json", &record); err != nil {
+			if errors.Is(err, errMetadataNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		authorNames[author.Key] = record.Name
+	}
+
+	return edition.metadata(isbn, authorNames), nil
+}
+
+// chainMetadataProvider tries each provider in order until one has a record.
+type chainMetadataProvider []MetadataProvider
+
+func (chain chainMetadataProvider) Lookup(isbn string) (*BookMetadata, error) {
+	for _, provider := range chain {
+		meta, err := provider.Lookup(isbn)
+		if errors.Is(err, errMetadataNotFound) {
+			continue
+		}
+		return meta, err
+	}
+	return nil, errMetadataNotFound
+}
+
+// setupMetadataProvider configures lookups from a local dump file and an HTTP
+// endpoint. The file is consulted first. It returns nil when neither is set.
+func setupMetadataProvider(path, url string) MetadataProvider {
+	var chain chainMetadataProvider
+
+	if path != "" {
+		provider, err := NewFileMetadataProvider(path)
+		if err != nil {
+			slog.Error("loading metadata file", "path", path, "err", err)
+		} else {
+			chain = append(chain, provider)
+		}
+	}
+	if url != "" {
+		chain = append(chain, NewHTTPMetadataProvider(url))
+	}
+
+	if len(chain) == 0 {
+		return nil
+	}
+	return chain
+}
+
+// enrichBook fills empty fields of book from provider. Fields the admin
+// supplied are never overwritten.
+func enrichBook(provider MetadataProvider, book *BookInventory) error {
+	if provider == nil || book.ISBN == "" {
+		return nil
+	}
+
+	meta, err := provider.Lookup(book.ISBN)
+	if err != nil {
+		if errors.Is(err, errMetadataNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	if book.Title == "" {
+		book.Title = meta.Title
+	}
+	if book.Authors == "" && len(book.AuthorList) == 0 {
+		book.Authors = strings.Join(meta.Authors, ", ")
+	}
+	if book.Publisher == "" {
+		book.Publisher = meta.Publisher
+	}
+	if book.Version == "" {
+		book.Version = meta.Version
+	}
+	if book.SeriesName == "" {
+		book.SeriesName = meta.SeriesName
+	}
+	if book.Language == "" {
+		book.Language = meta.Language
+	}
+	if book.PublicationYear == 0 {
+		book.PublicationYear = meta.PublicationYear
+	}
+	if len(book.Subjects) == 0 {
+		book.Subjects = meta.Subjects
+	}
+	return nil
+}
+
+// lookupMetadata lets admins preview what the provider knows about an ISBN.
+func (s *Server) lookupMetadata(c *gin.Context) {
+	if s.metadata == nil {
+		respondError(c, notFoundError("No metadata provider configured"))
+		return
+	}
+
+	meta, err := s.metadata.Lookup(c.Param("isbn"))
+	if err != nil {
+		if errors.Is(err, errMetadataNotFound) {
+			respondError(c, notFoundError("Metadata not found"))
+			return
+		}
+
+		respondError(c, newAPIError(http.StatusBadGateway, codeUpstreamFailed, err.Error()))
+		return
+	}
+
+	c.JSON(http.StatusOK, meta)
+}
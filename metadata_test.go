@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const duneEdition = `{"key":"/books/OL1M","title":"Dune","isbn_13":["978-0-441-17271-9"],"publishers":["Ace"],"publish_date":"August 1990","languages":[{"key":"/languages/eng"}],"authors":[{"key":"/authors/OL1A"}],"subjects":["Science fiction"]}`
+
+var duneMetadata = &BookMetadata{
+	ISBN:            "9780441172719",
+	Title:           "Dune",
+	Authors:         []string{"Frank Herbert"},
+	Publisher:       "Ace",
+	Language:        "eng",
+	PublicationYear: 1990,
+	Subjects:        []string{"Science fiction"},
+}
+
+func TestHTTPMetadataProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/isbn/9780441172719.json":
+			w.Write([]byte(duneEdition))
+		case "/authors/OL1A.json":
+			w.Write([]byte(`{"key":"/authors/OL1A","name":"Frank Herbert"}`))
+		case "/isbn/9780000000002.json":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	provider := NewHTTPMetadataProvider(server.URL + "/")
+
+	meta, err := provider.Lookup("978-0-441-17271-9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(meta, duneMetadata) {
+		t.Errorf("Lookup = %+v, want %+v", meta, duneMetadata)
+	}
+	if _, err := provider.Lookup("9780306406157"); !errors.Is(err, errMetadataNotFound) {
+		t.Errorf("unknown ISBN: %v, want errMetadataNotFound", err)
+	}
+	if _, err := provider.Lookup("9780000000002"); err == nil || errors.Is(err, errMetadataNotFound) {
+		t.Errorf("failing server: %v, want an upstream error", err)
+	}
+}
+
+func TestFileMetadataProvider(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "editions.txt")
+	dump := "/type/author\t/authors/OL1A\t1\t2020-01-01\t{\"type\":{\"key\":\"/type/author\"},\"key\":\"/authors/OL1A\",\"name\":\"Frank Herbert\"}\n" +
+		"not json\n" +
+		duneEdition + "\n"
+	if err := os.WriteFile(path, []byte(dump), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	provider, err := NewFileMetadataProvider(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := provider.Lookup("9780441172719")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(meta, duneMetadata) {
+		t.Errorf("Lookup = %+v, want %+v", meta, duneMetadata)
+	}
+	if _, err := provider.Lookup("9780306406157"); !errors.Is(err, errMetadataNotFound) {
+		t.Errorf("unknown ISBN: %v, want errMetadataNotFound", err)
+	}
+}
+
+type staticMetadataProvider map[string]*BookMetadata
+
+func (p staticMetadataProvider) Lookup(isbn string) (*BookMetadata, error) {
+	if meta, ok := p[isbn]; ok {
+		return meta, nil
+	}
+	return nil, errMetadataNotFound
+}
+
+func TestEnrichBookKeepsAdminFields(t *testing.T) {
+	provider := chainMetadataProvider{staticMetadataProvider{}, staticMetadataProvider{duneMetadata.ISBN: duneMetadata}}
+
+	book := &BookInventory{ISBN: duneMetadata.ISBN, Title: "Dune (Deluxe)"}
+	if err := enrichBook(provider, book); err != nil {
+		t.Fatal(err)
+	}
+	if book.Title != "Dune (Deluxe)" {
+		t.Errorf("Title overwritten with %q", book.Title)
+	}
+	if book.Authors != "Frank Herbert" || book.Publisher != "Ace" || book.PublicationYear != 1990 {
+		t.Errorf("book not enriched: %+v", book)
+	}
+
+	unknown := &BookInventory{ISBN: "9780306406157"}
+	if err := enrichBook(provider, unknown); err != nil || unknown.Title != "" {
+		t.Errorf("unknown ISBN: err %v, title %q", err, unknown.Title)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// Request and query metrics are package level because dbConn records them
+// without knowing about the server. They are exposed by the registry built in
+// newMetricsRegistry.
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "library_http_requests_total",
+		Help: "HTTP requests by route and status.",
+	}, []string{"method", "route", "status"})
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "library_http_request_duration_seconds",
+		Help:    "HTTP request latency by route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+	dbQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "library_db_query_duration_seconds",
+		Help:    "Database statement latency by kind of statement. Row iteration is not included.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"operation"})
+	dbQueryErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "library_db_query_errors_total",
+		Help: "Database statements that failed, by kind of statement.",
+	}, []string{"operation"})
+)
+
+var (
+	openLoansDesc       = prometheus.NewDesc("library_open_loans", "Loans not yet returned.", []string{"lib_id"}, nil)
+	overdueLoansDesc    = prometheus.NewDesc("library_overdue_loans", "Loans not yet returned and past their expected return date.", []string{"lib_id"}, nil)
+	pendingRequestsDesc = prometheus.NewDesc("library_pending_requests", "Requests waiting for a decision.", []string{"lib_id"}, nil)
+)
+
+// LibraryCirculation holds the current circulation figures of one library.
+type LibraryCirculation struct {
+	LibID           int
+	OpenLoans       int
+	OverdueLoans    int
+	PendingRequests int
+}
+
+func newMetricsRegistry(store *Store) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests, httpRequestDuration, dbQueryDuration, dbQueryErrors,
+		circulationCollector{store: store},
+	)
+	return registry
+}
+
+// metricsMiddleware records every request under its route pattern, so that
+// /books/:isbn is one series rather than one per ISBN.
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		method := c.Request.Method
+		httpRequests.WithLabelValues(method, route, strconv.Itoa(c.Writer.Status())).Inc()
+		httpRequestDuration.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+	}
+}
+
+// observeQuery records a statement started at start. Statements are labelled
+// by their first keyword to keep the number of series small.
+func observeQuery(query string, start time.Time, err error) {
+	operation := "other"
+	if fields := strings.Fields(query); len(fields) > 0 {
+		switch keyword := strings.ToLower(fields[0]); keyword {
+		case "select", "insert", "update", "delete":
+			operation = keyword
+		}
+	}
+	dbQueryDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		dbQueryErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+// circulationCollector reads the per-library gauges from the database on
+// every scrape, so they are never stale.
+type circulationCollector struct {
+	store *Store
+}
+
+func (cc circulationCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- openLoansDesc
+	ch <- overdueLoansDesc
+	ch <- pendingRequestsDesc
+}
+
+func (cc circulationCollector) Collect(ch chan<- prometheus.Metric) {
+	figures, err := cc.store.Stats.Circulation(time.Now().UTC())
+	if err != nil {
+		err = fmt.Errorf("collecting circulation metrics: %w", err)
+		ch <- prometheus.NewInvalidMetric(openLoansDesc, err)
+		return
+	}
+	for _, f := range figures {
+		libID := strconv.Itoa(f.LibID)
+		ch <- prometheus.MustNewConstMetric(openLoansDesc, prometheus.GaugeValue, float64(f.OpenLoans), libID)
+		ch <- prometheus.MustNewConstMetric(overdueLoansDesc, prometheus.GaugeValue, float64(f.OverdueLoans), libID)
+		ch <- prometheus.MustNewConstMetric(pendingRequestsDesc, prometheus.GaugeValue, float64(f.PendingRequests), libID)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	store, _ := newTestStore(t)
+	library, admin, book := seedLibrary(t, store, 2)
+	reader := &User{Name: "Ada", Email: "ada@example.org", Role: "reader", LibID: library.ID}
+	if err := store.Users.Create(reader); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	loans := []*IssueRegistery{
+		{ISBN: book.ISBN, ReaderID: reader.ID, IssueApproverID: admin.ID, IssueStatus: issueStatusOverdue, IssueDate: now.AddDate(0, 0, -20), ExpectedReturnDate: now.AddDate(0, 0, -6)},
+		{ISBN: book.ISBN, ReaderID: reader.ID, IssueApproverID: admin.ID, IssueStatus: issueStatusIssued, IssueDate: now, ExpectedReturnDate: now.AddDate(0, 0, 14)},
+	}
+	for _, loan := range loans {
+		if err := store.Issues.Create(loan); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.RequestEvents.Create(&RequestEvent{BookID: book.ISBN, ReaderID: reader.ID, RequestType: requestTypeIssue, RequestDate: now}); err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(metricsMiddleware())
+	router.GET("/metrics-test/:id", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	router.GET("/metrics", gin.WrapH(promhttp.HandlerFor(newMetricsRegistry(store), promhttp.HandlerOpts{})))
+	scrape := func() string {
+		t.Helper()
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET /metrics: %d", w.Code)
+		}
+		body, _ := io.ReadAll(w.Body)
+		return string(body)
+	}
+
+	// The request counters are package level, so only their growth is ours
+	const routeSeries = `library_http_requests_total{method="GET",route="/metrics-test/:id",status="204"}`
+	before := metricValue(scrape(), routeSeries)
+	for _, path := range []string{"/metrics-test/1", "/metrics-test/2", "/metrics-test/2/extra"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	body := scrape()
+	// Both IDs count towards one series per route
+	if got := metricValue(body, routeSeries) - before; got != 2 {
+		t.Errorf("%s grew by %v, want 2", routeSeries, got)
+	}
+
+	lib := strconv.Itoa(library.ID)
+	for _, want := range []string{
+		`library_http_requests_total{method="GET",route="unmatched",status="404"}`,
+		`library_open_loans{lib_id="` + lib + `"} 2`,
+		`library_overdue_loans{lib_id="` + lib + `"} 1`,
+		`library_pending_requests{lib_id="` + lib + `"} 1`,
+		`library_db_query_duration_seconds_count{operation="insert"}`,
+		`library_db_query_duration_seconds_count{operation="select"}`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics do not contain %s", want)
+		}
+	}
+	if strings.Contains(body, "/metrics-test/1") {
+		t.Error("a request path was used as a label")
+	}
+}
+
+// metricValue returns the value of series in a text exposition, or 0 when it
+// has not been recorded yet.
+func metricValue(exposition, series string) float64 {
+	for _, line := range strings.Split(exposition, "\n") {
+		if value, ok := strings.CutPrefix(line, series+" "); ok {
+			v, _ := strconv.ParseFloat(value, 64)
+			return v
+		}
+	}
+	return 0
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Notification events. Each has a template; see defaultTemplates.
+const (
+	notifyRequestApproved = "request_approved"
+	notifyRequestRejected = "request_rejected"
+	notifyDueSoon         = "due_soon"
+	notifyOverdue         = "overdue"
+	notifyHoldReady       = "hold_ready"
+)
+
+// NotificationData is what the templates see. User is the recipient; the
+// other fields are set as far as they apply to the event.
+type NotificationData struct {
+	User    *User
+	Title   string
+	Loan    *IssueRegistery
+	Request *RequestEvent
+	Reason  string
+}
+
+// Notifier tells a user about an event.
+type Notifier interface {
+	Notify(event string, data NotificationData) error
+}
+
+// errMailDisabled is returned by a Sender that has no mail server for the
+// library.
+var errMailDisabled = errors.New("no SMTP host configured")
+
+// Sender delivers a rendered message to an address on behalf of a library.
+type Sender interface {
+	Send(libID int, to, subject, body string) error
+}
+
+// defaultTemplates are used for events without a file in mail.templateDir.
+// A template starts with a "Subject:" line and a blank line; the rest is the
+// plain text body.
+var defaultTemplates = map[string]string{
+	notifyRequestApproved: `Subject: {{if eq .Request.RequestType "return"}}Return of {{printf "%q" .Title}} confirmed{{else}}Your loan of {{printf "%q" .Title}} was approved{{end}}
+
+Hello {{.User.Name}},
+
+{{if eq .Request.RequestType "return" -}}
+We have received {{printf "%q" .Title}} back. Thank you.
+{{- else -}}
+Your request for {{printf "%q" .Title}} was approved. Please return it by {{date .Loan.ExpectedReturnDate}}.
+{{- end}}
+`,
+	notifyRequestRejected: `Subject: Your request for {{printf "%q" .Title}} was declined
+
+Hello {{.User.Name}},
+
+Your {{.Request.RequestType}} request for {{printf "%q" .Title}} was declined.
+{{- with .Reason}}
+
+Reason: {{.}}
+{{- end}}
+`,
+	notifyDueSoon: `Subject: Reminder: {{printf "%q" .Title}} is due on {{date .Loan.ExpectedReturnDate}}
+
+Hello {{.User.Name}},
+
+Please return {{printf "%q" .Title}} by {{date .Loan.ExpectedReturnDate}}.
+`,
+	notifyOverdue: `Subject: Overdue: {{printf "%q" .Title}}
+
+Hello {{.User.Name}},
+
+{{printf "%q" .Title}} was due back on {{date .Loan.ExpectedReturnDate}}. Please return it as soon as possible.
+`,
+	notifyHoldReady: `Subject: {{printf "%q" .Title}} is waiting for you
+
+Hello {{.User.Name}},
+
+{{printf "%q" .Title}}, which you placed a hold on, is ready to be picked up.
+`,
+}
+
+var templateFuncs = template.FuncMap{
+	"date": func(t time.Time) string { return t.Format("Mon, 2 Jan 2006") },
+}
+
+type messageTemplate struct {
+	subject *template.Template
+	body    *template.Template
+}
+
+func parseMessageTemplate(name, text string) (*messageTemplate, error) {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	end := strings.Index(text, "\n\n")
+	if end < 0 || !strings.HasPrefix(text, "Subject:") || strings.Contains(text[:end], "\n") {
+		return nil, fmt.Errorf("template %s: must start with a single Subject: line followed by a blank line", name)
+	}
+	subject, err := template.New(name + ".subject").Funcs(templateFuncs).Parse(strings.TrimSpace(strings.TrimPrefix(text[:end], "Subject:")))
+	if err != nil {
+		return nil, err
+	}
+	body, err := template.New(name).Funcs(templateFuncs).Parse(text[end+2:])
+	if err != nil {
+		return nil, err
+	}
+	return &messageTemplate{subject: subject, body: body}, nil
+}
+
+func (t *messageTemplate) render(data NotificationData) (subject, body string, err error) {
+	var b strings.Builder
+	if err := t.subject.Execute(&b, data); err != nil {
+		return "", "", err
+	}
+	subject = strings.Join(strings.Fields(b.String()), " ")
+	b.Reset()
+	if err := t.body.Execute(&b, data); err != nil {
+		return "", "", err
+	}
+	return subject, b.String(), nil
+}
+
+// loadTemplates parses the built-in templates, replacing each with
+// dir/<event>.tmpl when that file exists.
+func loadTemplates(dir string) (map[string]*messageTemplate, error) {
+	templates := map[string]*messageTemplate{}
+	for event, text := range defaultTemplates {
+		if dir != "" {
+			data, err := os.ReadFile(filepath.Join(dir, event+".tmpl"))
+			if err == nil {
+				text = string(data)
+			} else if !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+		}
+		t, err := parseMessageTemplate(event, text)
+		if err != nil {
+			return nil, err
+		}
+		templates[event] = t
+	}
+	return templates, nil
+}
+
+// templateNotifier renders an event's template and delivers it on the
+// channel the recipient chose for the event: by a Sender, or to their inbox.
+type templateNotifier struct {
+	templates map[string]*messageTemplate
+	sender    Sender
+	inbox     NotificationRepository
+}
+
+func newNotifier(cfg MailConfig, inbox NotificationRepository) (*templateNotifier, error) {
+	templates, err := loadTemplates(cfg.TemplateDir)
+	if err != nil {
+		return nil, err
+	}
+	return &templateNotifier{templates: templates, sender: mailSender{cfg: cfg}, inbox: inbox}, nil
+}
+
+// Notify does nothing when the email channel is chosen by a user without an
+// email address. It fails with errMailDisabled when no mail server is
+// configured for their library, so callers can try again once there is one.
+func (n *templateNotifier) Notify(event string, data NotificationData) error {
+	t, ok := n.templates[event]
+	if !ok {
+		return fmt.Errorf("no template for %s", event)
+	}
+	prefs, err := n.inbox.Preferences(data.User.ID)
+	if err != nil {
+		return err
+	}
+	channel := notificationChannel(prefs, event)
+	if channel == channelNone || channel == channelEmail && data.User.Email == "" {
+		return nil
+	}
+
+	subject, body, err := t.render(data)
+	if err != nil {
+		return err
+	}
+	if channel == channelInApp {
+		return n.inbox.Create(&Notification{UserID: data.User.ID, Event: event, Subject: subject, Body: body, CreatedAt: time.Now().UTC()})
+	}
+	return n.sender.Send(data.User.LibID, data.User.Email, subject, body)
+}
+
+// mailSender delivers over SMTP with the settings for the recipient's
+// library, and fails with errMailDisabled when no host is set. The connection
+// is upgraded with STARTTLS whenever the server offers it.
+type mailSender struct {
+	cfg MailConfig
+}
+
+func (s mailSender) Send(libID int, to, subject, body string) error {
+	server := s.cfg.serverFor(libID)
+	if server.Host == "" {
+		return errMailDisabled
+	}
+
+	from, err := mail.ParseAddress(server.From)
+	if err != nil {
+		return fmt.Errorf("mail from address: %w", err)
+	}
+	message, err := buildMessage(server.From, to, subject, body)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if server.Username != "" {
+		auth = smtp.PlainAuth("", server.Username, server.Password, server.Host)
+	}
+	return smtp.SendMail(net.JoinHostPort(server.Host, strconv.Itoa(server.Port)), auth, from.Address, []string{to}, message)
+}
+
+func buildMessage(from, to, subject, body string) ([]byte, error) {
+	var b bytes.Buffer
+	headers := []string{
+		"From: " + from,
+		"To: " + to,
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+		"Content-Transfer-Encoding: quoted-printable",
+	}
+	for _, header := range headers {
+		b.WriteString(header + "\r\n")
+	}
+	b.WriteString("\r\n")
+
+	w := quotedprintable.NewWriter(&b)
+	if _, err := w.Write([]byte(strings.ReplaceAll(body, "\n", "\r\n"))); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// runTestEmailCommand implements `test-email`, which sends one notification
+// filled with sample data so templates and SMTP settings can be checked, for
+// example against a local SMTP stand-in such as MailHog.
+func runTestEmailCommand(a *app, args []string) error {
+	flags := flag.NewFlagSet("test-email", flag.ExitOnError)
+	to := flags.String("to", "", "recipient address")
+	event := flags.String("event", notifyRequestApproved, "notification to send")
+	libID := flags.Int("lib", 0, "library whose mail settings to use")
+	flags.Parse(args)
+	if *to == "" {
+		return errors.New("test-email: -to is required")
+	}
+	if a.config.Mail.serverFor(*libID).Host == "" {
+		return fmt.Errorf("test-email: %w for library %d", errMailDisabled, *libID)
+	}
+
+	now := time.Now().UTC()
+	loan := &IssueRegistery{ISBN: "9780306406157", IssueStatus: issueStatusIssued, IssueDate: now, ExpectedReturnDate: now.AddDate(0, 0, a.config.Circulation.LoanDays)}
+	data := NotificationData{
+		User:    &User{Name: "Test Reader", Email: *to, LibID: *libID},
+		Title:   "A Sample Book",
+		Loan:    loan,
+		Request: &RequestEvent{BookID: loan.ISBN, RequestType: requestTypeIssue, Decision: requestDecisionApproved},
+		Reason:  "This is a test.",
+	}
+	if err := a.notifier.Notify(*event, data); err != nil {
+		return err
+	}
+	fmt.Printf("Sent %s to %s\n", *event, *to)
+	return nil
+}
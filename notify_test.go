@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRenderDefaultTemplates(t *testing.T) {
+	templates, err := loadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	due := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	user := &User{Name: "Ada"}
+	loan := &IssueRegistery{ExpectedReturnDate: due}
+
+	tests := []struct {
+		event       string
+		data        NotificationData
+		subject     string
+		bodyContent string
+	}{
+		{notifyRequestApproved, NotificationData{User: user, Title: "Dune", Loan: loan, Request: &RequestEvent{RequestType: requestTypeIssue}},
+			`Your loan of "Dune" was approved`, "Please return it by Fri, 1 Mar 2024."},
+		{notifyRequestApproved, NotificationData{User: user, Title: "Dune", Loan: loan, Request: &RequestEvent{RequestType: requestTypeReturn}},
+			`Return of "Dune" confirmed`, `We have received "Dune" back.`},
+		{notifyRequestRejected, NotificationData{User: user, Title: "Dune", Request: &RequestEvent{RequestType: requestTypeIssue}, Reason: "Lost"},
+			`Your request for "Dune" was declined`, "Reason: Lost"},
+		{notifyDueSoon, NotificationData{User: user, Title: "Dune", Loan: loan},
+			`Reminder: "Dune" is due on Fri, 1 Mar 2024`, "Hello Ada,"},
+	}
+	for _, tt := range tests {
+		subject, body, err := templates[tt.event].render(tt.data)
+		if err != nil {
+			t.Errorf("%s: %v", tt.event, err)
+			continue
+		}
+		if subject != tt.subject {
+			t.Errorf("%s: subject %q, want %q", tt.event, subject, tt.subject)
+		}
+		if !strings.Contains(body, tt.bodyContent) {
+			t.Errorf("%s: body %q does not contain %q", tt.event, body, tt.bodyContent)
+		}
+	}
+}
+
+func TestLoadTemplatesFromDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, notifyOverdue+".tmpl"), []byte("Subject: Late: {{.Title}}\r\n\r\nBring back {{.Title}}.\r\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	templates, err := loadTemplates(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, body, err := templates[notifyOverdue].render(NotificationData{User: &User{}, Title: "Dune", Loan: &IssueRegistery{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != "Late: Dune" || body != "Bring back Dune.\n" {
+		t.Errorf("rendered %q / %q", subject, body)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, notifyHoldReady+".tmpl"), []byte("Ready: {{.Title}}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadTemplates(dir); err == nil {
+		t.Error("template without a Subject: line was accepted")
+	}
+}
+
+func TestServerForFallsBack(t *testing.T) {
+	cfg := MailConfig{
+		SMTP: SMTPConfig{Host: "smtp.example.org", Port: 587, Username: "library", Password: "secret", From: "Library <library@example.org>"},
+		Libraries: map[int]SMTPConfig{
+			2: {From: "North <north@example.org>"},
+			3: {Host: "mail.south.example.org", Username: "south"},
+		},
+	}
+
+	if got := cfg.serverFor(1); got != cfg.SMTP {
+		t.Errorf("library without override: %+v, want %+v", got, cfg.SMTP)
+	}
+	want := cfg.SMTP
+	want.From = "North <north@example.org>"
+	if got := cfg.serverFor(2); got != want {
+		t.Errorf("library 2: %+v, want %+v", got, want)
+	}
+	want = SMTPConfig{Host: "mail.south.example.org", Port: 587, Username: "south", From: cfg.SMTP.From}
+	if got := cfg.serverFor(3); got != want {
+		t.Errorf("library 3: %+v, want %+v", got, want)
+	}
+}
+
+// smtpStandIn accepts SMTP sessions on a local port and keeps the messages
+// it is given.
+type smtpStandIn struct {
+	port     int
+	mu       sync.Mutex
+	messages []string
+}
+
+func newSMTPStandIn(t *testing.T) *smtpStandIn {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	server := &smtpStandIn{port: listener.Addr().(*net.TCPAddr).Port}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (s *smtpStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { fmt.Fprintf(conn, "%s\r\n", line) }
+	reply("220 stand-in")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch strings.ToUpper(strings.TrimSpace(line)) {
+		case "DATA":
+			reply("354 end with .")
+			var message strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				message.WriteString(line)
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, message.String())
+			s.mu.Unlock()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func (s *smtpStandIn) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.messages...)
+}
+
+func TestMailSenderDialsLibraryServer(t *testing.T) {
+	shared, north := newSMTPStandIn(t), newSMTPStandIn(t)
+	sender := mailSender{cfg: MailConfig{
+		SMTP:      SMTPConfig{Host: "localhost", Port: shared.port, From: "Library <library@example.org>"},
+		Libraries: map[int]SMTPConfig{2: {Host: "127.0.0.1", Port: north.port, From: "North <north@example.org>"}},
+	}}
+
+	if err := sender.Send(2, "ada@example.org", "Hello", "Body"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sender.Send(1, "bob@example.org", "Hello", "Body"); err != nil {
+		t.Fatal(err)
+	}
+
+	if messages := north.received(); len(messages) != 1 || !strings.Contains(messages[0], "north@example.org") || !strings.Contains(messages[0], "ada@example.org") {
+		t.Errorf("library server received %q", messages)
+	}
+	if messages := shared.received(); len(messages) != 1 || !strings.Contains(messages[0], "bob@example.org") {
+		t.Errorf("shared server received %q", messages)
+	}
+}
+
+func TestRemindersWaitForMailServer(t *testing.T) {
+	store, _ := newTestStore(t)
+	library, admin, book := seedLibrary(t, store, 1)
+	reader := &User{Name: "Ada", Email: "ada@example.org", Role: "reader", LibID: library.ID}
+	if err := store.Users.Create(reader); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	loan := &IssueRegistery{ISBN: book.ISBN, ReaderID: reader.ID, IssueApproverID: admin.ID, IssueStatus: issueStatusOverdue, IssueDate: now.AddDate(0, 0, -20), ExpectedReturnDate: now.AddDate(0, 0, -6)}
+	if err := store.Issues.Create(loan); err != nil {
+		t.Fatal(err)
+	}
+
+	a := &app{config: defaultConfig(), store: store}
+	var err error
+	if a.notifier, err = newNotifier(MailConfig{}, store.Notifications); err != nil {
+		t.Fatal(err)
+	}
+	summary, err := overdueRemindersJob(a, now)
+	if err != nil {
+		t.Fatalf("reminders without a mail server: %v", err)
+	}
+	if !strings.Contains(summary, "kept 1") {
+		t.Errorf("summary %q does not mention the kept reminder", summary)
+	}
+
+	server := newSMTPStandIn(t)
+	if a.notifier, err = newNotifier(MailConfig{SMTP: SMTPConfig{Host: "127.0.0.1", Port: server.port, From: "library@example.org"}}, store.Notifications); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := overdueRemindersJob(a, now); err != nil {
+		t.Fatal(err)
+	}
+	if messages := server.received(); len(messages) != 1 || !strings.Contains(messages[0], "ada@example.org") {
+		t.Errorf("mail server received %q", messages)
+	}
+	pending, err := store.Issues.PendingReminders(reminderOverdue, issueStatusOverdue, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("%d reminders still pending after sending", len(pending))
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Domain events. Repositories record them in the outbox in the same
+// transaction as the change they describe, so an event exists exactly when
+// its change was committed. OutboxDispatcher then hands each one to the
+// webhooks and the notifier at least once.
+const (
+	eventBookCreated     = "book.created"
+	eventRequestCreated  = "request.created"
+	eventRequestRejected = "request.rejected"
+	eventIssueApproved   = "issue.approved"
+	eventIssueReturned   = "issue.returned"
+	eventIssueOverdue    = "issue.overdue"
+)
+
+// loanEvent is the data of the issue.* events. Request is nil for
+// issue.overdue and for loans created or edited directly.
+type loanEvent struct {
+	Request *RequestEvent   `json:"request,omitempty"`
+	Issue   *IssueRegistery `json:"issue"`
+}
+
+// rejectionEvent is the data of request.rejected.
+type rejectionEvent struct {
+	Request *RequestEvent `json:"request"`
+	Reason  string        `json:"reason,omitempty"`
+}
+
+// An entry is retried with the webhook backoff until it has been tried
+// outboxMaxAttempts times, and kept for outboxRetention once processed.
+const (
+	outboxMaxAttempts = 8
+	outboxBatchSize   = 50
+	outboxRetention   = 30 * 24 * time.Hour
+)
+
+// OutboxEntry is one recorded domain event. ProcessedAt is set once it has
+// been dispatched or given up on; LastError tells which.
+type OutboxEntry struct {
+	ID            int             `json:"id"`
+	Event         string          `json:"event"`
+	LibID         int             `json:"libID"`
+	Data          json.RawMessage `json:"data"`
+	CreatedAt     time.Time       `json:"createdAt"`
+	Attempts      int             `json:"attempts"`
+	LastError     string          `json:"lastError"`
+	NextAttemptAt time.Time       `json:"nextAttemptAt"`
+	ProcessedAt   *time.Time      `json:"processedAt,omitempty"`
+}
+
+func createOutboxTable() error {
+	createOutboxTableSQL := []string{
+		`CREATE TABLE IF NOT EXISTS outbox (
+        "ID" INTEGER PRIMARY KEY AUTOINCREMENT,
+        "Event" TEXT NOT NULL,
+        "LibID" INTEGER NOT NULL DEFAULT 0,
+        "Data" TEXT NOT NULL,
+        "CreatedAt" TIMESTAMP NOT NULL,
+        "Attempts" INTEGER NOT NULL DEFAULT 0,
+        "LastError" TEXT NOT NULL DEFAULT '',
+        "NextAttemptAt" TIMESTAMP NOT NULL,
+        "ProcessedAt" TIMESTAMP
+    );`,
+		`CREATE INDEX IF NOT EXISTS outbox_due ON outbox ("ProcessedAt", "NextAttemptAt");`,
+	}
+
+	for _, stmt := range createOutboxTableSQL {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OutboxDispatcher feeds outbox entries to the webhooks and the notifier.
+// Webhook deliveries are queued once per entry however often it is retried;
+// emails may be sent again if the process stops between sending one and
+// marking its entry processed.
+type OutboxDispatcher struct {
+	store    *Store
+	notifier Notifier
+	hub      *EventHub
+}
+
+func NewOutboxDispatcher(store *Store, notifier Notifier, hub *EventHub) *OutboxDispatcher {
+	return &OutboxDispatcher{store: store, notifier: notifier, hub: hub}
+}
+
+// Run dispatches due entries every interval until ctx is cancelled.
+func (d *OutboxDispatcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := d.DispatchDue(time.Now().UTC()); err != nil {
+			slog.Error("dispatching events", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// DispatchDue makes one attempt at every entry that is due.
+func (d *OutboxDispatcher) DispatchDue(now time.Time) error {
+	for {
+		entries, err := d.store.Outbox.Due(now, outboxBatchSize)
+		if err != nil {
+			return err
+		}
+		for i := range entries {
+			entry := &entries[i]
+			entry.Attempts++
+			entry.LastError = ""
+			if entry.Attempts == 1 {
+				d.hub.Publish(*entry)
+			}
+			finished := time.Now().UTC()
+			if err := d.dispatch(entry); err != nil {
+				entry.LastError = err.Error()
+				entry.NextAttemptAt = finished.Add(webhookRetryBase << (entry.Attempts - 1))
+			}
+			if entry.LastError == "" || entry.Attempts >= outboxMaxAttempts {
+				entry.ProcessedAt = &finished
+			}
+			if err := d.store.Outbox.Update(entry); err != nil {
+				return err
+			}
+		}
+		if len(entries) < outboxBatchSize {
+			return nil
+		}
+	}
+}
+
+// payload is the JSON document describing the entry to webhooks and event
+// streams.
+func (entry *OutboxEntry) payload() ([]byte, error) {
+	return json.Marshal(webhookPayload{Event: entry.Event, LibID: entry.LibID, OccurredAt: entry.CreatedAt, Data: entry.Data})
+}
+
+func (d *OutboxDispatcher) dispatch(entry *OutboxEntry) error {
+	payload, err := entry.payload()
+	if err != nil {
+		return err
+	}
+	if _, err := d.store.Webhooks.Enqueue(entry.ID, entry.Event, entry.LibID, payload, time.Now().UTC()); err != nil {
+		return err
+	}
+
+	switch entry.Event {
+	case eventIssueApproved, eventIssueReturned:
+		var data loanEvent
+		if err := json.Unmarshal(entry.Data, &data); err != nil {
+			return err
+		}
+		return d.notifyReader(notifyRequestApproved, data.Request, data.Issue, "")
+	case eventRequestRejected:
+		var data rejectionEvent
+		if err := json.Unmarshal(entry.Data, &data); err != nil {
+			return err
+		}
+		return d.notifyReader(notifyRequestRejected, data.Request, nil, data.Reason)
+	}
+	return nil
+}
+
+// notifyReader skips readers who have been deleted since the event. Without a
+// mail server the email is dropped: a decision is old news by the time one is
+// configured.
+func (d *OutboxDispatcher) notifyReader(template string, request *RequestEvent, loan *IssueRegistery, reason string) error {
+	if request == nil {
+		return nil
+	}
+	reader, err := d.store.Users.Get(request.ReaderID)
+	if errors.Is(err, errNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = d.notifier.Notify(template, NotificationData{User: reader, Title: bookTitle(d.store, request.BookID), Loan: loan, Request: request, Reason: reason})
+	if errors.Is(err, errMailDisabled) {
+		// The message may hold personal data, so only say who it was for
+		slog.Info("email not sent, no SMTP host configured", "event", template, "to", reader.Email, "lib_id", reader.LibID)
+		return nil
+	}
+	return err
+}
+
+func pruneOutboxJob(a *app, now time.Time) (string, error) {
+	n, err := a.store.Outbox.Prune(now.Add(-outboxRetention))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("deleted %d processed events", n), nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPruneOutboxJob(t *testing.T) {
+	store, _ := newTestStore(t)
+	library, _, _ := seedLibrary(t, store, 1)
+	for _, isbn := range []string{"9780140449136", "9780262033848"} {
+		if err := store.Books.Create(&BookInventory{ISBN: isbn, LibID: library.ID, Title: "Title", TotalCopies: 1, AvailableCopies: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := store.Outbox.After(0, library.ID, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("recorded %d events, want one per book", len(entries))
+	}
+
+	// The first was processed long ago, the second recently and the third
+	// is still waiting to be dispatched.
+	now := time.Now().UTC()
+	for i, processed := range []time.Duration{outboxRetention + time.Hour, time.Hour} {
+		processedAt := now.Add(-processed)
+		entries[i].ProcessedAt = &processedAt
+		if err := store.Outbox.Update(&entries[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a := &app{config: defaultConfig(), store: store}
+	summary, err := pruneOutboxJob(a, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary != "deleted 1 processed events" {
+		t.Errorf("summary = %q", summary)
+	}
+
+	left, err := store.Outbox.After(0, library.ID, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 2 || left[0].ID != entries[1].ID || left[1].ID != entries[2].ID {
+		t.Errorf("kept %+v, want the recent and the pending event", left)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+// postgresSchema mirrors the SQLite tables. Identifiers are left unquoted so
+// PostgreSQL folds them to lower case and the repositories' queries match.
+// ALTER TABLE ... IF NOT EXISTS statements upgrade databases created by
+// earlier releases, the way addColumnIfMissing does for SQLite. The ON DELETE
+// rules of the foreign keys are applied afterwards by postgresForeignKeys.
+var postgresSchema = []string{
+	`CREATE TABLE IF NOT EXISTS library (
+        ID SERIAL PRIMARY KEY,
+        Name TEXT,
+        DeletedAt TIMESTAMPTZ
+    )`,
+	`CREATE TABLE IF NOT EXISTS users (
+        ID SERIAL PRIMARY KEY,
+        Name TEXT,
+        Email TEXT,
+        Contact TEXT,
+        Role TEXT,
+        LibID INTEGER NOT NULL REFERENCES library(ID),
+        Password TEXT,
+        MustChangePassword INTEGER NOT NULL DEFAULT 0,
+        DeletedAt TIMESTAMPTZ
+    )`,
+	`CREATE TABLE IF NOT EXISTS book_inventory (
+        ISBN TEXT PRIMARY KEY,
+        LibID INTEGER NOT NULL REFERENCES library(ID),
+        Title TEXT NOT NULL CHECK (length(trim(Title)) > 0),
+        Authors TEXT,
+        Publisher TEXT,
+        Version TEXT,
+        TotalCopies INTEGER NOT NULL DEFAULT 0 CHECK (TotalCopies >= 0),
+        AvailableCopies INTEGER NOT NULL DEFAULT 0 CHECK (AvailableCopies >= 0),
+        SeriesName TEXT,
+        SeriesNumber INTEGER,
+        Language TEXT,
+        PublicationYear INTEGER,
+        DeletedAt TIMESTAMPTZ,
+        CHECK (AvailableCopies <= TotalCopies)
+    )`,
+	`CREATE TABLE IF NOT EXISTS RequestEvents (
+        ReqID SERIAL PRIMARY KEY,
+        BookID TEXT,
+        ReaderID INTEGER REFERENCES users(ID),
+        RequestDate TIMESTAMPTZ,
+        ApprovalDate TIMESTAMPTZ,
+        ApproverID INTEGER REFERENCES users(ID),
+        RequestType TEXT,
+        Decision TEXT
+    )`,
+	`CREATE TABLE IF NOT EXISTS IssueRegistery (
+        IssueID SERIAL PRIMARY KEY,
+        ISBN TEXT REFERENCES book_inventory(ISBN),
+        ReaderID INTEGER REFERENCES users(ID),
+        IssueApproverID INTEGER REFERENCES users(ID),
+        IssueStatus TEXT,
+        IssueDate TIMESTAMPTZ,
+        ExpectedReturnDate TIMESTAMPTZ,
+        ReturnDate TIMESTAMPTZ,
+        ReturnApproverID INTEGER REFERENCES users(ID)
+    )`,
+	`CREATE TABLE IF NOT EXISTS authors (
+        ID SERIAL PRIMARY KEY,
+        Name TEXT NOT NULL
+    )`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS authors_name_key ON authors (lower(Name))`,
+	`CREATE TABLE IF NOT EXISTS book_authors (
+        ISBN TEXT NOT NULL REFERENCES book_inventory(ISBN),
+        AuthorID INTEGER NOT NULL REFERENCES authors(ID),
+        Position INTEGER NOT NULL DEFAULT 0,
+        PRIMARY KEY (ISBN, AuthorID)
+    )`,
+	`CREATE TABLE IF NOT EXISTS subjects (
+        ID SERIAL PRIMARY KEY,
+        Heading TEXT NOT NULL
+    )`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS subjects_heading_key ON subjects (lower(Heading))`,
+	`CREATE TABLE IF NOT EXISTS book_subjects (
+        ISBN TEXT NOT NULL REFERENCES book_inventory(ISBN),
+        SubjectID INTEGER NOT NULL REFERENCES subjects(ID),
+        PRIMARY KEY (ISBN, SubjectID)
+    )`,
+	`CREATE TABLE IF NOT EXISTS audit_log (
+        ID SERIAL PRIMARY KEY,
+        ActorID INTEGER NOT NULL DEFAULT 0,
+        ActorEmail TEXT NOT NULL DEFAULT '',
+        Action TEXT NOT NULL,
+        Entity TEXT NOT NULL,
+        EntityID TEXT NOT NULL DEFAULT '',
+        Before TEXT,
+        After TEXT,
+        CreatedAt TIMESTAMPTZ NOT NULL
+    )`,
+	`CREATE INDEX IF NOT EXISTS audit_log_entity ON audit_log (Entity, EntityID)`,
+	`CREATE INDEX IF NOT EXISTS audit_log_created ON audit_log (CreatedAt)`,
+	`CREATE OR REPLACE RULE audit_log_no_update AS ON UPDATE TO audit_log DO INSTEAD NOTHING`,
+	`CREATE OR REPLACE RULE audit_log_no_delete AS ON DELETE TO audit_log DO INSTEAD NOTHING`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS Password TEXT`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS MustChangePassword INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE book_inventory ADD COLUMN IF NOT EXISTS SeriesName TEXT`,
+	`ALTER TABLE book_inventory ADD COLUMN IF NOT EXISTS SeriesNumber INTEGER`,
+	`ALTER TABLE book_inventory ADD COLUMN IF NOT EXISTS Language TEXT`,
+	`ALTER TABLE book_inventory ADD COLUMN IF NOT EXISTS PublicationYear INTEGER`,
+	`ALTER TABLE RequestEvents ALTER COLUMN BookID TYPE TEXT USING BookID::text`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS DeletedAt TIMESTAMPTZ`,
+	`ALTER TABLE book_inventory ADD COLUMN IF NOT EXISTS DeletedAt TIMESTAMPTZ`,
+	`ALTER TABLE library ADD COLUMN IF NOT EXISTS DeletedAt TIMESTAMPTZ`,
+	`ALTER TABLE RequestEvents ADD COLUMN IF NOT EXISTS Decision TEXT`,
+	`CREATE TABLE IF NOT EXISTS loan_reminders (
+        IssueID INTEGER NOT NULL REFERENCES IssueRegistery(IssueID) ON DELETE CASCADE,
+        Kind TEXT NOT NULL,
+        SentAt TIMESTAMPTZ NOT NULL,
+        PRIMARY KEY (IssueID, Kind)
+    )`,
+	`CREATE TABLE IF NOT EXISTS job_runs (
+        ID SERIAL PRIMARY KEY,
+        Job TEXT NOT NULL,
+        TriggeredBy TEXT NOT NULL,
+        StartedAt TIMESTAMPTZ NOT NULL,
+        FinishedAt TIMESTAMPTZ NOT NULL,
+        Status TEXT NOT NULL,
+        Summary TEXT NOT NULL DEFAULT ''
+    )`,
+	`CREATE INDEX IF NOT EXISTS job_runs_job ON job_runs (Job, StartedAt)`,
+	`CREATE TABLE IF NOT EXISTS webhooks (
+        ID SERIAL PRIMARY KEY,
+        LibID INTEGER NOT NULL REFERENCES library(ID) ON DELETE RESTRICT,
+        URL TEXT NOT NULL,
+        Events TEXT NOT NULL,
+        Secret TEXT NOT NULL,
+        CreatedAt TIMESTAMPTZ NOT NULL
+    )`,
+	`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+        ID SERIAL PRIMARY KEY,
+        WebhookID INTEGER NOT NULL REFERENCES webhooks(ID) ON DELETE CASCADE,
+        Event TEXT NOT NULL,
+        Payload TEXT NOT NULL,
+        Status TEXT NOT NULL,
+        Attempts INTEGER NOT NULL DEFAULT 0,
+        ResponseStatus INTEGER NOT NULL DEFAULT 0,
+        Error TEXT NOT NULL DEFAULT '',
+        CreatedAt TIMESTAMPTZ NOT NULL,
+        NextAttemptAt TIMESTAMPTZ NOT NULL,
+        DeliveredAt TIMESTAMPTZ
+    )`,
+	`CREATE INDEX IF NOT EXISTS webhook_deliveries_due ON webhook_deliveries (Status, NextAttemptAt)`,
+	`CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook ON webhook_deliveries (WebhookID, ID)`,
+	`ALTER TABLE webhook_deliveries ADD COLUMN IF NOT EXISTS OutboxID INTEGER`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS webhook_deliveries_outbox ON webhook_deliveries (OutboxID, WebhookID)`,
+	`CREATE TABLE IF NOT EXISTS outbox (
+        ID SERIAL PRIMARY KEY,
+        Event TEXT NOT NULL,
+        LibID INTEGER NOT NULL DEFAULT 0,
+        Data TEXT NOT NULL,
+        CreatedAt TIMESTAMPTZ NOT NULL,
+        Attempts INTEGER NOT NULL DEFAULT 0,
+        LastError TEXT NOT NULL DEFAULT '',
+        NextAttemptAt TIMESTAMPTZ NOT NULL,
+        ProcessedAt TIMESTAMPTZ
+    )`,
+	`CREATE INDEX IF NOT EXISTS outbox_due ON outbox (ProcessedAt, NextAttemptAt)`,
+	`CREATE TABLE IF NOT EXISTS notification_preferences (
+        UserID INTEGER NOT NULL REFERENCES users(ID) ON DELETE CASCADE,
+        Event TEXT NOT NULL,
+        Channel TEXT NOT NULL,
+        PRIMARY KEY (UserID, Event)
+    )`,
+	`CREATE TABLE IF NOT EXISTS notifications (
+        ID SERIAL PRIMARY KEY,
+        UserID INTEGER NOT NULL REFERENCES users(ID) ON DELETE CASCADE,
+        Event TEXT NOT NULL,
+        Subject TEXT NOT NULL,
+        Body TEXT NOT NULL,
+        CreatedAt TIMESTAMPTZ NOT NULL,
+        ReadAt TIMESTAMPTZ
+    )`,
+	`CREATE INDEX IF NOT EXISTS notifications_user ON notifications (UserID, ID)`,
+}
+
+func migratePostgres(conn *dbConn) error {
+	for _, stmt := range postgresSchema {
+		if _, err := conn.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	if err := cleanupZeroReferences(conn); err != nil {
+		return err
+	}
+	if _, err := conn.Exec(backfillDecisionSQL, requestDecisionApproved); err != nil {
+		return err
+	}
+	for _, stmt := range postgresForeignKeys() {
+		if _, err := conn.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
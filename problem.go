@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Error codes say what went wrong independently of the wording of the detail,
+// so clients can branch on them. They are part of the API: add new ones, but
+// never rename or reuse one.
+const (
+	codeInvalidRequest         = "invalid_request"
+	codeUnauthorized           = "unauthorized"
+	codeForbidden              = "forbidden"
+	codePasswordChangeRequired = "password_change_required"
+	codeNotFound               = "not_found"
+	codeAlreadyExists          = "already_exists"
+	codeDeleted                = "deleted"
+	codeOpenLoans              = "open_loans"
+	codeAlreadyDecided         = "request_already_decided"
+	codeNoCopiesAvailable      = "no_copies_available"
+	codeLoanLimitReached       = "loan_limit_reached"
+	codeNoOpenLoan             = "no_open_loan"
+	codeCopiesOnLoan           = "copies_on_loan"
+	codePayloadTooLarge        = "payload_too_large"
+	codeValidationFailed       = "validation_failed"
+	codeInvalidReference       = "invalid_reference"
+	codeUnknownRequestType     = "unknown_request_type"
+	codeInternal               = "internal_error"
+	codeNotImplemented         = "not_implemented"
+	codeUpstreamFailed         = "upstream_failed"
+)
+
+// problemTypePrefix turns a code into the problem type URI.
+const problemTypePrefix = "urn:library:problem:"
+
+// APIError is an error reported to the client as an RFC 7807 problem
+// document. Detail is shown to people; Fields lists rejected request fields
+// and Extensions adds members to the document.
+type APIError struct {
+	Status     int
+	Code       string
+	Detail     string
+	Fields     ValidationErrors
+	Extensions map[string]interface{}
+	Err        error
+}
+
+func (e *APIError) Error() string {
+	return e.Detail
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+func newAPIError(status int, code, detail string) *APIError {
+	return &APIError{Status: status, Code: code, Detail: detail}
+}
+
+// with adds a member to the problem document.
+func (e *APIError) with(key string, value interface{}) *APIError {
+	if e.Extensions == nil {
+		e.Extensions = map[string]interface{}{}
+	}
+	e.Extensions[key] = value
+	return e
+}
+
+func badRequest(detail string) *APIError {
+	return newAPIError(http.StatusBadRequest, codeInvalidRequest, detail)
+}
+
+func notFoundError(detail string) *APIError {
+	return newAPIError(http.StatusNotFound, codeNotFound, detail)
+}
+
+func invalidReference(detail string) *APIError {
+	return newAPIError(http.StatusUnprocessableEntity, codeInvalidReference, detail)
+}
+
+func validationError(fields ValidationErrors) *APIError {
+	return &APIError{Status: http.StatusUnprocessableEntity, Code: codeValidationFailed, Detail: fields.Error(), Fields: fields, Err: fields}
+}
+
+// fieldError rejects a single request field.
+func fieldError(field, message string) *APIError {
+	return validationError(ValidationErrors{{Field: field, Message: message}})
+}
+
+// domainErrors maps the sentinel errors of the repositories and the
+// circulation rules. Their messages are written for clients and become the
+// detail.
+var domainErrors = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{errNotFound, http.StatusNotFound, codeNotFound},
+	{errDeleted, http.StatusConflict, codeDeleted},
+	{errAlreadyDecided, http.StatusConflict, codeAlreadyDecided},
+	{errNoCopiesAvailable, http.StatusConflict, codeNoCopiesAvailable},
+	{errLoanLimitReached, http.StatusConflict, codeLoanLimitReached},
+	{errNoOpenLoan, http.StatusConflict, codeNoOpenLoan},
+	{errCopiesOnLoan, http.StatusConflict, codeCopiesOnLoan},
+	{errUnknownRequestType, http.StatusUnprocessableEntity, codeUnknownRequestType},
+	{errInvalidReference, http.StatusUnprocessableEntity, codeInvalidReference},
+	{errBackupUnsupported, http.StatusNotImplemented, codeNotImplemented},
+}
+
+// classifyError returns the APIError describing err, or nil when err is not
+// one the client should see.
+func classifyError(err error) *APIError {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	var fields ValidationErrors
+	if errors.As(err, &fields) {
+		return validationError(fields)
+	}
+	for _, d := range domainErrors {
+		if errors.Is(err, d.err) {
+			return &APIError{Status: d.status, Code: d.code, Detail: d.err.Error(), Err: err}
+		}
+	}
+	if isUniqueViolation(err) {
+		return &APIError{Status: http.StatusConflict, Code: codeAlreadyExists, Detail: "a record with the same key already exists", Err: err}
+	}
+	return nil
+}
+
+// respondError answers err as an application/problem+json document and aborts
+// the request. Unexpected errors are logged with the request's context and
+// reported as internal_error without their message; the request ID in the
+// document lets the two be matched up.
+func respondError(c *gin.Context, err error) {
+	apiErr := classifyError(err)
+	if apiErr == nil {
+		requestLog(c).Error("request failed", "method", c.Request.Method, "route", c.FullPath(), "err", err)
+		apiErr = newAPIError(http.StatusInternalServerError, codeInternal, "Internal server error")
+	}
+	writeProblem(c, apiErr)
+}
+
+func writeProblem(c *gin.Context, e *APIError) {
+	problem := map[string]interface{}{}
+	for key, value := range e.Extensions {
+		problem[key] = value
+	}
+	problem["type"] = problemTypePrefix + e.Code
+	problem["title"] = http.StatusText(e.Status)
+	problem["status"] = e.Status
+	problem["code"] = e.Code
+	problem["instance"] = c.Request.URL.Path
+	if e.Detail != "" {
+		problem["detail"] = e.Detail
+	}
+	if len(e.Fields) > 0 {
+		problem["fields"] = e.Fields
+	}
+	if id := c.GetString(requestIDKey); id != "" {
+		problem["requestID"] = id
+	}
+
+	body, err := json.Marshal(problem)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.Abort()
+	c.Data(e.Status, "application/problem+json", body)
+}
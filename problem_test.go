@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+type problemDocument struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Code      string       `json:"code"`
+	Detail    string       `json:"detail"`
+	Instance  string       `json:"instance"`
+	Fields    []FieldError `json:"fields"`
+	RequestID string       `json:"requestID"`
+	Limit     int          `json:"limit"`
+}
+
+func TestRespondErrorDocuments(t *testing.T) {
+	store, _ := newTestStore(t)
+	_, _, book := seedLibrary(t, store, 1)
+	duplicate := store.Books.Create(&BookInventory{ISBN: book.ISBN, LibID: book.LibID, Title: "Again"})
+	captureLogs(t)
+
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+		detail string
+	}{
+		{"api error", badRequest("Invalid limit").with("limit", 5), http.StatusBadRequest, codeInvalidRequest, "Invalid limit"},
+		{"wrapped domain error", fmt.Errorf("approving request 3: %w", errNoCopiesAvailable), http.StatusConflict, codeNoCopiesAvailable, errNoCopiesAvailable.Error()},
+		{"not found", errNotFound, http.StatusNotFound, codeNotFound, errNotFound.Error()},
+		{"validation", ValidationErrors{{Field: "title", Message: "is required"}}, http.StatusUnprocessableEntity, codeValidationFailed, "validation failed: title: is required"},
+		{"unique violation", duplicate, http.StatusConflict, codeAlreadyExists, "a record with the same key already exists"},
+		{"unexpected", errors.New("connection to 10.0.0.5 refused"), http.StatusInternalServerError, codeInternal, "Internal server error"},
+	}
+
+	gin.SetMode(gin.TestMode)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.New()
+			router.Use(requestIDMiddleware())
+			router.GET("/things/:id", func(c *gin.Context) { respondError(c, tt.err) })
+			req := httptest.NewRequest(http.MethodGet, "/things/3", nil)
+			req.Header.Set(requestIDHeader, "req-1")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.status || w.Header().Get("Content-Type") != "application/problem+json" {
+				t.Fatalf("answered %d %s, want %d application/problem+json", w.Code, w.Header().Get("Content-Type"), tt.status)
+			}
+			var doc problemDocument
+			if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+				t.Fatal(err)
+			}
+			// Members specific to one error are checked below
+			doc.Fields, doc.Limit = nil, 0
+			want := problemDocument{Type: problemTypePrefix + tt.code, Title: http.StatusText(tt.status), Status: tt.status, Code: tt.code,
+				Detail: tt.detail, Instance: "/things/3", RequestID: "req-1"}
+			if !reflect.DeepEqual(doc, want) {
+				t.Errorf("document = %+v, want %+v", doc, want)
+			}
+			if strings.Contains(w.Body.String(), "10.0.0.5") {
+				t.Error("the message of an unexpected error reached the client")
+			}
+		})
+	}
+
+	t.Run("members", func(t *testing.T) {
+		for _, tt := range []struct {
+			err   error
+			check func(problemDocument) bool
+		}{
+			{badRequest("Invalid limit").with("limit", 5), func(doc problemDocument) bool { return doc.Limit == 5 }},
+			{fieldError("title", "is required"), func(doc problemDocument) bool {
+				return len(doc.Fields) == 1 && doc.Fields[0] == FieldError{Field: "title", Message: "is required"}
+			}},
+		} {
+			w := serveAs(&User{}, "/", func(c *gin.Context) { respondError(c, tt.err) }, http.MethodGet, "/", "")
+			var doc problemDocument
+			if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+				t.Fatal(err)
+			}
+			if !tt.check(doc) {
+				t.Errorf("%v: document %s lacks its member", tt.err, w.Body.String())
+			}
+		}
+	})
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// errNotFound is returned by repositories when the requested row does not
+// exist or has been deleted.
+var errNotFound = errors.New("not found")
+
+// errDeleted is returned when creating a row whose key belongs to a deleted
+// row; that row has to be restored instead.
+var errDeleted = errors.New("deleted")
+
+// Users, libraries and books are soft deleted: Delete only sets DeletedAt,
+// every other method except Restore and ListDeleted ignores deleted rows, and
+// Restore brings a row back.
+
+type UserRepository interface {
+	Create(user *User) error
+	Get(id int) (*User, error)
+	GetByEmail(email string) (*User, error)
+	Update(user *User) error
+	// SetPassword stores a password hash and whether it must be changed at
+	// the next login.
+	SetPassword(id int, hash string, mustChange bool) error
+	Delete(id int) error
+	Restore(id int) error
+	List() ([]User, error)
+	ListDeleted() ([]User, error)
+	ListByRole(role string) ([]User, error)
+}
+
+type LibraryRepository interface {
+	Create(library *Library) error
+	Get(id int) (*Library, error)
+	Exists(id int) (bool, error)
+	Update(library *Library) error
+	// Delete also deletes the library's books and its users other than
+	// owners. Restore brings back the ones deleted along with it.
+	Delete(id int) error
+	Restore(id int) error
+	List() ([]Library, error)
+	ListDeleted() ([]Library, error)
+}
+
+// BookFilter narrows catalog listings. Zero values mean "no restriction".
+// Deleted books are left out unless Deleted is set, which lists only them.
+type BookFilter struct {
+	LibID    int
+	Author   string
+	Subject  string
+	Series   string
+	Language string
+	Year     int
+	YearFrom int
+	YearTo   int
+	Deleted  bool
+}
+
+// BookRepository stores BookInventory rows together with their author and
+// subject links.
+type BookRepository interface {
+	Create(book *BookInventory) error
+	Get(isbn string) (*BookInventory, error)
+	// Update ignores book.AvailableCopies, which only circulation changes.
+	// A change of TotalCopies moves AvailableCopies by the same amount and
+	// fails with errCopiesOnLoan if that would leave it negative. On success
+	// book.AvailableCopies holds the stored value.
+	Update(book *BookInventory) error
+	Delete(isbn string) error
+	Restore(isbn string) error
+	List(filter BookFilter) ([]BookInventory, error)
+	// ForEach calls fn for every book of a library without loading the whole
+	// catalog into memory. Iteration stops at the first error fn returns.
+	ForEach(libID int, fn func(book *BookInventory) error) error
+	ListAuthors() ([]Author, error)
+	ListSubjects() ([]Subject, error)
+	// Reindex rebuilds every book's author links from its Authors column,
+	// drops authors and subjects no book refers to and refreshes the
+	// database's indexes. It returns the number of books processed.
+	Reindex() (int, error)
+}
+
+type RequestEventRepository interface {
+	Create(event *RequestEvent) error
+	Get(id int) (*RequestEvent, error)
+	Update(event *RequestEvent) error
+	Delete(id int) error
+	List() ([]RequestEvent, error)
+}
+
+// LoanFilter selects open loans by book, reader or library. Zero values mean
+// "no restriction".
+type LoanFilter struct {
+	ISBN     string
+	ReaderID int
+	LibID    int
+}
+
+type IssueRepository interface {
+	Create(issue *IssueRegistery) error
+	Get(id int) (*IssueRegistery, error)
+	Update(issue *IssueRegistery) error
+	Delete(id int) error
+	List() ([]IssueRegistery, error)
+	// MarkOverdue flags open loans whose ExpectedReturnDate is before now and
+	// returns the loans it changed.
+	MarkOverdue(now time.Time) ([]IssueRegistery, error)
+	// CountOpen counts loans that are issued or overdue.
+	CountOpen(filter LoanFilter) (int, error)
+	// PendingReminders lists loans in status that are due before dueBefore
+	// and have not had a reminder of kind yet.
+	PendingReminders(kind, status string, dueBefore time.Time) ([]IssueRegistery, error)
+	// ClaimReminder records that a reminder of kind is being sent for a loan.
+	// It returns false if one was already recorded, so that concurrent runs
+	// do not both send it.
+	ClaimReminder(issueID int, kind string, now time.Time) (bool, error)
+	// ReleaseReminder forgets a claim whose reminder could not be delivered.
+	ReleaseReminder(issueID int, kind string) error
+}
+
+// CirculationRepository moves copies in and out of the shelves. Each call runs
+// in one transaction and changes AvailableCopies with a conditional update, so
+// concurrent approvals cannot lend the same copy twice.
+type CirculationRepository interface {
+	// Approve approves a pending request. An issue request takes a copy and
+	// opens a loan due policy.LoanDays after now; a return request closes the
+	// reader's open loan of the book and puts the copy back. It returns the
+	// loan that was opened or closed.
+	Approve(reqID, approverID int, now time.Time, policy CirculationConfig) (*IssueRegistery, error)
+	// Reject declines a pending request and returns it. The reason is passed
+	// on to the reader.
+	Reject(reqID, approverID int, reason string, now time.Time) (*RequestEvent, error)
+}
+
+// AuditRepository is append-only: entries can be recorded and queried but
+// never changed.
+type AuditRepository interface {
+	Record(entry *AuditEntry) error
+	List(filter AuditFilter) ([]AuditEntry, error)
+}
+
+// WebhookRepository stores webhook registrations and their delivery log.
+type WebhookRepository interface {
+	Create(hook *Webhook) error
+	Get(id int) (*Webhook, error)
+	Delete(id int) error
+	// List returns the webhooks of libID, or of every library when it is 0.
+	List(libID int) ([]Webhook, error)
+	// Enqueue queues a delivery of payload to every webhook of libID
+	// subscribed to event and returns how many were queued. Deliveries
+	// already queued for outboxID are not queued again. Events of library
+	// 0, which belong to no library, are delivered to no webhook.
+	Enqueue(outboxID int, event string, libID int, payload []byte, now time.Time) (int, error)
+	// DueDeliveries returns up to limit pending deliveries whose next attempt
+	// is due, with the URL and secret of their webhook filled in.
+	DueDeliveries(now time.Time, limit int) ([]WebhookDelivery, error)
+	// UpdateDelivery stores the outcome of an attempt.
+	UpdateDelivery(delivery *WebhookDelivery) error
+	// ListDeliveries returns the newest deliveries of a webhook first.
+	ListDeliveries(webhookID, limit int) ([]WebhookDelivery, error)
+}
+
+// NotificationRepository stores notification preferences and the in-app
+// inbox. Notifications of one user are only reachable through that user's ID.
+type NotificationRepository interface {
+	// Preferences returns the channels a user has chosen, by event. Events
+	// left at the default are missing.
+	Preferences(userID int) (map[string]string, error)
+	SetPreferences(userID int, prefs map[string]string) error
+	Create(n *Notification) error
+	// List returns the newest notifications of a user first.
+	List(userID int, unreadOnly bool, limit int) ([]Notification, error)
+	MarkRead(userID, id int, now time.Time) error
+	// MarkAllRead returns how many notifications were unread.
+	MarkAllRead(userID int, now time.Time) (int, error)
+}
+
+// StatsRepository answers the reporting queries behind CirculationReport.
+// Periods are [from, end); loans and requests belong to the library of their
+// book.
+type StatsRepository interface {
+	// Loans returns the loans that were open at any time in the period.
+	Loans(libID int, from, end time.Time) ([]IssueRegistery, error)
+	// TopTitles returns the most borrowed books of the period, most loans first.
+	TopTitles(libID int, from, end time.Time, limit int) ([]TitleCount, error)
+	Requests(libID int, from, end time.Time) (RequestStats, error)
+	// TotalCopies sums TotalCopies over the books that are not deleted.
+	TotalCopies(libID int) (int, error)
+	// Circulation returns the current figures of every library that is not
+	// deleted.
+	Circulation(now time.Time) ([]LibraryCirculation, error)
+}
+
+// OutboxRepository holds domain events recorded by the other repositories in
+// the same transaction as the change they describe. See OutboxDispatcher.
+type OutboxRepository interface {
+	// Due returns up to limit unprocessed entries whose next attempt is due,
+	// oldest first.
+	Due(now time.Time, limit int) ([]OutboxEntry, error)
+	// Update stores the outcome of an attempt.
+	Update(entry *OutboxEntry) error
+	// Prune deletes entries processed before cutoff and returns how many.
+	Prune(cutoff time.Time) (int, error)
+	// After returns up to limit entries of libID recorded after afterID,
+	// processed or not, oldest first.
+	After(afterID, libID, limit int) ([]OutboxEntry, error)
+}
+
+// JobRunRepository keeps the outcome of every maintenance job run.
+type JobRunRepository interface {
+	Record(run *JobRun) error
+	// Latest returns the most recent run of job, or errNotFound.
+	Latest(job string) (*JobRun, error)
+}
+
+// Store groups the repositories handed to the HTTP handlers and CLI commands.
+type Store struct {
+	Users         UserRepository
+	Libraries     LibraryRepository
+	Books         BookRepository
+	RequestEvents RequestEventRepository
+	Issues        IssueRepository
+	Circulation   CirculationRepository
+	Audit         AuditRepository
+	JobRuns       JobRunRepository
+	Webhooks      WebhookRepository
+	Outbox        OutboxRepository
+	Notifications NotificationRepository
+	Stats         StatsRepository
+
+	atomic func(fn func(tx *Store) error) error
+}
+
+// Atomic runs fn with a Store whose repositories share one transaction. It is
+// committed when fn returns nil and rolled back otherwise. Repository methods
+// that use a transaction of their own join this one.
+func (s *Store) Atomic(fn func(tx *Store) error) error {
+	return s.atomic(fn)
+}
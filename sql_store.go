@@ -0,0 +1,1617 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// NewSQLStore returns repositories backed by db. The same implementation
+// serves SQLite and PostgreSQL; the connection's dialect covers the differences.
+func NewSQLStore(db sqlExecutor) *Store {
+	return &Store{
+		atomic: func(fn func(tx *Store) error) error {
+			return db.InTx(func(tx *dbTx) error {
+				return fn(NewSQLStore(tx))
+			})
+		},
+		Users:         &sqlUserRepository{db: db},
+		Libraries:     &sqlLibraryRepository{db: db},
+		Books:         &sqlBookRepository{db: db},
+		RequestEvents: &sqlRequestEventRepository{db: db},
+		Issues:        &sqlIssueRepository{db: db},
+		Circulation:   &sqlCirculationRepository{db: db},
+		Audit:         &sqlAuditRepository{db: db},
+		JobRuns:       &sqlJobRunRepository{db: db},
+		Webhooks:      &sqlWebhookRepository{db: db},
+		Outbox:        &sqlOutboxRepository{db: db},
+		Notifications: &sqlNotificationRepository{db: db},
+		Stats:         &sqlStatsRepository{db: db},
+	}
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// checkAffected turns an UPDATE or DELETE that matched nothing into errNotFound.
+func checkAffected(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+// nullTime converts a nullable column into the *time.Time used for DeletedAt.
+func nullTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// nullID stores 0, the zero value of an optional reference, as NULL so that
+// foreign keys accept it.
+func nullID(id int) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+func nullString(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	return value
+}
+
+func notFound(err error) error {
+	if err == sql.ErrNoRows {
+		return errNotFound
+	}
+	return err
+}
+
+// Users
+
+type sqlUserRepository struct {
+	db sqlExecutor
+}
+
+const userColumns = `ID, COALESCE(Name, ''), COALESCE(Email, ''), COALESCE(Contact, ''), COALESCE(Role, ''), LibID, COALESCE(Password, ''), MustChangePassword, DeletedAt`
+
+func scanUser(row rowScanner, user *User) error {
+	var mustChange int
+	var deletedAt sql.NullTime
+	if err := row.Scan(&user.ID, &user.Name, &user.Email, &user.Contact, &user.Role, &user.LibID, &user.Password, &mustChange, &deletedAt); err != nil {
+		return err
+	}
+	user.MustChangePassword = mustChange != 0
+	user.DeletedAt = nullTime(deletedAt)
+	return nil
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (r *sqlUserRepository) Create(user *User) error {
+	id, err := r.db.InsertID("ID", "INSERT INTO users (Name, Email, Contact, Role, LibID, Password, MustChangePassword) VALUES (?,?,?,?,?,?,?)", user.Name, user.Email, user.Contact, user.Role, user.LibID, user.Password, boolInt(user.MustChangePassword))
+	if err != nil {
+		return referenceError(err)
+	}
+	user.ID = id
+	return nil
+}
+
+func (r *sqlUserRepository) Get(id int) (*User, error) {
+	var user User
+	if err := scanUser(r.db.QueryRow("SELECT "+userColumns+" FROM users WHERE ID =? AND DeletedAt IS NULL", id), &user); err != nil {
+		return nil, notFound(err)
+	}
+	return &user, nil
+}
+
+func (r *sqlUserRepository) GetByEmail(email string) (*User, error) {
+	var user User
+	if err := scanUser(r.db.QueryRow("SELECT "+userColumns+" FROM users WHERE Email =? AND DeletedAt IS NULL", email), &user); err != nil {
+		return nil, notFound(err)
+	}
+	return &user, nil
+}
+
+// Update leaves the password untouched; it is not part of the public user payload.
+func (r *sqlUserRepository) Update(user *User) error {
+	return referenceError(checkAffected(r.db.Exec("UPDATE users SET Name =?, Email =?, Contact =?, Role =?, LibID =? WHERE ID =? AND DeletedAt IS NULL", user.Name, user.Email, user.Contact, user.Role, user.LibID, user.ID)))
+}
+
+func (r *sqlUserRepository) SetPassword(id int, hash string, mustChange bool) error {
+	return checkAffected(r.db.Exec("UPDATE users SET Password =?, MustChangePassword =? WHERE ID =? AND DeletedAt IS NULL", hash, boolInt(mustChange), id))
+}
+
+func (r *sqlUserRepository) ListByRole(role string) ([]User, error) {
+	rows, err := r.db.Query("SELECT "+userColumns+" FROM users WHERE lower(Role) = lower(?) AND DeletedAt IS NULL", role)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var user User
+		if err := scanUser(rows, &user); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (r *sqlUserRepository) Delete(id int) error {
+	return checkAffected(r.db.Exec("UPDATE users SET DeletedAt =? WHERE ID =? AND DeletedAt IS NULL", time.Now().UTC(), id))
+}
+
+func (r *sqlUserRepository) Restore(id int) error {
+	return checkAffected(r.db.Exec("UPDATE users SET DeletedAt = NULL WHERE ID =? AND DeletedAt IS NOT NULL", id))
+}
+
+func (r *sqlUserRepository) List() ([]User, error) {
+	return r.list("DeletedAt IS NULL")
+}
+
+func (r *sqlUserRepository) ListDeleted() ([]User, error) {
+	return r.list("DeletedAt IS NOT NULL")
+}
+
+func (r *sqlUserRepository) list(where string) ([]User, error) {
+	rows, err := r.db.Query("SELECT " + userColumns + " FROM users WHERE " + where)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var user User
+		if err := scanUser(rows, &user); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// Libraries
+
+type sqlLibraryRepository struct {
+	db sqlExecutor
+}
+
+func (r *sqlLibraryRepository) Create(library *Library) error {
+	id, err := r.db.InsertID("ID", "INSERT INTO library (Name) VALUES (?)", library.Name)
+	if err != nil {
+		return err
+	}
+	library.ID = id
+	return nil
+}
+
+func (r *sqlLibraryRepository) Get(id int) (*Library, error) {
+	var library Library
+	err := r.db.QueryRow("SELECT ID, COALESCE(Name, '') FROM library WHERE ID =? AND DeletedAt IS NULL", id).Scan(&library.ID, &library.Name)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &library, nil
+}
+
+func (r *sqlLibraryRepository) Exists(id int) (bool, error) {
+	var count int
+	err := r.db.QueryRow("SELECT COUNT(*) FROM library WHERE ID =? AND DeletedAt IS NULL", id).Scan(&count)
+	return count > 0, err
+}
+
+func (r *sqlLibraryRepository) Update(library *Library) error {
+	return checkAffected(r.db.Exec("UPDATE library SET Name =? WHERE ID =? AND DeletedAt IS NULL", library.Name, library.ID))
+}
+
+// Delete stamps the books and users with the library's DeletedAt, which is how
+// Restore tells them from rows deleted on their own.
+func (r *sqlLibraryRepository) Delete(id int) error {
+	now := time.Now().UTC()
+	return r.db.InTx(func(tx *dbTx) error {
+		if err := checkAffected(tx.Exec("UPDATE library SET DeletedAt =? WHERE ID =? AND DeletedAt IS NULL", now, id)); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE book_inventory SET DeletedAt =? WHERE LibID =? AND DeletedAt IS NULL", now, id); err != nil {
+			return err
+		}
+		_, err := tx.Exec("UPDATE users SET DeletedAt =? WHERE LibID =? AND DeletedAt IS NULL AND LOWER(Role) <> ?", now, id, defaultOwnerRole)
+		return err
+	})
+}
+
+func (r *sqlLibraryRepository) Restore(id int) error {
+	return r.db.InTx(func(tx *dbTx) error {
+		for _, table := range []string{"book_inventory", "users"} {
+			if _, err := tx.Exec("UPDATE "+table+" SET DeletedAt = NULL WHERE LibID =? AND DeletedAt = (SELECT DeletedAt FROM library WHERE ID =?)", id, id); err != nil {
+				return err
+			}
+		}
+		return checkAffected(tx.Exec("UPDATE library SET DeletedAt = NULL WHERE ID =? AND DeletedAt IS NOT NULL", id))
+	})
+}
+
+func (r *sqlLibraryRepository) List() ([]Library, error) {
+	return r.list("DeletedAt IS NULL")
+}
+
+func (r *sqlLibraryRepository) ListDeleted() ([]Library, error) {
+	return r.list("DeletedAt IS NOT NULL")
+}
+
+func (r *sqlLibraryRepository) list(where string) ([]Library, error) {
+	rows, err := r.db.Query("SELECT ID, COALESCE(Name, ''), DeletedAt FROM library WHERE " + where)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var libraries []Library
+	for rows.Next() {
+		var library Library
+		var deletedAt sql.NullTime
+		if err := rows.Scan(&library.ID, &library.Name, &deletedAt); err != nil {
+			return nil, err
+		}
+		library.DeletedAt = nullTime(deletedAt)
+		libraries = append(libraries, library)
+	}
+	return libraries, rows.Err()
+}
+
+// BookInventory
+
+type sqlBookRepository struct {
+	db sqlExecutor
+}
+
+// bookColumns lists book_inventory columns in the order scanBook expects.
+// Columns added by later migrations are NULL on old rows, hence the COALESCEs.
+const bookColumns = `ISBN, LibID, COALESCE(Title, ''), COALESCE(Authors, ''), COALESCE(Publisher, ''), COALESCE(Version, ''), TotalCopies, AvailableCopies,
+	COALESCE(SeriesName, ''), COALESCE(SeriesNumber, 0), COALESCE(Language, ''), COALESCE(PublicationYear, 0), DeletedAt`
+
+func scanBook(row rowScanner, book *BookInventory) error {
+	var deletedAt sql.NullTime
+	if err := row.Scan(&book.ISBN, &book.LibID, &book.Title, &book.Authors, &book.Publisher, &book.Version, &book.TotalCopies, &book.AvailableCopies,
+		&book.SeriesName, &book.SeriesNumber, &book.Language, &book.PublicationYear, &deletedAt); err != nil {
+		return err
+	}
+	book.DeletedAt = nullTime(deletedAt)
+	return nil
+}
+
+func (r *sqlBookRepository) Create(book *BookInventory) error {
+	var deleted int
+	if err := r.db.QueryRow("SELECT COUNT(*) FROM book_inventory WHERE ISBN =? AND DeletedAt IS NOT NULL", book.ISBN).Scan(&deleted); err != nil {
+		return err
+	}
+	if deleted > 0 {
+		return errDeleted
+	}
+
+	return r.db.InTx(func(tx *dbTx) error {
+		_, err := tx.Exec(`
+	INSERT INTO book_inventory (ISBN, LibID, Title, Authors, Publisher, Version, TotalCopies, AvailableCopies, SeriesName, SeriesNumber, Language, PublicationYear)
+	VALUES (?,?,?,?,?,?,?,?,?,?,?,?)
+`, book.ISBN, book.LibID, book.Title, book.Authors, book.Publisher, book.Version, book.TotalCopies, book.AvailableCopies, book.SeriesName, book.SeriesNumber, book.Language, book.PublicationYear)
+		if err != nil {
+			return err
+		}
+		if err := (&sqlBookRepository{db: tx}).syncMetadata(book); err != nil {
+			return err
+		}
+		return recordEvent(tx, eventBookCreated, book.LibID, book)
+	})
+}
+
+func (r *sqlBookRepository) Get(isbn string) (*BookInventory, error) {
+	var book BookInventory
+	if err := scanBook(r.db.QueryRow("SELECT "+bookColumns+" FROM book_inventory WHERE ISBN =? AND DeletedAt IS NULL", isbn), &book); err != nil {
+		return nil, notFound(err)
+	}
+	if err := r.loadMetadata(&book); err != nil {
+		return nil, err
+	}
+	return &book, nil
+}
+
+func (r *sqlBookRepository) Update(book *BookInventory) error {
+	return r.db.InTx(func(tx *dbTx) error {
+		return (&sqlBookRepository{db: tx}).update(book)
+	})
+}
+
+func (r *sqlBookRepository) update(book *BookInventory) error {
+	err := checkAffected(r.db.Exec(`UPDATE book_inventory SET LibID =?, Title =?, Authors =?, Publisher =?, Version =?,
+		AvailableCopies = AvailableCopies + (? - TotalCopies), TotalCopies =?, SeriesName =?, SeriesNumber =?, Language =?, PublicationYear =?
+		WHERE ISBN =? AND DeletedAt IS NULL AND AvailableCopies + (? - TotalCopies) >= 0`,
+		book.LibID, book.Title, book.Authors, book.Publisher, book.Version, book.TotalCopies, book.TotalCopies, book.SeriesName, book.SeriesNumber, book.Language, book.PublicationYear, book.ISBN, book.TotalCopies))
+	if errors.Is(err, errNotFound) {
+		if _, getErr := r.Get(book.ISBN); getErr == nil {
+			return errCopiesOnLoan
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := r.db.QueryRow("SELECT AvailableCopies FROM book_inventory WHERE ISBN =?", book.ISBN).Scan(&book.AvailableCopies); err != nil {
+		return err
+	}
+	return r.syncMetadata(book)
+}
+
+// Delete keeps the author and subject links so Restore brings them back.
+func (r *sqlBookRepository) Delete(isbn string) error {
+	return checkAffected(r.db.Exec("UPDATE book_inventory SET DeletedAt =? WHERE ISBN =? AND DeletedAt IS NULL", time.Now().UTC(), isbn))
+}
+
+func (r *sqlBookRepository) Restore(isbn string) error {
+	return checkAffected(r.db.Exec("UPDATE book_inventory SET DeletedAt = NULL WHERE ISBN =? AND DeletedAt IS NOT NULL", isbn))
+}
+
+func (r *sqlBookRepository) List(filter BookFilter) ([]BookInventory, error) {
+	where, args := bookFilterSQL(filter)
+	rows, err := r.db.Query("SELECT "+bookColumns+" FROM book_inventory"+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var books []BookInventory
+	for rows.Next() {
+		var book BookInventory
+		if err := scanBook(rows, &book); err != nil {
+			return nil, err
+		}
+		books = append(books, book)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for i := range books {
+		if err := r.loadMetadata(&books[i]); err != nil {
+			return nil, err
+		}
+	}
+	return books, nil
+}
+
+func (r *sqlBookRepository) ForEach(libID int, fn func(book *BookInventory) error) error {
+	rows, err := r.db.Query("SELECT "+bookColumns+" FROM book_inventory WHERE LibID =? AND DeletedAt IS NULL ORDER BY ISBN", libID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var book BookInventory
+		if err := scanBook(rows, &book); err != nil {
+			return err
+		}
+		if err := r.loadMetadata(&book); err != nil {
+			return err
+		}
+		if err := fn(&book); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (r *sqlBookRepository) ListAuthors() ([]Author, error) {
+	rows, err := r.db.Query("SELECT ID, Name FROM authors ORDER BY lower(Name)")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var authors []Author
+	for rows.Next() {
+		var author Author
+		if err := rows.Scan(&author.ID, &author.Name); err != nil {
+			return nil, err
+		}
+		authors = append(authors, author)
+	}
+	return authors, rows.Err()
+}
+
+func (r *sqlBookRepository) ListSubjects() ([]Subject, error) {
+	rows, err := r.db.Query("SELECT ID, Heading FROM subjects ORDER BY lower(Heading)")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subjects []Subject
+	for rows.Next() {
+		var subject Subject
+		if err := rows.Scan(&subject.ID, &subject.Heading); err != nil {
+			return nil, err
+		}
+		subjects = append(subjects, subject)
+	}
+	return subjects, rows.Err()
+}
+
+func (r *sqlBookRepository) Reindex() (int, error) {
+	// Collect the books first: rewriting links while a SELECT is still open
+	// would hold SQLite's read lock against our own writes.
+	books, err := r.List(BookFilter{})
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range books {
+		books[i].AuthorList = nil
+		err := r.db.InTx(func(tx *dbTx) error {
+			return (&sqlBookRepository{db: tx}).syncMetadata(&books[i])
+		})
+		if err != nil {
+			return i, fmt.Errorf("reindexing %s: %w", books[i].ISBN, err)
+		}
+	}
+
+	cleanup := []string{
+		"DELETE FROM authors WHERE ID NOT IN (SELECT AuthorID FROM book_authors)",
+		"DELETE FROM subjects WHERE ID NOT IN (SELECT SubjectID FROM book_subjects)",
+	}
+	// PostgreSQL's REINDEX needs a target and table ownership; ANALYZE is enough there
+	if r.db.Dialect() == dialectSQLite {
+		cleanup = append(cleanup, "REINDEX")
+	}
+	cleanup = append(cleanup, "ANALYZE")
+	for _, stmt := range cleanup {
+		if _, err := r.db.Exec(stmt); err != nil {
+			return len(books), err
+		}
+	}
+	return len(books), nil
+}
+
+// syncMetadata rewrites the author and subject links of a book. The Authors
+// text column is kept as a display string derived from AuthorList. Callers
+// run it in the transaction that writes the book row.
+func (r *sqlBookRepository) syncMetadata(book *BookInventory) error {
+	if len(book.AuthorList) == 0 {
+		book.AuthorList = splitAuthors(book.Authors)
+	}
+
+	names := make([]string, 0, len(book.AuthorList))
+	for _, author := range book.AuthorList {
+		names = append(names, author.Name)
+	}
+	if len(names) > 0 {
+		book.Authors = strings.Join(names, ", ")
+		if _, err := r.db.Exec("UPDATE book_inventory SET Authors =? WHERE ISBN =?", book.Authors, book.ISBN); err != nil {
+			return err
+		}
+	}
+
+	if _, err := r.db.Exec("DELETE FROM book_authors WHERE ISBN =?", book.ISBN); err != nil {
+		return err
+	}
+	for i := range book.AuthorList {
+		id, err := r.upsertNamed("authors", "Name", book.AuthorList[i].Name)
+		if err != nil {
+			return err
+		}
+		book.AuthorList[i].ID = id
+		if _, err := r.db.Exec(r.db.Dialect().InsertIgnore("book_authors", "ISBN", "AuthorID", "Position"), book.ISBN, id, i); err != nil {
+			return err
+		}
+	}
+
+	if _, err := r.db.Exec("DELETE FROM book_subjects WHERE ISBN =?", book.ISBN); err != nil {
+		return err
+	}
+	for _, heading := range book.Subjects {
+		heading = strings.TrimSpace(heading)
+		if heading == "" {
+			continue
+		}
+		id, err := r.upsertNamed("subjects", "Heading", heading)
+		if err != nil {
+			return err
+		}
+		if _, err := r.db.Exec(r.db.Dialect().InsertIgnore("book_subjects", "ISBN", "SubjectID"), book.ISBN, id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// upsertNamed returns the ID of the row in table whose column equals value,
+// creating it first if needed. Only used with the authors and subjects tables.
+func (r *sqlBookRepository) upsertNamed(table, column, value string) (int, error) {
+	value = strings.TrimSpace(value)
+	if _, err := r.db.Exec(r.db.Dialect().InsertIgnore(table, column), value); err != nil {
+		return 0, err
+	}
+
+	var id int
+	err := r.db.QueryRow(fmt.Sprintf("SELECT ID FROM %s WHERE lower(%s) = lower(?)", table, column), value).Scan(&id)
+	return id, err
+}
+
+func (r *sqlBookRepository) loadMetadata(book *BookInventory) error {
+	rows, err := r.db.Query(`SELECT a.ID, a.Name FROM book_authors ba
+		JOIN authors a ON a.ID = ba.AuthorID
+		WHERE ba.ISBN =? ORDER BY ba.Position`, book.ISBN)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	book.AuthorList = nil
+	for rows.Next() {
+		var author Author
+		if err := rows.Scan(&author.ID, &author.Name); err != nil {
+			return err
+		}
+		book.AuthorList = append(book.AuthorList, author)
+	}
+	rows.Close()
+
+	rows, err = r.db.Query(`SELECT s.Heading FROM book_subjects bs
+		JOIN subjects s ON s.ID = bs.SubjectID
+		WHERE bs.ISBN =? ORDER BY lower(s.Heading)`, book.ISBN)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	book.Subjects = nil
+	for rows.Next() {
+		var heading string
+		if err := rows.Scan(&heading); err != nil {
+			return err
+		}
+		book.Subjects = append(book.Subjects, heading)
+	}
+
+	return rows.Err()
+}
+
+func bookFilterSQL(filter BookFilter) (string, []interface{}) {
+	conditions := []string{"DeletedAt IS NULL"}
+	var args []interface{}
+
+	if filter.Deleted {
+		conditions[0] = "DeletedAt IS NOT NULL"
+	}
+	if filter.LibID != 0 {
+		conditions = append(conditions, "LibID = ?")
+		args = append(args, filter.LibID)
+	}
+	if filter.Author != "" {
+		conditions = append(conditions, `ISBN IN (SELECT ba.ISBN FROM book_authors ba
+			JOIN authors a ON a.ID = ba.AuthorID WHERE lower(a.Name) LIKE lower(?))`)
+		args = append(args, "%"+filter.Author+"%")
+	}
+	if filter.Subject != "" {
+		conditions = append(conditions, `ISBN IN (SELECT bs.ISBN FROM book_subjects bs
+			JOIN subjects s ON s.ID = bs.SubjectID WHERE lower(s.Heading) LIKE lower(?))`)
+		args = append(args, "%"+filter.Subject+"%")
+	}
+	if filter.Series != "" {
+		conditions = append(conditions, "lower(SeriesName) LIKE lower(?)")
+		args = append(args, "%"+filter.Series+"%")
+	}
+	if filter.Language != "" {
+		conditions = append(conditions, "lower(Language) = lower(?)")
+		args = append(args, filter.Language)
+	}
+	if filter.Year != 0 {
+		conditions = append(conditions, "PublicationYear = ?")
+		args = append(args, filter.Year)
+	}
+	if filter.YearFrom != 0 {
+		conditions = append(conditions, "PublicationYear >= ?")
+		args = append(args, filter.YearFrom)
+	}
+	if filter.YearTo != 0 {
+		conditions = append(conditions, "PublicationYear <= ?")
+		args = append(args, filter.YearTo)
+	}
+
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// RequestEvents
+
+type sqlRequestEventRepository struct {
+	db sqlExecutor
+}
+
+const requestEventColumns = `ReqID, COALESCE(BookID, ''), COALESCE(ReaderID, 0), RequestDate, ApprovalDate, COALESCE(ApproverID, 0), COALESCE(RequestType, ''), COALESCE(Decision, '')`
+
+func scanRequestEvent(row rowScanner, event *RequestEvent) error {
+	var requestDate, approvalDate sql.NullTime
+	if err := row.Scan(&event.ReqID, &event.BookID, &event.ReaderID, &requestDate, &approvalDate, &event.ApproverID, &event.RequestType, &event.Decision); err != nil {
+		return err
+	}
+	event.RequestDate = requestDate.Time
+	event.ApprovalDate = approvalDate.Time
+	return nil
+}
+
+// Create stores a new, pending request. A decision is only made through
+// CirculationRepository, so any the caller filled in is dropped.
+func (r *sqlRequestEventRepository) Create(event *RequestEvent) error {
+	event.ApprovalDate, event.ApproverID, event.Decision = time.Time{}, 0, ""
+	return r.db.InTx(func(tx *dbTx) error {
+		id, err := tx.InsertID("ReqID", "INSERT INTO RequestEvents (BookID, ReaderID, RequestDate, ApprovalDate, ApproverID, RequestType, Decision) VALUES (?,?,?,?,?,?,?)", nullString(event.BookID), nullID(event.ReaderID), event.RequestDate, event.ApprovalDate, nullID(event.ApproverID), event.RequestType, nullString(event.Decision))
+		if err != nil {
+			return referenceError(err)
+		}
+		event.ReqID = id
+		return recordEvent(tx, eventRequestCreated, bookLibID(tx, event.BookID), event)
+	})
+}
+
+func (r *sqlRequestEventRepository) Get(id int) (*RequestEvent, error) {
+	var event RequestEvent
+	if err := scanRequestEvent(r.db.QueryRow("SELECT "+requestEventColumns+" FROM RequestEvents WHERE ReqID =?", id), &event); err != nil {
+		return nil, notFound(err)
+	}
+	return &event, nil
+}
+
+func (r *sqlRequestEventRepository) Update(event *RequestEvent) error {
+	return referenceError(checkAffected(r.db.Exec("UPDATE RequestEvents SET BookID =?, ReaderID =?, RequestDate =?, ApprovalDate =?, ApproverID =?, RequestType =?, Decision =? WHERE ReqID =?", nullString(event.BookID), nullID(event.ReaderID), event.RequestDate, event.ApprovalDate, nullID(event.ApproverID), event.RequestType, nullString(event.Decision), event.ReqID)))
+}
+
+func (r *sqlRequestEventRepository) Delete(id int) error {
+	return checkAffected(r.db.Exec("DELETE FROM RequestEvents WHERE ReqID =?", id))
+}
+
+func (r *sqlRequestEventRepository) List() ([]RequestEvent, error) {
+	rows, err := r.db.Query("SELECT " + requestEventColumns + " FROM RequestEvents")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []RequestEvent
+	for rows.Next() {
+		var event RequestEvent
+		if err := scanRequestEvent(rows, &event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// IssueRegistery
+
+type sqlIssueRepository struct {
+	db sqlExecutor
+}
+
+const issueColumns = `IssueID, COALESCE(ISBN, ''), COALESCE(ReaderID, 0), COALESCE(IssueApproverID, 0), COALESCE(IssueStatus, ''),
+	IssueDate, ExpectedReturnDate, ReturnDate, COALESCE(ReturnApproverID, 0)`
+
+// scanIssue tolerates NULL dates: ReturnDate stays empty until the book is returned.
+func scanIssue(row rowScanner, issue *IssueRegistery) error {
+	var issueDate, expectedReturnDate, returnDate sql.NullTime
+	if err := row.Scan(&issue.IssueID, &issue.ISBN, &issue.ReaderID, &issue.IssueApproverID, &issue.IssueStatus,
+		&issueDate, &expectedReturnDate, &returnDate, &issue.ReturnApproverID); err != nil {
+		return err
+	}
+	issue.IssueDate = issueDate.Time
+	issue.ExpectedReturnDate = expectedReturnDate.Time
+	issue.ReturnDate = returnDate.Time
+	return nil
+}
+
+// Create takes a copy of the book off the shelf when the loan is open.
+func (r *sqlIssueRepository) Create(issue *IssueRegistery) error {
+	return r.db.InTx(func(tx *dbTx) error {
+		id, err := tx.InsertID("IssueID", "INSERT INTO IssueRegistery (ISBN, ReaderID, IssueApproverID, IssueStatus, IssueDate, ExpectedReturnDate) VALUES (?,?,?,?,?,?)", nullString(issue.ISBN), nullID(issue.ReaderID), nullID(issue.IssueApproverID), issue.IssueStatus, issue.IssueDate, issue.ExpectedReturnDate)
+		if err != nil {
+			return referenceError(err)
+		}
+		issue.IssueID = id
+		if loanIsOpen(issue.IssueStatus) {
+			if err := takeCopy(tx, issue.ISBN); err != nil {
+				return err
+			}
+		}
+		return recordEvent(tx, issueStatusEvent(issue.IssueStatus), bookLibID(tx, issue.ISBN), loanEvent{Issue: issue})
+	})
+}
+
+func (r *sqlIssueRepository) Get(id int) (*IssueRegistery, error) {
+	var issue IssueRegistery
+	if err := scanIssue(r.db.QueryRow("SELECT "+issueColumns+" FROM IssueRegistery WHERE IssueID =?", id), &issue); err != nil {
+		return nil, notFound(err)
+	}
+	return &issue, nil
+}
+
+// Update moves the copy of an open loan along with its book and status, and
+// records an issue.* event when the edit changes the status of the loan.
+func (r *sqlIssueRepository) Update(issue *IssueRegistery) error {
+	return r.db.InTx(func(tx *dbTx) error {
+		var isbn sql.NullString
+		var status string
+		if err := tx.QueryRow("SELECT ISBN, IssueStatus FROM IssueRegistery WHERE IssueID =?", issue.IssueID).Scan(&isbn, &status); err != nil {
+			return notFound(err)
+		}
+		if err := referenceError(checkAffected(tx.Exec("UPDATE IssueRegistery SET ISBN =?, ReaderID =?, IssueApproverID =?, IssueStatus =?, IssueDate =?, ExpectedReturnDate =?, ReturnDate =?, ReturnApproverID =? WHERE IssueID =?", nullString(issue.ISBN), nullID(issue.ReaderID), nullID(issue.IssueApproverID), issue.IssueStatus, issue.IssueDate, issue.ExpectedReturnDate, issue.ReturnDate, nullID(issue.ReturnApproverID), issue.IssueID))); err != nil {
+			return err
+		}
+		if loanIsOpen(status) {
+			if err := releaseCopy(tx, isbn.String); err != nil {
+				return err
+			}
+		}
+		if loanIsOpen(issue.IssueStatus) {
+			if err := takeCopy(tx, issue.ISBN); err != nil {
+				return err
+			}
+		}
+		if status == issue.IssueStatus {
+			return nil
+		}
+		return recordEvent(tx, issueStatusEvent(issue.IssueStatus), bookLibID(tx, issue.ISBN), loanEvent{Issue: issue})
+	})
+}
+
+// issueStatusEvent returns the event describing a loan entering status.
+func issueStatusEvent(status string) string {
+	switch status {
+	case issueStatusReturned:
+		return eventIssueReturned
+	case issueStatusOverdue:
+		return eventIssueOverdue
+	}
+	return eventIssueApproved
+}
+
+// Delete puts the copy of an open loan back on the shelf.
+func (r *sqlIssueRepository) Delete(id int) error {
+	return r.db.InTx(func(tx *dbTx) error {
+		var isbn sql.NullString
+		var status string
+		if err := tx.QueryRow("SELECT ISBN, IssueStatus FROM IssueRegistery WHERE IssueID =?", id).Scan(&isbn, &status); err != nil {
+			return notFound(err)
+		}
+		if err := checkAffected(tx.Exec("DELETE FROM IssueRegistery WHERE IssueID =?", id)); err != nil {
+			return err
+		}
+		if loanIsOpen(status) {
+			return releaseCopy(tx, isbn.String)
+		}
+		return nil
+	})
+}
+
+func loanIsOpen(status string) bool {
+	return status == issueStatusIssued || status == issueStatusOverdue
+}
+
+func (r *sqlIssueRepository) List() ([]IssueRegistery, error) {
+	rows, err := r.db.Query("SELECT " + issueColumns + " FROM IssueRegistery")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var issues []IssueRegistery
+	for rows.Next() {
+		var issue IssueRegistery
+		if err := scanIssue(rows, &issue); err != nil {
+			return nil, err
+		}
+		issues = append(issues, issue)
+	}
+	return issues, rows.Err()
+}
+
+func (r *sqlIssueRepository) CountOpen(filter LoanFilter) (int, error) {
+	query := "SELECT COUNT(*) FROM IssueRegistery WHERE IssueStatus IN (?, ?)"
+	args := []interface{}{issueStatusIssued, issueStatusOverdue}
+	if filter.ISBN != "" {
+		query += " AND ISBN = ?"
+		args = append(args, filter.ISBN)
+	}
+	if filter.ReaderID != 0 {
+		query += " AND ReaderID = ?"
+		args = append(args, filter.ReaderID)
+	}
+	if filter.LibID != 0 {
+		query += " AND ISBN IN (SELECT ISBN FROM book_inventory WHERE LibID = ?)"
+		args = append(args, filter.LibID)
+	}
+
+	var count int
+	err := r.db.QueryRow(query, args...).Scan(&count)
+	return count, err
+}
+
+func (r *sqlIssueRepository) MarkOverdue(now time.Time) ([]IssueRegistery, error) {
+	var marked []IssueRegistery
+	err := r.db.InTx(func(tx *dbTx) error {
+		rows, err := tx.Query("SELECT "+issueColumns+" FROM IssueRegistery WHERE IssueStatus =? AND ExpectedReturnDate < ?", issueStatusIssued, now)
+		if err != nil {
+			return err
+		}
+		var due []IssueRegistery
+		for rows.Next() {
+			var issue IssueRegistery
+			if err := scanIssue(rows, &issue); err != nil {
+				rows.Close()
+				return err
+			}
+			due = append(due, issue)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		// A loan returned since the SELECT is left alone.
+		for _, issue := range due {
+			result, err := tx.Exec("UPDATE IssueRegistery SET IssueStatus =? WHERE IssueID =? AND IssueStatus =?", issueStatusOverdue, issue.IssueID, issueStatusIssued)
+			if err != nil {
+				return err
+			}
+			n, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				issue.IssueStatus = issueStatusOverdue
+				if err := recordEvent(tx, eventIssueOverdue, bookLibID(tx, issue.ISBN), loanEvent{Issue: &issue}); err != nil {
+					return err
+				}
+				marked = append(marked, issue)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return marked, nil
+}
+
+func (r *sqlIssueRepository) PendingReminders(kind, status string, dueBefore time.Time) ([]IssueRegistery, error) {
+	rows, err := r.db.Query("SELECT "+issueColumns+` FROM IssueRegistery i
+		WHERE IssueStatus =? AND ExpectedReturnDate < ?
+		AND NOT EXISTS (SELECT 1 FROM loan_reminders m WHERE m.IssueID = i.IssueID AND m.Kind =?)
+		ORDER BY ExpectedReturnDate`, status, dueBefore, kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var issues []IssueRegistery
+	for rows.Next() {
+		var issue IssueRegistery
+		if err := scanIssue(rows, &issue); err != nil {
+			return nil, err
+		}
+		issues = append(issues, issue)
+	}
+	return issues, rows.Err()
+}
+
+func (r *sqlIssueRepository) ClaimReminder(issueID int, kind string, now time.Time) (bool, error) {
+	result, err := r.db.Exec(r.db.Dialect().InsertIgnore("loan_reminders", "IssueID", "Kind", "SentAt"), issueID, kind, now)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (r *sqlIssueRepository) ReleaseReminder(issueID int, kind string) error {
+	_, err := r.db.Exec("DELETE FROM loan_reminders WHERE IssueID =? AND Kind =?", issueID, kind)
+	return err
+}
+
+// Circulation
+
+type sqlCirculationRepository struct {
+	db sqlExecutor
+}
+
+func (r *sqlCirculationRepository) Approve(reqID, approverID int, now time.Time, policy CirculationConfig) (*IssueRegistery, error) {
+	var loan *IssueRegistery
+	err := r.db.InTx(func(tx *dbTx) error {
+		var event RequestEvent
+		if err := scanRequestEvent(tx.QueryRow("SELECT "+requestEventColumns+" FROM RequestEvents WHERE ReqID =?", reqID), &event); err != nil {
+			return notFound(err)
+		}
+
+		// Claiming the request first makes a repeated approval fail here
+		// instead of lending a second copy.
+		if err := decideRequest(tx, reqID, approverID, requestDecisionApproved, now); err != nil {
+			return err
+		}
+
+		var err error
+
+		outcome := eventIssueApproved
+		switch event.RequestType {
+		case requestTypeIssue:
+			loan, err = issueCopy(tx, &event, approverID, now, policy)
+		case requestTypeReturn:
+			loan, err = returnCopy(tx, &event, approverID, now)
+			outcome = eventIssueReturned
+		default:
+			err = errUnknownRequestType
+		}
+		if err != nil {
+			return err
+		}
+
+		event.ApprovalDate, event.ApproverID, event.Decision = now, approverID, requestDecisionApproved
+		return recordEvent(tx, outcome, bookLibID(tx, loan.ISBN), loanEvent{Request: &event, Issue: loan})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return loan, nil
+}
+
+func (r *sqlCirculationRepository) Reject(reqID, approverID int, reason string, now time.Time) (*RequestEvent, error) {
+	var event RequestEvent
+	err := r.db.InTx(func(tx *dbTx) error {
+		if err := decideRequest(tx, reqID, approverID, requestDecisionRejected, now); err != nil {
+			return err
+		}
+		if err := scanRequestEvent(tx.QueryRow("SELECT "+requestEventColumns+" FROM RequestEvents WHERE ReqID =?", reqID), &event); err != nil {
+			return err
+		}
+		return recordEvent(tx, eventRequestRejected, bookLibID(tx, event.BookID), rejectionEvent{Request: &event, Reason: reason})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+// decideRequest records the decision on a pending request, failing with
+// errAlreadyDecided if it has one.
+func decideRequest(tx *dbTx, reqID, approverID int, decision string, now time.Time) error {
+	err := checkAffected(tx.Exec("UPDATE RequestEvents SET ApprovalDate =?, ApproverID =?, Decision =? WHERE ReqID =? AND Decision IS NULL", now, approverID, decision, reqID))
+	if errors.Is(err, errNotFound) {
+		var exists int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM RequestEvents WHERE ReqID =?", reqID).Scan(&exists); err != nil {
+			return err
+		}
+		if exists == 0 {
+			return errNotFound
+		}
+		return errAlreadyDecided
+	}
+	return err
+}
+
+func issueCopy(tx *dbTx, event *RequestEvent, approverID int, now time.Time, policy CirculationConfig) (*IssueRegistery, error) {
+	if policy.MaxLoansPerReader > 0 {
+		var open int
+		err := tx.QueryRow("SELECT COUNT(*) FROM IssueRegistery WHERE ReaderID =? AND IssueStatus IN (?, ?)", event.ReaderID, issueStatusIssued, issueStatusOverdue).Scan(&open)
+		if err != nil {
+			return nil, err
+		}
+		if open >= policy.MaxLoansPerReader {
+			return nil, errLoanLimitReached
+		}
+	}
+
+	if err := takeCopy(tx, event.BookID); err != nil {
+		return nil, err
+	}
+
+	loan := &IssueRegistery{
+		ISBN:               event.BookID,
+		ReaderID:           event.ReaderID,
+		IssueApproverID:    approverID,
+		IssueStatus:        issueStatusIssued,
+		IssueDate:          now,
+		ExpectedReturnDate: now.AddDate(0, 0, policy.LoanDays),
+	}
+	var err error
+	loan.IssueID, err = tx.InsertID("IssueID", "INSERT INTO IssueRegistery (ISBN, ReaderID, IssueApproverID, IssueStatus, IssueDate, ExpectedReturnDate) VALUES (?,?,?,?,?,?)", loan.ISBN, nullID(loan.ReaderID), nullID(loan.IssueApproverID), loan.IssueStatus, loan.IssueDate, loan.ExpectedReturnDate)
+	if err != nil {
+		return nil, referenceError(err)
+	}
+	return loan, nil
+}
+
+// returnCopy closes the reader's oldest open loan of the book. The copy goes
+// back on the shelf unless that would exceed TotalCopies.
+func returnCopy(tx *dbTx, event *RequestEvent, approverID int, now time.Time) (*IssueRegistery, error) {
+	var loan IssueRegistery
+	err := scanIssue(tx.QueryRow("SELECT "+issueColumns+" FROM IssueRegistery WHERE ISBN =? AND ReaderID =? AND IssueStatus IN (?, ?) ORDER BY IssueDate LIMIT 1", event.BookID, event.ReaderID, issueStatusIssued, issueStatusOverdue), &loan)
+	if err == sql.ErrNoRows {
+		return nil, errNoOpenLoan
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkAffected(tx.Exec("UPDATE IssueRegistery SET IssueStatus =?, ReturnDate =?, ReturnApproverID =? WHERE IssueID =? AND IssueStatus IN (?, ?)", issueStatusReturned, now, approverID, loan.IssueID, issueStatusIssued, issueStatusOverdue))
+	if errors.Is(err, errNotFound) {
+		return nil, errNoOpenLoan
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := releaseCopy(tx, loan.ISBN); err != nil {
+		return nil, err
+	}
+
+	loan.IssueStatus = issueStatusReturned
+	loan.ReturnDate = now
+	loan.ReturnApproverID = approverID
+	return &loan, nil
+}
+
+// takeCopy lends a copy of isbn, failing with errNoCopiesAvailable when none
+// is on the shelf. The condition in the UPDATE keeps concurrent loans from
+// taking the same copy.
+func takeCopy(tx *dbTx, isbn string) error {
+	err := checkAffected(tx.Exec("UPDATE book_inventory SET AvailableCopies = AvailableCopies - 1 WHERE ISBN =? AND AvailableCopies > 0 AND DeletedAt IS NULL", isbn))
+	if errors.Is(err, errNotFound) {
+		return errNoCopiesAvailable
+	}
+	return err
+}
+
+// releaseCopy puts a copy of isbn back on the shelf unless that would exceed
+// TotalCopies.
+func releaseCopy(tx *dbTx, isbn string) error {
+	_, err := tx.Exec("UPDATE book_inventory SET AvailableCopies = AvailableCopies + 1 WHERE ISBN =? AND AvailableCopies < TotalCopies", isbn)
+	return err
+}
+
+// Audit log
+
+type sqlAuditRepository struct {
+	db sqlExecutor
+}
+
+func (r *sqlAuditRepository) Record(entry *AuditEntry) error {
+	id, err := r.db.InsertID("ID", "INSERT INTO audit_log (ActorID, ActorEmail, Action, Entity, EntityID, Before, After, CreatedAt) VALUES (?,?,?,?,?,?,?,?)",
+		entry.ActorID, entry.ActorEmail, entry.Action, entry.Entity, entry.EntityID, nullJSON(entry.Before), nullJSON(entry.After), entry.CreatedAt)
+	if err != nil {
+		return err
+	}
+	entry.ID = id
+	return nil
+}
+
+func (r *sqlAuditRepository) List(filter AuditFilter) ([]AuditEntry, error) {
+	var conditions []string
+	var args []interface{}
+	add := func(condition string, arg interface{}) {
+		conditions = append(conditions, condition)
+		args = append(args, arg)
+	}
+	if filter.ActorID != 0 {
+		add("ActorID = ?", filter.ActorID)
+	}
+	if filter.Action != "" {
+		add("Action = ?", filter.Action)
+	}
+	if filter.Entity != "" {
+		add("Entity = ?", filter.Entity)
+	}
+	if filter.EntityID != "" {
+		add("EntityID = ?", filter.EntityID)
+	}
+	if !filter.Since.IsZero() {
+		add("CreatedAt >= ?", filter.Since.UTC())
+	}
+	if !filter.Until.IsZero() {
+		add("CreatedAt < ?", filter.Until.UTC())
+	}
+
+	query := "SELECT ID, ActorID, ActorEmail, Action, Entity, EntityID, COALESCE(Before, ''), COALESCE(After, ''), CreatedAt FROM audit_log"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY ID DESC"
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		var before, after string
+		if err := rows.Scan(&entry.ID, &entry.ActorID, &entry.ActorEmail, &entry.Action, &entry.Entity, &entry.EntityID, &before, &after, &entry.CreatedAt); err != nil {
+			return nil, err
+		}
+		if before != "" {
+			entry.Before = json.RawMessage(before)
+		}
+		if after != "" {
+			entry.After = json.RawMessage(after)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func nullJSON(data json.RawMessage) interface{} {
+	if len(data) == 0 {
+		return nil
+	}
+	return string(data)
+}
+
+// Job runs
+
+type sqlJobRunRepository struct {
+	db sqlExecutor
+}
+
+func (r *sqlJobRunRepository) Record(run *JobRun) error {
+	id, err := r.db.InsertID("ID", "INSERT INTO job_runs (Job, TriggeredBy, StartedAt, FinishedAt, Status, Summary) VALUES (?,?,?,?,?,?)",
+		run.Job, run.TriggeredBy, run.StartedAt, run.FinishedAt, run.Status, run.Summary)
+	if err != nil {
+		return err
+	}
+	run.ID = id
+	return nil
+}
+
+func (r *sqlJobRunRepository) Latest(job string) (*JobRun, error) {
+	var run JobRun
+	err := r.db.QueryRow("SELECT ID, Job, TriggeredBy, StartedAt, FinishedAt, Status, Summary FROM job_runs WHERE Job =? ORDER BY StartedAt DESC, ID DESC LIMIT 1", job).
+		Scan(&run.ID, &run.Job, &run.TriggeredBy, &run.StartedAt, &run.FinishedAt, &run.Status, &run.Summary)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &run, nil
+}
+
+// Webhooks
+
+type sqlWebhookRepository struct {
+	db sqlExecutor
+}
+
+const webhookColumns = `ID, LibID, URL, Events, CreatedAt`
+
+func scanWebhook(row rowScanner, hook *Webhook) error {
+	var events string
+	if err := row.Scan(&hook.ID, &hook.LibID, &hook.URL, &events, &hook.CreatedAt); err != nil {
+		return err
+	}
+	hook.Events = strings.Split(events, ",")
+	return nil
+}
+
+func (r *sqlWebhookRepository) Create(hook *Webhook) error {
+	id, err := r.db.InsertID("ID", "INSERT INTO webhooks (LibID, URL, Events, Secret, CreatedAt) VALUES (?,?,?,?,?)",
+		hook.LibID, hook.URL, strings.Join(hook.Events, ","), hook.Secret, hook.CreatedAt)
+	if err != nil {
+		return referenceError(err)
+	}
+	hook.ID = id
+	return nil
+}
+
+func (r *sqlWebhookRepository) Get(id int) (*Webhook, error) {
+	var hook Webhook
+	if err := scanWebhook(r.db.QueryRow("SELECT "+webhookColumns+" FROM webhooks WHERE ID =?", id), &hook); err != nil {
+		return nil, notFound(err)
+	}
+	return &hook, nil
+}
+
+func (r *sqlWebhookRepository) Delete(id int) error {
+	return checkAffected(r.db.Exec("DELETE FROM webhooks WHERE ID =?", id))
+}
+
+func (r *sqlWebhookRepository) List(libID int) ([]Webhook, error) {
+	query := "SELECT " + webhookColumns + " FROM webhooks"
+	var args []interface{}
+	if libID != 0 {
+		query += " WHERE LibID =?"
+		args = append(args, libID)
+	}
+	rows, err := r.db.Query(query+" ORDER BY ID", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hooks := []Webhook{}
+	for rows.Next() {
+		var hook Webhook
+		if err := scanWebhook(rows, &hook); err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, rows.Err()
+}
+
+func (r *sqlWebhookRepository) Enqueue(outboxID int, event string, libID int, payload []byte, now time.Time) (int, error) {
+	// List reads 0 as every library, which would leak the event to all
+	// tenants
+	if libID == 0 {
+		return 0, nil
+	}
+	hooks, err := r.List(libID)
+	if err != nil {
+		return 0, err
+	}
+
+	queued := 0
+	for _, hook := range hooks {
+		subscribed := false
+		for _, e := range hook.Events {
+			if e == event {
+				subscribed = true
+			}
+		}
+		if !subscribed {
+			continue
+		}
+		result, err := r.db.Exec(r.db.Dialect().InsertIgnore("webhook_deliveries", "OutboxID", "WebhookID", "Event", "Payload", "Status", "CreatedAt", "NextAttemptAt"),
+			outboxID, hook.ID, event, string(payload), deliveryPending, now, now)
+		if err != nil {
+			return queued, err
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			queued++
+		}
+	}
+	return queued, nil
+}
+
+const deliveryColumns = `d.ID, d.WebhookID, d.Event, d.Payload, d.Status, d.Attempts, d.ResponseStatus, d.Error, d.CreatedAt, d.NextAttemptAt, d.DeliveredAt`
+
+func scanDelivery(row rowScanner, delivery *WebhookDelivery, extra ...interface{}) error {
+	var payload string
+	var deliveredAt sql.NullTime
+	dest := []interface{}{&delivery.ID, &delivery.WebhookID, &delivery.Event, &payload, &delivery.Status, &delivery.Attempts,
+		&delivery.ResponseStatus, &delivery.Error, &delivery.CreatedAt, &delivery.NextAttemptAt, &deliveredAt}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return err
+	}
+	delivery.Payload = json.RawMessage(payload)
+	delivery.DeliveredAt = nullTime(deliveredAt)
+	return nil
+}
+
+func (r *sqlWebhookRepository) DueDeliveries(now time.Time, limit int) ([]WebhookDelivery, error) {
+	rows, err := r.db.Query("SELECT "+deliveryColumns+`, h.URL, h.Secret FROM webhook_deliveries d
+		JOIN webhooks h ON h.ID = d.WebhookID
+		WHERE d.Status =? AND d.NextAttemptAt <= ? ORDER BY d.NextAttemptAt, d.ID LIMIT ?`, deliveryPending, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		var delivery WebhookDelivery
+		if err := scanDelivery(rows, &delivery, &delivery.URL, &delivery.Secret); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+func (r *sqlWebhookRepository) UpdateDelivery(delivery *WebhookDelivery) error {
+	var deliveredAt interface{}
+	if delivery.DeliveredAt != nil {
+		deliveredAt = *delivery.DeliveredAt
+	}
+	return checkAffected(r.db.Exec("UPDATE webhook_deliveries SET Status =?, Attempts =?, ResponseStatus =?, Error =?, NextAttemptAt =?, DeliveredAt =? WHERE ID =?",
+		delivery.Status, delivery.Attempts, delivery.ResponseStatus, delivery.Error, delivery.NextAttemptAt, deliveredAt, delivery.ID))
+}
+
+func (r *sqlWebhookRepository) ListDeliveries(webhookID, limit int) ([]WebhookDelivery, error) {
+	rows, err := r.db.Query("SELECT "+deliveryColumns+" FROM webhook_deliveries d WHERE d.WebhookID =? ORDER BY d.ID DESC LIMIT ?", webhookID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var delivery WebhookDelivery
+		if err := scanDelivery(rows, &delivery); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+// Outbox
+
+// recordEvent adds a domain event to the outbox as part of tx.
+func recordEvent(tx *dbTx, event string, libID int, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	_, err = tx.Exec("INSERT INTO outbox (Event, LibID, Data, CreatedAt, NextAttemptAt) VALUES (?,?,?,?,?)", event, libID, string(payload), now, now)
+	return err
+}
+
+// bookLibID returns the library of a book, deleted or not, and 0 for an
+// unknown ISBN.
+func bookLibID(tx *dbTx, isbn string) int {
+	var libID int
+	tx.QueryRow("SELECT LibID FROM book_inventory WHERE ISBN =?", isbn).Scan(&libID)
+	return libID
+}
+
+type sqlOutboxRepository struct {
+	db sqlExecutor
+}
+
+const outboxColumns = "ID, Event, LibID, Data, CreatedAt, Attempts, LastError, NextAttemptAt"
+
+func (r *sqlOutboxRepository) Due(now time.Time, limit int) ([]OutboxEntry, error) {
+	return r.query("SELECT "+outboxColumns+" FROM outbox WHERE ProcessedAt IS NULL AND NextAttemptAt <= ? ORDER BY ID LIMIT ?", now, limit)
+}
+
+func (r *sqlOutboxRepository) After(afterID, libID, limit int) ([]OutboxEntry, error) {
+	return r.query("SELECT "+outboxColumns+" FROM outbox WHERE ID > ? AND LibID = ? ORDER BY ID LIMIT ?", afterID, libID, limit)
+}
+
+func (r *sqlOutboxRepository) query(query string, args ...interface{}) ([]OutboxEntry, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []OutboxEntry
+	for rows.Next() {
+		var entry OutboxEntry
+		var data string
+		if err := rows.Scan(&entry.ID, &entry.Event, &entry.LibID, &data, &entry.CreatedAt, &entry.Attempts, &entry.LastError, &entry.NextAttemptAt); err != nil {
+			return nil, err
+		}
+		entry.Data = json.RawMessage(data)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (r *sqlOutboxRepository) Update(entry *OutboxEntry) error {
+	var processedAt interface{}
+	if entry.ProcessedAt != nil {
+		processedAt = *entry.ProcessedAt
+	}
+	return checkAffected(r.db.Exec("UPDATE outbox SET Attempts =?, LastError =?, NextAttemptAt =?, ProcessedAt =? WHERE ID =?",
+		entry.Attempts, entry.LastError, entry.NextAttemptAt, processedAt, entry.ID))
+}
+
+func (r *sqlOutboxRepository) Prune(cutoff time.Time) (int, error) {
+	result, err := r.db.Exec("DELETE FROM outbox WHERE ProcessedAt IS NOT NULL AND ProcessedAt < ?", cutoff)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+// Notifications
+
+type sqlNotificationRepository struct {
+	db sqlExecutor
+}
+
+func (r *sqlNotificationRepository) Preferences(userID int) (map[string]string, error) {
+	rows, err := r.db.Query("SELECT Event, Channel FROM notification_preferences WHERE UserID =?", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	prefs := map[string]string{}
+	for rows.Next() {
+		var event, channel string
+		if err := rows.Scan(&event, &channel); err != nil {
+			return nil, err
+		}
+		prefs[event] = channel
+	}
+	return prefs, rows.Err()
+}
+
+func (r *sqlNotificationRepository) SetPreferences(userID int, prefs map[string]string) error {
+	return r.db.InTx(func(tx *dbTx) error {
+		for event, channel := range prefs {
+			if _, err := tx.Exec("DELETE FROM notification_preferences WHERE UserID =? AND Event =?", userID, event); err != nil {
+				return err
+			}
+			if _, err := tx.Exec("INSERT INTO notification_preferences (UserID, Event, Channel) VALUES (?,?,?)", userID, event, channel); err != nil {
+				return referenceError(err)
+			}
+		}
+		return nil
+	})
+}
+
+func (r *sqlNotificationRepository) Create(n *Notification) error {
+	id, err := r.db.InsertID("ID", "INSERT INTO notifications (UserID, Event, Subject, Body, CreatedAt) VALUES (?,?,?,?,?)",
+		n.UserID, n.Event, n.Subject, n.Body, n.CreatedAt)
+	if err != nil {
+		return referenceError(err)
+	}
+	n.ID = id
+	return nil
+}
+
+func (r *sqlNotificationRepository) List(userID int, unreadOnly bool, limit int) ([]Notification, error) {
+	query := "SELECT ID, UserID, Event, Subject, Body, CreatedAt, ReadAt FROM notifications WHERE UserID =?"
+	if unreadOnly {
+		query += " AND ReadAt IS NULL"
+	}
+	rows, err := r.db.Query(query+" ORDER BY ID DESC LIMIT ?", userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notifications := []Notification{}
+	for rows.Next() {
+		var n Notification
+		var readAt sql.NullTime
+		if err := rows.Scan(&n.ID, &n.UserID, &n.Event, &n.Subject, &n.Body, &n.CreatedAt, &readAt); err != nil {
+			return nil, err
+		}
+		n.ReadAt = nullTime(readAt)
+		notifications = append(notifications, n)
+	}
+	return notifications, rows.Err()
+}
+
+func (r *sqlNotificationRepository) MarkRead(userID, id int, now time.Time) error {
+	return checkAffected(r.db.Exec("UPDATE notifications SET ReadAt = COALESCE(ReadAt, ?) WHERE ID =? AND UserID =?", now, id, userID))
+}
+
+func (r *sqlNotificationRepository) MarkAllRead(userID int, now time.Time) (int, error) {
+	result, err := r.db.Exec("UPDATE notifications SET ReadAt =? WHERE UserID =? AND ReadAt IS NULL", now, userID)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+// Stats
+
+type sqlStatsRepository struct {
+	db sqlExecutor
+}
+
+const libraryBooks = "(SELECT ISBN FROM book_inventory WHERE LibID = ?)"
+
+func (r *sqlStatsRepository) Loans(libID int, from, end time.Time) ([]IssueRegistery, error) {
+	rows, err := r.db.Query("SELECT "+issueColumns+" FROM IssueRegistery WHERE ISBN IN "+libraryBooks+`
+		AND IssueDate < ? AND (IssueStatus <> ? OR ReturnDate >= ?)`, libID, end, issueStatusReturned, from)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var loans []IssueRegistery
+	for rows.Next() {
+		var loan IssueRegistery
+		if err := scanIssue(rows, &loan); err != nil {
+			return nil, err
+		}
+		loans = append(loans, loan)
+	}
+	return loans, rows.Err()
+}
+
+func (r *sqlStatsRepository) TopTitles(libID int, from, end time.Time, limit int) ([]TitleCount, error) {
+	rows, err := r.db.Query(`SELECT i.ISBN, COALESCE(b.Title, ''), COUNT(*) FROM IssueRegistery i
+		JOIN book_inventory b ON b.ISBN = i.ISBN
+		WHERE b.LibID = ? AND i.IssueDate >= ? AND i.IssueDate < ?
+		GROUP BY i.ISBN, b.Title ORDER BY COUNT(*) DESC, i.ISBN LIMIT ?`, libID, from, end, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	titles := []TitleCount{}
+	for rows.Next() {
+		var title TitleCount
+		if err := rows.Scan(&title.ISBN, &title.Title, &title.Loans); err != nil {
+			return nil, err
+		}
+		titles = append(titles, title)
+	}
+	return titles, rows.Err()
+}
+
+func (r *sqlStatsRepository) Requests(libID int, from, end time.Time) (RequestStats, error) {
+	var stats RequestStats
+	err := r.db.QueryRow(`SELECT COUNT(*),
+		COALESCE(SUM(CASE WHEN Decision = ? THEN 1 ELSE 0 END), 0),
+		COALESCE(SUM(CASE WHEN Decision = ? THEN 1 ELSE 0 END), 0),
+		COALESCE(SUM(CASE WHEN Decision IS NULL THEN 1 ELSE 0 END), 0)
+		FROM RequestEvents WHERE BookID IN `+libraryBooks+` AND RequestDate >= ? AND RequestDate < ?`,
+		requestDecisionApproved, requestDecisionRejected, libID, from, end).Scan(&stats.Total, &stats.Approved, &stats.Rejected, &stats.Pending)
+	return stats, err
+}
+
+func (r *sqlStatsRepository) TotalCopies(libID int) (int, error) {
+	var total int
+	err := r.db.QueryRow("SELECT COALESCE(SUM(TotalCopies), 0) FROM book_inventory WHERE LibID = ? AND DeletedAt IS NULL", libID).Scan(&total)
+	return total, err
+}
+
+func (r *sqlStatsRepository) Circulation(now time.Time) ([]LibraryCirculation, error) {
+	rows, err := r.db.Query(`SELECT l.ID,
+		(SELECT COUNT(*) FROM IssueRegistery i JOIN book_inventory b ON b.ISBN = i.ISBN
+			WHERE b.LibID = l.ID AND i.IssueStatus <> ?),
+		(SELECT COUNT(*) FROM IssueRegistery i JOIN book_inventory b ON b.ISBN = i.ISBN
+			WHERE b.LibID = l.ID AND i.IssueStatus <> ? AND i.ExpectedReturnDate < ?),
+		(SELECT COUNT(*) FROM RequestEvents e JOIN book_inventory b ON b.ISBN = e.BookID
+			WHERE b.LibID = l.ID AND e.Decision IS NULL)
+		FROM library l WHERE l.DeletedAt IS NULL ORDER BY l.ID`, issueStatusReturned, issueStatusReturned, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var figures []LibraryCirculation
+	for rows.Next() {
+		var f LibraryCirculation
+		if err := rows.Scan(&f.LibID, &f.OpenLoans, &f.OverdueLoans, &f.PendingRequests); err != nil {
+			return nil, err
+		}
+		figures = append(figures, f)
+	}
+	return figures, rows.Err()
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultStatsDays = 30
+	maxStatsDays     = 366
+	defaultTopTitles = 10
+	maxTopTitles     = 100
+	statsDateLayout  = "2006-01-02"
+)
+
+// DailyLoans counts the loans issued and returned on one day.
+type DailyLoans struct {
+	Date    string `json:"date"`
+	Loans   int    `json:"loans"`
+	Returns int    `json:"returns"`
+}
+
+type TitleCount struct {
+	ISBN  string `json:"isbn"`
+	Title string `json:"title"`
+	Loans int    `json:"loans"`
+}
+
+// RequestStats counts the requests made in a period by their decision.
+type RequestStats struct {
+	Total    int `json:"total"`
+	Approved int `json:"approved"`
+	Rejected int `json:"rejected"`
+	Pending  int `json:"pending"`
+}
+
+// CirculationReport describes a library's circulation over the days From to
+// To, both included.
+//
+// ActiveReaders counts readers who held a book at any time in the period.
+// AverageLoanDays is the mean length of loans returned in the period, and
+// OverdueRate the share of loans issued in the period and due by now that
+// were returned late or are still out. Utilization is the time copies spent
+// on loan as a share of all copy time in the period, up to now; it uses the
+// current TotalCopies of the library's books.
+type CirculationReport struct {
+	LibID           int          `json:"libID"`
+	From            string       `json:"from"`
+	To              string       `json:"to"`
+	Loans           int          `json:"loans"`
+	Returns         int          `json:"returns"`
+	LoansPerDay     []DailyLoans `json:"loansPerDay"`
+	TopTitles       []TitleCount `json:"topTitles"`
+	ActiveReaders   int          `json:"activeReaders"`
+	AverageLoanDays float64      `json:"averageLoanDays"`
+	OverdueRate     float64      `json:"overdueRate"`
+	TotalCopies     int          `json:"totalCopies"`
+	Utilization     float64      `json:"utilization"`
+	Requests        RequestStats `json:"requests"`
+}
+
+// buildCirculationReport computes the loan figures of a report from the loans
+// overlapping [from, end). The caller fills in TopTitles and Requests.
+func buildCirculationReport(loans []IssueRegistery, from, end, now time.Time, totalCopies int) *CirculationReport {
+	report := &CirculationReport{
+		From:        from.Format(statsDateLayout),
+		To:          end.AddDate(0, 0, -1).Format(statsDateLayout),
+		TotalCopies: totalCopies,
+		TopTitles:   []TitleCount{},
+	}
+	days := map[string]*DailyLoans{}
+	for day := from; day.Before(end); day = day.AddDate(0, 0, 1) {
+		report.LoansPerDay = append(report.LoansPerDay, DailyLoans{Date: day.Format(statsDateLayout)})
+	}
+	for i := range report.LoansPerDay {
+		days[report.LoansPerDay[i].Date] = &report.LoansPerDay[i]
+	}
+	inPeriod := func(t time.Time) bool { return !t.Before(from) && t.Before(end) }
+
+	// Only time that has already passed can be on loan or overdue.
+	periodEnd := end
+	if now.Before(periodEnd) {
+		periodEnd = now
+	}
+
+	readers := map[int]bool{}
+	var loanTime, returnedTime time.Duration
+	var due, late int
+	for _, loan := range loans {
+		returned := loan.IssueStatus == issueStatusReturned
+		if loan.ReaderID != 0 {
+			readers[loan.ReaderID] = true
+		}
+
+		if inPeriod(loan.IssueDate) {
+			report.Loans++
+			days[loan.IssueDate.UTC().Format(statsDateLayout)].Loans++
+			if loan.ExpectedReturnDate.Before(periodEnd) {
+				due++
+				if !returned || loan.ReturnDate.After(loan.ExpectedReturnDate) {
+					late++
+				}
+			}
+		}
+		if returned && inPeriod(loan.ReturnDate) {
+			report.Returns++
+			days[loan.ReturnDate.UTC().Format(statsDateLayout)].Returns++
+			returnedTime += loan.ReturnDate.Sub(loan.IssueDate)
+		}
+
+		start, stop := loan.IssueDate, periodEnd
+		if start.Before(from) {
+			start = from
+		}
+		if returned && loan.ReturnDate.Before(stop) {
+			stop = loan.ReturnDate
+		}
+		if stop.After(start) {
+			loanTime += stop.Sub(start)
+		}
+	}
+
+	report.ActiveReaders = len(readers)
+	if report.Returns > 0 {
+		report.AverageLoanDays = roundStat(returnedTime.Hours() / 24 / float64(report.Returns))
+	}
+	if due > 0 {
+		report.OverdueRate = roundStat(float64(late) / float64(due))
+	}
+	if copyTime := periodEnd.Sub(from) * time.Duration(totalCopies); copyTime > 0 {
+		report.Utilization = roundStat(float64(loanTime) / float64(copyTime))
+	}
+	return report
+}
+
+func roundStat(v float64) float64 {
+	return math.Round(v*1000) / 1000
+}
+
+// circulationStats serves ?from=YYYY-MM-DD&to=YYYY-MM-DD&top=N, by default
+// for the last 30 days. Owners pass the library in the URL; admins get their
+// own library.
+func (s *Server) circulationStats(c *gin.Context) {
+	var libID int
+	if c.Param("id") != "" {
+		var ok bool
+		if libID, ok = paramID(c, "id"); !ok {
+			return
+		}
+		if _, err := s.store.Libraries.Get(libID); err != nil {
+			if errors.Is(err, errNotFound) {
+				respondError(c, notFoundError("Library not found"))
+				return
+			}
+
+			respondError(c, err)
+			return
+		}
+	} else {
+		libID = c.MustGet("user").(User).LibID
+	}
+
+	now := time.Now().UTC()
+	to := now.Truncate(24 * time.Hour)
+	if value := c.Query("to"); value != "" {
+		var err error
+		if to, err = time.Parse(statsDateLayout, value); err != nil {
+			respondError(c, badRequest("Invalid to, expected YYYY-MM-DD"))
+			return
+		}
+	}
+	from := to.AddDate(0, 0, 1-defaultStatsDays)
+	if value := c.Query("from"); value != "" {
+		var err error
+		if from, err = time.Parse(statsDateLayout, value); err != nil {
+			respondError(c, badRequest("Invalid from, expected YYYY-MM-DD"))
+			return
+		}
+	}
+	end := to.AddDate(0, 0, 1)
+	if !from.Before(end) || from.AddDate(0, 0, maxStatsDays).Before(end) {
+		respondError(c, badRequest("from must not be after to, and the range must not exceed "+strconv.Itoa(maxStatsDays)+" days"))
+		return
+	}
+
+	top := defaultTopTitles
+	if value := c.Query("top"); value != "" {
+		var err error
+		if top, err = strconv.Atoi(value); err != nil || top <= 0 {
+			respondError(c, badRequest("Invalid top"))
+			return
+		}
+		if top > maxTopTitles {
+			top = maxTopTitles
+		}
+	}
+
+	loans, err := s.store.Stats.Loans(libID, from, end)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	totalCopies, err := s.store.Stats.TotalCopies(libID)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	report := buildCirculationReport(loans, from, end, now, totalCopies)
+	report.LibID = libID
+
+	if report.TopTitles, err = s.store.Stats.TopTitles(libID, from, end, top); err != nil {
+		respondError(c, err)
+		return
+	}
+	if report.Requests, err = s.store.Stats.Requests(libID, from, end); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func statsDate(t *testing.T, value string) time.Time {
+	t.Helper()
+	date, err := time.Parse("2006-01-02 15:04", value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return date
+}
+
+func TestBuildCirculationReport(t *testing.T) {
+	d := func(value string) time.Time { return statsDate(t, value) }
+	loans := []IssueRegistery{
+		// Returned on time within the period
+		{ISBN: "a", ReaderID: 1, IssueStatus: issueStatusReturned, IssueDate: d("2024-03-02 10:00"), ExpectedReturnDate: d("2024-03-16 10:00"), ReturnDate: d("2024-03-05 10:00")},
+		// Issued before the period and still out
+		{ISBN: "b", ReaderID: 2, IssueStatus: issueStatusOverdue, IssueDate: d("2024-02-25 00:00"), ExpectedReturnDate: d("2024-03-03 00:00")},
+		// Due within the period and returned late after it
+		{ISBN: "c", ReaderID: 1, IssueStatus: issueStatusReturned, IssueDate: d("2024-03-09 00:00"), ExpectedReturnDate: d("2024-03-10 00:00"), ReturnDate: d("2024-03-12 00:00")},
+		// Issued on the last day and not due yet
+		{ISBN: "d", ReaderID: 3, IssueStatus: issueStatusIssued, IssueDate: d("2024-03-10 12:00"), ExpectedReturnDate: d("2024-03-24 12:00")},
+	}
+	from, end := d("2024-03-01 00:00"), d("2024-03-11 00:00")
+
+	report := buildCirculationReport(loans, from, end, d("2024-03-20 00:00"), 2)
+	if report.From != "2024-03-01" || report.To != "2024-03-10" || len(report.LoansPerDay) != 10 {
+		t.Fatalf("period %s to %s with %d days, want 2024-03-01 to 2024-03-10 with 10", report.From, report.To, len(report.LoansPerDay))
+	}
+	if report.Loans != 3 || report.Returns != 1 || report.ActiveReaders != 3 {
+		t.Errorf("loans, returns, readers = %d, %d, %d, want 3, 1, 3", report.Loans, report.Returns, report.ActiveReaders)
+	}
+	if report.AverageLoanDays != 3 {
+		t.Errorf("AverageLoanDays = %v, want 3", report.AverageLoanDays)
+	}
+	if report.OverdueRate != 1 {
+		t.Errorf("OverdueRate = %v, want 1: the only loan due was late", report.OverdueRate)
+	}
+	// 3 + 10 + 2 + 0.5 loan days out of 2 copies for 10 days
+	if report.Utilization != 0.775 {
+		t.Errorf("Utilization = %v, want 0.775", report.Utilization)
+	}
+	days := map[string]DailyLoans{}
+	for _, day := range report.LoansPerDay {
+		days[day.Date] = day
+	}
+	for date, want := range map[string]DailyLoans{
+		"2024-03-02": {Date: "2024-03-02", Loans: 1},
+		"2024-03-05": {Date: "2024-03-05", Returns: 1},
+		"2024-03-09": {Date: "2024-03-09", Loans: 1},
+		"2024-03-10": {Date: "2024-03-10", Loans: 1},
+		"2024-03-03": {Date: "2024-03-03"},
+	} {
+		if days[date] != want {
+			t.Errorf("%s = %+v, want %+v", date, days[date], want)
+		}
+	}
+
+	// A period that is not over yet only counts the time up to now
+	report = buildCirculationReport(loans[:2], from, end, d("2024-03-06 00:00"), 2)
+	if report.Utilization != 0.8 {
+		t.Errorf("Utilization up to now = %v, want 0.8", report.Utilization)
+	}
+}
+
+func TestCirculationStatsRange(t *testing.T) {
+	store, _ := newTestStore(t)
+	library, admin, book := seedLibrary(t, store, 1)
+	reader := &User{Name: "Ada", Email: "ada@example.org", Role: "reader", LibID: library.ID}
+	if err := store.Users.Create(reader); err != nil {
+		t.Fatal(err)
+	}
+	loan := &IssueRegistery{ISBN: book.ISBN, ReaderID: reader.ID, IssueApproverID: admin.ID, IssueStatus: issueStatusIssued,
+		IssueDate: statsDate(t, "2024-03-02 10:00"), ExpectedReturnDate: statsDate(t, "2024-03-16 10:00")}
+	if err := store.Issues.Create(loan); err != nil {
+		t.Fatal(err)
+	}
+	loan.IssueStatus, loan.ReturnDate, loan.ReturnApproverID = issueStatusReturned, statsDate(t, "2024-03-05 10:00"), admin.ID
+	if err := store.Issues.Update(loan); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{store: store}
+
+	today := time.Now().UTC().Format(statsDateLayout)
+	tests := []struct {
+		query    string
+		status   int
+		from, to string
+		days     int
+		loans    int
+	}{
+		{query: "", status: http.StatusOK, from: time.Now().UTC().AddDate(0, 0, 1-defaultStatsDays).Format(statsDateLayout), to: today, days: defaultStatsDays},
+		{query: "?from=2024-03-01&to=2024-03-10", status: http.StatusOK, from: "2024-03-01", to: "2024-03-10", days: 10, loans: 1},
+		{query: "?from=2024-03-03&to=2024-03-10", status: http.StatusOK, from: "2024-03-03", to: "2024-03-10", days: 8},
+		{query: "?from=2024-03-02&to=2024-03-02", status: http.StatusOK, from: "2024-03-02", to: "2024-03-02", days: 1, loans: 1},
+		{query: "?to=2024-03-10", status: http.StatusOK, from: "2024-02-10", to: "2024-03-10", days: defaultStatsDays, loans: 1},
+		{query: "?from=2023-03-02&to=2024-03-01", status: http.StatusOK, from: "2023-03-02", to: "2024-03-01", days: maxStatsDays, loans: 0},
+		{query: "?from=2023-03-01&to=2024-03-01", status: http.StatusBadRequest},
+		{query: "?from=2024-03-10&to=2024-03-01", status: http.StatusBadRequest},
+		{query: "?from=03/01/2024", status: http.StatusBadRequest},
+		{query: "?to=2024-03-10&top=0", status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := serveAs(admin, "/admin/stats", s.circulationStats, http.MethodGet, "/admin/stats"+tt.query, "")
+		if w.Code != tt.status {
+			t.Errorf("%q: status %d, want %d: %s", tt.query, w.Code, tt.status, w.Body.String())
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		var report CirculationReport
+		if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+			t.Fatal(err)
+		}
+		if report.From != tt.from || report.To != tt.to || len(report.LoansPerDay) != tt.days || report.Loans != tt.loans {
+			t.Errorf("%q: %s to %s, %d days, %d loans; want %s to %s, %d days, %d loans",
+				tt.query, report.From, report.To, len(report.LoansPerDay), report.Loans, tt.from, tt.to, tt.days, tt.loans)
+		}
+	}
+}
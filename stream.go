@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// queueEvents are the events that change an admin's request queue.
+var queueEvents = []string{eventRequestCreated, eventRequestRejected, eventIssueApproved, eventIssueReturned}
+
+const (
+	streamBuffer      = 64
+	streamKeepAlive   = 15 * time.Second
+	streamReplayLimit = 500
+)
+
+// EventHub fans the entries handed out by OutboxDispatcher out to the open
+// event streams.
+type EventHub struct {
+	mu          sync.Mutex
+	subscribers map[chan OutboxEntry]int
+}
+
+func NewEventHub() *EventHub {
+	return &EventHub{subscribers: make(map[chan OutboxEntry]int)}
+}
+
+// Subscribe returns a channel receiving the entries of libID and a function
+// that must be called once the subscriber is done.
+func (h *EventHub) Subscribe(libID int) (<-chan OutboxEntry, func()) {
+	ch := make(chan OutboxEntry, streamBuffer)
+	h.mu.Lock()
+	h.subscribers[ch] = libID
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subscribers[ch]; ok {
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Publish never blocks. A subscriber that has fallen a full buffer behind is
+// dropped instead; its channel is closed so the client reconnects and replays
+// what it missed from the outbox.
+func (h *EventHub) Publish(entry OutboxEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch, libID := range h.subscribers {
+		if libID != entry.LibID {
+			continue
+		}
+		select {
+		case ch <- entry:
+		default:
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+func isQueueEvent(event string) bool {
+	for _, e := range queueEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// writeStreamEvent writes entry in the text/event-stream format. The data is
+// the same JSON document webhooks receive.
+func writeStreamEvent(w io.Writer, entry OutboxEntry) error {
+	payload, err := entry.payload()
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", entry.ID, entry.Event, payload)
+	return err
+}
+
+// streamRequests serves GET /admin/requests/stream, a Server-Sent Events
+// stream of new requests, rejections, approvals and returns in the admin's
+// library. Event IDs are outbox IDs, so a client reconnecting with
+// Last-Event-ID first receives the events it missed.
+func (s *Server) streamRequests(c *gin.Context) {
+	admin := c.MustGet("user").(User)
+	entries, unsubscribe := s.events.Subscribe(admin.LibID)
+	defer unsubscribe()
+
+	lastID, _ := strconv.Atoi(c.GetHeader("Last-Event-ID"))
+	var missed []OutboxEntry
+	if lastID > 0 {
+		var err error
+		missed, err = s.store.Outbox.After(lastID, admin.LibID, streamReplayLimit)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	send := func(entry OutboxEntry) bool {
+		// Replayed entries may be published again once dispatched.
+		if entry.ID <= lastID || !isQueueEvent(entry.Event) {
+			return true
+		}
+		if err := writeStreamEvent(c.Writer, entry); err != nil {
+			return false
+		}
+		lastID = entry.ID
+		return true
+	}
+
+	for _, entry := range missed {
+		if !send(entry) {
+			return
+		}
+	}
+	c.Writer.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case entry, ok := <-entries:
+			if !ok || !send(entry) {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := io.WriteString(c.Writer, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+		c.Writer.Flush()
+	}
+}
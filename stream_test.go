@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type streamEvent struct {
+	id    int
+	event string
+}
+
+// readStreamEvent reads the next event from a text/event-stream, skipping
+// comments.
+func readStreamEvent(t *testing.T, r *bufio.Reader) streamEvent {
+	t.Helper()
+	var ev streamEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && ev.event != "":
+			return ev
+		case strings.HasPrefix(line, "id: "):
+			ev.id, _ = strconv.Atoi(strings.TrimPrefix(line, "id: "))
+		case strings.HasPrefix(line, "event: "):
+			ev.event = strings.TrimPrefix(line, "event: ")
+		}
+	}
+}
+
+func TestStreamReplaysFromLastEventID(t *testing.T) {
+	store, _ := newTestStore(t)
+	library, admin, book := seedLibrary(t, store, 1)
+	reader := &User{Name: "Ada", Email: "ada@example.org", Role: "reader", LibID: library.ID}
+	if err := store.Users.Create(reader); err != nil {
+		t.Fatal(err)
+	}
+	request := func() OutboxEntry {
+		t.Helper()
+		if err := store.RequestEvents.Create(&RequestEvent{BookID: book.ISBN, ReaderID: reader.ID, RequestType: requestTypeIssue, RequestDate: time.Now().UTC()}); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := store.Outbox.After(0, library.ID, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return entries[len(entries)-1]
+	}
+	seen := request()
+	missed := request()
+
+	events := NewEventHub()
+	s := &Server{store: store, events: events}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(func(c *gin.Context) { c.Set("user", *admin) })
+	router.GET("/admin/requests/stream", s.streamRequests)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/admin/requests/stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Last-Event-ID", strconv.Itoa(seen.ID))
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	stream := bufio.NewReader(resp.Body)
+
+	if got := readStreamEvent(t, stream); got != (streamEvent{missed.ID, eventRequestCreated}) {
+		t.Errorf("replayed %+v, want the missed request %d", got, missed.ID)
+	}
+
+	// The dispatcher publishes entries once dispatched, possibly after they
+	// were replayed; those and other libraries' events are not sent again.
+	live := request()
+	events.Publish(missed)
+	events.Publish(OutboxEntry{ID: live.ID + 100, Event: eventRequestCreated, LibID: library.ID + 1})
+	events.Publish(live)
+	if got := readStreamEvent(t, stream); got != (streamEvent{live.ID, eventRequestCreated}) {
+		t.Errorf("streamed %+v, want the new request %d", got, live.ID)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// FieldError describes why a single request field was rejected.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type ValidationErrors []FieldError
+
+func (errs ValidationErrors) Error() string {
+	messages := make([]string, 0, len(errs))
+	for _, e := range errs {
+		messages = append(messages, e.Field+": "+e.Message)
+	}
+	return "validation failed: " + strings.Join(messages, "; ")
+}
+
+func (errs *ValidationErrors) add(field, message string) {
+	*errs = append(*errs, FieldError{Field: field, Message: message})
+}
+
+// validateBook checks the inventory invariants that the CHECK constraints on
+// book_inventory also enforce, so clients get field-level errors instead of a
+// constraint failure. create is false for updates, where the ISBN comes from
+// the URL and availableCopies is ignored by BookRepository.Update. Invalid
+// books are reported as ValidationErrors; any other error means the library
+// could not be looked up.
+func validateBook(book *BookInventory, create bool, libraries LibraryRepository) error {
+	var errs ValidationErrors
+
+	book.ISBN = strings.TrimSpace(book.ISBN)
+	book.Title = strings.TrimSpace(book.Title)
+
+	if create && book.ISBN == "" {
+		errs.add("isbn", "is required")
+	}
+	if book.Title == "" {
+		errs.add("title", "is required")
+	}
+	if book.TotalCopies < 0 {
+		errs.add("totalCopies", "must not be negative")
+	}
+	if create && book.AvailableCopies < 0 {
+		errs.add("availableCopies", "must not be negative")
+	}
+	if create && book.AvailableCopies > book.TotalCopies {
+		errs.add("availableCopies", "must not exceed totalCopies")
+	}
+	if book.SeriesNumber < 0 {
+		errs.add("seriesNumber", "must not be negative")
+	}
+	if book.PublicationYear < 0 || book.PublicationYear > time.Now().Year()+1 {
+		errs.add("publicationYear", "is not a valid year")
+	}
+
+	exists, err := libraries.Exists(book.LibID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		errs.add("libID", fmt.Sprintf("library %d does not exist", book.LibID))
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
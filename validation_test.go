@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type fakeLibraries struct {
+	LibraryRepository
+	ids map[int]bool
+	err error
+}
+
+func (f fakeLibraries) Exists(id int) (bool, error) {
+	return f.ids[id], f.err
+}
+
+func TestValidateBook(t *testing.T) {
+	libraries := fakeLibraries{ids: map[int]bool{1: true}}
+	valid := func(edit func(book *BookInventory)) *BookInventory {
+		book := &BookInventory{ISBN: "9780306406157", Title: "Title", LibID: 1, TotalCopies: 3, AvailableCopies: 2}
+		edit(book)
+		return book
+	}
+
+	tests := []struct {
+		name   string
+		book   *BookInventory
+		create bool
+		fields []string
+	}{
+		{"valid", valid(func(b *BookInventory) {}), true, nil},
+		{"missing ISBN", valid(func(b *BookInventory) { b.ISBN = " " }), true, []string{"isbn"}},
+		{"ISBN from the URL", valid(func(b *BookInventory) { b.ISBN = "" }), false, nil},
+		{"blank title", valid(func(b *BookInventory) { b.Title = "  " }), true, []string{"title"}},
+		{"negative total", valid(func(b *BookInventory) { b.TotalCopies, b.AvailableCopies = -1, 0 }), true, []string{"totalCopies", "availableCopies"}},
+		{"more available than total", valid(func(b *BookInventory) { b.AvailableCopies = 4 }), true, []string{"availableCopies"}},
+		{"negative available", valid(func(b *BookInventory) { b.AvailableCopies = -1 }), true, []string{"availableCopies"}},
+		{"update lowering total", valid(func(b *BookInventory) { b.TotalCopies = 1 }), false, nil},
+		{"update with negative available", valid(func(b *BookInventory) { b.AvailableCopies = -1 }), false, nil},
+		{"negative series number", valid(func(b *BookInventory) { b.SeriesNumber = -1 }), true, []string{"seriesNumber"}},
+		{"year in the future", valid(func(b *BookInventory) { b.PublicationYear = time.Now().Year() + 2 }), true, []string{"publicationYear"}},
+		{"unknown library", valid(func(b *BookInventory) { b.LibID = 7 }), false, []string{"libID"}},
+	}
+	for _, tt := range tests {
+		err := validateBook(tt.book, tt.create, libraries)
+		var errs ValidationErrors
+		if err != nil && !errors.As(err, &errs) {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		}
+		var fields []string
+		for _, e := range errs {
+			fields = append(fields, e.Field)
+		}
+		if len(fields) != len(tt.fields) {
+			t.Errorf("%s: fields %v, want %v", tt.name, fields, tt.fields)
+			continue
+		}
+		for i := range fields {
+			if fields[i] != tt.fields[i] {
+				t.Errorf("%s: fields %v, want %v", tt.name, fields, tt.fields)
+				break
+			}
+		}
+	}
+
+	dbErr := errors.New("database is locked")
+	err := validateBook(valid(func(b *BookInventory) {}), true, fakeLibraries{err: dbErr})
+	if !errors.Is(err, dbErr) {
+		t.Errorf("failing library lookup: %v, want the lookup error", err)
+	}
+}
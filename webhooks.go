@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// webhookEvents are the domain events webhooks can subscribe to.
+var webhookEvents = []string{eventBookCreated, eventRequestCreated, eventRequestRejected, eventIssueApproved, eventIssueReturned, eventIssueOverdue}
+
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+)
+
+// A delivery is retried with exponential backoff starting at
+// webhookRetryBase and given up after webhookMaxAttempts, about an hour later.
+const (
+	webhookMaxAttempts = 8
+	webhookRetryBase   = 30 * time.Second
+	webhookTimeout     = 10 * time.Second
+	webhookBatchSize   = 50
+)
+
+// Webhook is an owner-registered URL that receives the events of one
+// library. Secret keys the X-Library-Signature header and is only shown when
+// the webhook is created.
+type Webhook struct {
+	ID        int       `json:"id"`
+	LibID     int       `json:"libID"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// WebhookDelivery is one event queued for one webhook, together with the
+// outcome of its latest attempt.
+type WebhookDelivery struct {
+	ID             int             `json:"id"`
+	WebhookID      int             `json:"webhookID"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	ResponseStatus int             `json:"responseStatus"`
+	Error          string          `json:"error"`
+	CreatedAt      time.Time       `json:"createdAt"`
+	NextAttemptAt  time.Time       `json:"nextAttemptAt"`
+	DeliveredAt    *time.Time      `json:"deliveredAt,omitempty"`
+
+	URL    string `json:"-"`
+	Secret string `json:"-"`
+}
+
+type webhookPayload struct {
+	Event      string      `json:"event"`
+	LibID      int         `json:"libID"`
+	OccurredAt time.Time   `json:"occurredAt"`
+	Data       interface{} `json:"data"`
+}
+
+func createWebhookTables() error {
+	createWebhookTablesSQL := []string{
+		`CREATE TABLE IF NOT EXISTS webhooks (
+        "ID" INTEGER PRIMARY KEY AUTOINCREMENT,
+        "LibID" INTEGER NOT NULL,
+        "URL" TEXT NOT NULL,
+        "Events" TEXT NOT NULL,
+        "Secret" TEXT NOT NULL,
+        "CreatedAt" TIMESTAMP NOT NULL,
+        FOREIGN KEY ("LibID") REFERENCES library("ID") ON DELETE RESTRICT
+    );`,
+		`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+        "ID" INTEGER PRIMARY KEY AUTOINCREMENT,
+        "WebhookID" INTEGER NOT NULL,
+        "Event" TEXT NOT NULL,
+        "Payload" TEXT NOT NULL,
+        "Status" TEXT NOT NULL,
+        "Attempts" INTEGER NOT NULL DEFAULT 0,
+        "ResponseStatus" INTEGER NOT NULL DEFAULT 0,
+        "Error" TEXT NOT NULL DEFAULT '',
+        "CreatedAt" TIMESTAMP NOT NULL,
+        "NextAttemptAt" TIMESTAMP NOT NULL,
+        "DeliveredAt" TIMESTAMP,
+        "OutboxID" INTEGER,
+        FOREIGN KEY ("WebhookID") REFERENCES webhooks("ID") ON DELETE CASCADE
+    );`,
+		`CREATE INDEX IF NOT EXISTS webhook_deliveries_due ON webhook_deliveries ("Status", "NextAttemptAt");`,
+		`CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook ON webhook_deliveries ("WebhookID", "ID");`,
+	}
+
+	for _, stmt := range createWebhookTablesSQL {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	if err := addColumnIfMissing("webhook_deliveries", "OutboxID", "INTEGER"); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS webhook_deliveries_outbox ON webhook_deliveries ("OutboxID", "WebhookID");`); err != nil {
+		return err
+	}
+	return nil
+}
+
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookDispatcher delivers queued webhook events.
+type WebhookDispatcher struct {
+	store  *Store
+	client *http.Client
+}
+
+func NewWebhookDispatcher(store *Store) *WebhookDispatcher {
+	return &WebhookDispatcher{store: store, client: &http.Client{Timeout: webhookTimeout}}
+}
+
+// Run delivers due events every interval until ctx is cancelled.
+func (d *WebhookDispatcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := d.DeliverDue(time.Now().UTC()); err != nil {
+			slog.Error("delivering webhooks", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// DeliverDue makes one attempt at every delivery that is due.
+func (d *WebhookDispatcher) DeliverDue(now time.Time) error {
+	for {
+		deliveries, err := d.store.Webhooks.DueDeliveries(now, webhookBatchSize)
+		if err != nil {
+			return err
+		}
+		for i := range deliveries {
+			d.attempt(&deliveries[i])
+			if err := d.store.Webhooks.UpdateDelivery(&deliveries[i]); err != nil {
+				return err
+			}
+		}
+		if len(deliveries) < webhookBatchSize {
+			return nil
+		}
+	}
+}
+
+// attempt POSTs the payload once and records the outcome on delivery. The
+// receiver must answer 2xx; anything else is retried until the attempts run
+// out.
+func (d *WebhookDispatcher) attempt(delivery *WebhookDelivery) {
+	delivery.Attempts++
+	delivery.ResponseStatus = 0
+	delivery.Error = ""
+
+	req, err := http.NewRequest(http.MethodPost, delivery.URL, strings.NewReader(string(delivery.Payload)))
+	if err == nil {
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Library-Event", delivery.Event)
+		req.Header.Set("X-Library-Delivery", strconv.Itoa(delivery.ID))
+		req.Header.Set("X-Library-Signature", signWebhook(delivery.Secret, delivery.Payload))
+
+		var resp *http.Response
+		resp, err = d.client.Do(req)
+		if err == nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+			delivery.ResponseStatus = resp.StatusCode
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				err = fmt.Errorf("receiver answered %s", resp.Status)
+			}
+		}
+	}
+
+	now := time.Now().UTC()
+	if err == nil {
+		delivery.Status = deliveryDelivered
+		delivery.DeliveredAt = &now
+		return
+	}
+	delivery.Error = err.Error()
+	if delivery.Attempts >= webhookMaxAttempts {
+		delivery.Status = deliveryFailed
+		return
+	}
+	delivery.NextAttemptAt = now.Add(webhookRetryBase << (delivery.Attempts - 1))
+}
+
+func validWebhookEvent(event string) bool {
+	for _, known := range webhookEvents {
+		if event == known {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) createWebhook(c *gin.Context) {
+	var hook Webhook
+	if err := c.ShouldBindJSON(&hook); err != nil {
+		respondError(c, badRequest(err.Error()))
+		return
+	}
+
+	if u, err := url.Parse(hook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		respondError(c, fieldError("url", "must be an absolute http or https URL"))
+		return
+	}
+	if len(hook.Events) == 0 {
+		respondError(c, fieldError("events", "must name at least one event").with("events", webhookEvents))
+		return
+	}
+	for _, event := range hook.Events {
+		if !validWebhookEvent(event) {
+			respondError(c, fieldError("events", "unknown event "+event).with("events", webhookEvents))
+			return
+		}
+	}
+	if hook.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			respondError(c, err)
+			return
+		}
+		hook.Secret = hex.EncodeToString(secret)
+	}
+	hook.CreatedAt = time.Now().UTC()
+
+	if err := s.store.Atomic(func(tx *Store) error {
+		if err := tx.Webhooks.Create(&hook); err != nil {
+			return err
+		}
+		logged := hook
+		logged.Secret = ""
+		return auditTx(c, tx, "create", "webhook", strconv.Itoa(hook.ID), nil, logged)
+	}); err != nil {
+		if errors.Is(err, errInvalidReference) {
+			respondError(c, invalidReference("libID does not name an existing library"))
+			return
+		}
+
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, hook)
+}
+
+// listWebhooks serves GET /owner/webhooks?libID=.
+func (s *Server) listWebhooks(c *gin.Context) {
+	libID := 0
+	if value := c.Query("libID"); value != "" {
+		var err error
+		if libID, err = strconv.Atoi(value); err != nil {
+			respondError(c, badRequest("Invalid libID"))
+			return
+		}
+	}
+
+	hooks, err := s.store.Webhooks.List(libID)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, hooks)
+}
+
+// deleteWebhook removes a webhook together with its delivery log.
+func (s *Server) deleteWebhook(c *gin.Context) {
+	id, ok := paramID(c, "id")
+	if !ok {
+		return
+	}
+
+	before, _ := s.store.Webhooks.Get(id)
+	if err := s.store.Atomic(func(tx *Store) error {
+		if err := tx.Webhooks.Delete(id); err != nil {
+			return err
+		}
+		return auditTx(c, tx, "delete", "webhook", strconv.Itoa(id), before, nil)
+	}); err != nil {
+		if errors.Is(err, errNotFound) {
+			respondError(c, notFoundError("Webhook not found"))
+			return
+		}
+
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Webhook deleted"})
+}
+
+// listWebhookDeliveries serves GET /owner/webhooks/:id/deliveries?limit=,
+// newest first.
+func (s *Server) listWebhookDeliveries(c *gin.Context) {
+	id, ok := paramID(c, "id")
+	if !ok {
+		return
+	}
+	limit := defaultAuditLimit
+	if value := c.Query("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+			respondError(c, badRequest("Invalid limit"))
+			return
+		}
+		if limit > maxAuditLimit {
+			limit = maxAuditLimit
+		}
+	}
+
+	if _, err := s.store.Webhooks.Get(id); err != nil {
+		if errors.Is(err, errNotFound) {
+			respondError(c, notFoundError("Webhook not found"))
+			return
+		}
+
+		respondError(c, err)
+		return
+	}
+	deliveries, err := s.store.Webhooks.ListDeliveries(id, limit)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, deliveries)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEnqueueStaysWithinLibrary(t *testing.T) {
+	store, _ := newTestStore(t)
+	now := time.Now().UTC()
+
+	hooks := map[int]*Webhook{}
+	for _, name := range []string{"North", "South"} {
+		library := &Library{Name: name}
+		if err := store.Libraries.Create(library); err != nil {
+			t.Fatal(err)
+		}
+		hook := &Webhook{LibID: library.ID, URL: "https://example.org/" + name, Events: []string{eventRequestCreated}, Secret: "s", CreatedAt: now}
+		if err := store.Webhooks.Create(hook); err != nil {
+			t.Fatal(err)
+		}
+		hooks[library.ID] = hook
+	}
+
+	for libID, hook := range hooks {
+		queued, err := store.Webhooks.Enqueue(libID, eventRequestCreated, libID, []byte(`{}`), now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if queued != 1 {
+			t.Errorf("library %d: queued %d deliveries, want 1", libID, queued)
+		}
+		deliveries, err := store.Webhooks.ListDeliveries(hook.ID, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(deliveries) != 1 {
+			t.Errorf("webhook of library %d has %d deliveries, want 1", libID, len(deliveries))
+		}
+	}
+
+	queued, err := store.Webhooks.Enqueue(100, eventRequestCreated, 0, []byte(`{}`), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queued != 0 {
+		t.Errorf("event without a library queued %d deliveries, want 0", queued)
+	}
+}
+
+func TestSignWebhook(t *testing.T) {
+	body := []byte(`{"event":"request.created"}`)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(body)
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	if got := signWebhook("secret", body); got != want {
+		t.Errorf("signWebhook = %q, want %q", got, want)
+	}
+	if signWebhook("other", body) == want {
+		t.Error("signature does not depend on the secret")
+	}
+}
+
+func TestWebhookAttemptBacksOff(t *testing.T) {
+	var signatures []string
+	status := http.StatusInternalServerError
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signatures = append(signatures, r.Header.Get("X-Library-Signature"))
+		w.WriteHeader(status)
+	}))
+	defer receiver.Close()
+
+	d := &WebhookDispatcher{client: receiver.Client()}
+	delivery := &WebhookDelivery{ID: 1, Event: eventRequestCreated, Payload: []byte(`{}`), Status: deliveryPending, URL: receiver.URL, Secret: "secret"}
+	for attempt := 1; attempt < webhookMaxAttempts; attempt++ {
+		before := time.Now().UTC()
+		d.attempt(delivery)
+		if delivery.Status != deliveryPending || delivery.ResponseStatus != status {
+			t.Fatalf("attempt %d: status %q, response %d", attempt, delivery.Status, delivery.ResponseStatus)
+		}
+		wait := webhookRetryBase << (attempt - 1)
+		if delay := delivery.NextAttemptAt.Sub(before); delay < wait || delay > wait+time.Second {
+			t.Errorf("attempt %d: next attempt in %v, want %v", attempt, delay, wait)
+		}
+	}
+
+	d.attempt(delivery)
+	if delivery.Status != deliveryFailed || delivery.Attempts != webhookMaxAttempts {
+		t.Errorf("after %d attempts: status %q, attempts %d, want %q", webhookMaxAttempts, delivery.Status, delivery.Attempts, deliveryFailed)
+	}
+	for _, signature := range signatures {
+		if signature != signWebhook("secret", delivery.Payload) {
+			t.Errorf("X-Library-Signature = %q", signature)
+		}
+	}
+
+	status = http.StatusNoContent
+	delivery = &WebhookDelivery{ID: 2, Event: eventRequestCreated, Payload: []byte(`{}`), Status: deliveryPending, URL: receiver.URL, Secret: "secret"}
+	d.attempt(delivery)
+	if delivery.Status != deliveryDelivered || delivery.DeliveredAt == nil {
+		t.Errorf("2xx answer left status %q", delivery.Status)
+	}
+}